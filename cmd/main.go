@@ -2,19 +2,25 @@ package main
 
 import (
 	"bufio" // Needed for scenario mode
+	"context"
 	"encoding/csv"
 	"fmt" // Needed for scenario mode
 	log "github.com/sirupsen/logrus"
 	Scenario "llm-context-management/internal/app/scenario" // Needed for scenario mode
 	Server "llm-context-management/internal/app/server"
 	SessionManager "llm-context-management/internal/app/session_manager"
+	ChatTemplate "llm-context-management/internal/pkg/chat_template"
 	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	ContextWindow "llm-context-management/internal/pkg/context_window"
 	Llama "llm-context-management/internal/pkg/llama_wrapper"
+	Tokenizer "llm-context-management/internal/pkg/tokenizer"
 	"os" // Needed for scenario mode
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv" // for CSV writing (duration to ms)
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -55,13 +61,41 @@ func main() {
 	const fredAddr = "141.23.28.210:9001" //"localhost:9001" // FIXME:
 	const fredKeygroup = "qwen15test"     // NOTE: we isolate models's sessions by keygroup
 	const fredCreateKeygroup = true       // Attempt to create keygroup if not exists
+	// Namespace of the tokenized context keys, "" uses "default". Give nodes sharing a keygroup but serving models with different tokenizers their own
+	const contextNamespace = ""
+	const tokenCodec = "" // Encoding of stored tokens: "json" (or ""), "packed", "varint", optionally with "+deflate", e.g. "varint+deflate"
+	const deltaChunks = 0 // Store only each turn's new tokens/messages in FReD, merging a context's chunks at this many; 0 rewrites the whole context every turn
 	const serverListenAddr = ":8081"
+	const llamaRequestTimeout = 5 * time.Minute          // Deadline of a single LLaMa.cpp request, including the generation
+	const turnWaitDeadline = 3 * time.Second             // How long a request waits for its previous turn to replicate before 409
+	const consistencyTokens = false                      // Responses carry a token for reading the turn on any node, they wait for the turn's context write
+	const shutdownTimeout = 30 * time.Second             // Deadline for in-flight completions and context updates on SIGINT/SIGTERM
 	const scenarioFilePath = "testdata/example_ruby.yml" // only in scenario mode
-	const rawHistoryLength = 20
+	const contextMaxTokens = 0                           // Token budget of prompt and answer, 0 uses the model's n_ctx from LLaMa.cpp
+	const contextReserveTokens = 256                     // Tokens kept free for the answer, unless a request sets n_predict/max_tokens
+	const compactionThreshold = 0                        // Stored context tokens that trigger summarizing older turns, 0 disables it (e.g. 1536 for -c 2048)
+	const compactionKeepTurns = 4                        // Newest turns kept verbatim by a compaction
+	const chatTemplatesPath = ""                         // optional JSON file with custom chat templates, e.g. "testdata/chat_templates.json"
+	const contextCacheBytes = 0                          // Memory for caching recently used contexts on this node, 0 disables the cache (e.g. 64 << 20)
+	const contextCacheTTL = 10 * time.Minute             // Maximum age of a cached context
+	// How tokenized contexts are sent: TokenizedBackendContext needs the llama.cpp-fastencode fork, TokenizedBackendPromptArray works with upstream llama.cpp
+	const tokenizedBackend = Server.TokenizedBackendContext
+	// GGUF model file or tokenizer.json of the served model for tokenizing in process, "" always uses LLaMa.cpp's /tokenize
+	const tokenizerPath = ""
+	// Tokenizers (GGUF or tokenizer.json) of the models other nodes serve, to convert tokenized contexts they wrote
+	conversionTokenizerPaths := []string{}
 
 	// --- Initialize common services ---
 	sessionManager := SessionManager.NewSQLiteSessionManager(dbPath)
 	llamaService := Llama.NewLlamaClient(llamaURL)
+	llamaService.Timeout = llamaRequestTimeout
+	contextWindow := ContextWindow.Policy{MaxTokens: contextMaxTokens, ReserveTokens: contextReserveTokens}
+	chatTemplates := ChatTemplate.NewRegistry()
+	if chatTemplatesPath != "" {
+		if err := chatTemplates.LoadFile(chatTemplatesPath); err != nil {
+			log.Fatalf("Failed to load chat templates: %v", err)
+		}
+	}
 	//redisContextStorage := ContextStorage.NewRedisContextStorage(redisAddr, "", 0)
 
 	// Initialize FReDContextStorage
@@ -69,18 +103,79 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialize FReDContextStorage: %v", err)
 	}
+	fredContextStorage.Keys = ContextStorage.KeySchema{Namespace: contextNamespace}
+	if fredContextStorage.TokenCodec, err = ContextStorage.ParseTokenCodec(tokenCodec); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	fredContextStorage.DeltaChunks = deltaChunks
 	log.Info("Successfully initialized FReDContextStorage.")
 
 	if runServerMode {
 		// --- Server Mode ---
 		log.Info("Starting in Server Mode...")
-		srv := Server.NewServer(llamaService, sessionManager, fredContextStorage) // redisContextStorage
-		defer srv.Stop()                                                          // Ensure cleanup on exit
-		log.Fatal(srv.Start(serverListenAddr))
+		var contextStorage ContextStorage.ContextStorage = fredContextStorage // redisContextStorage
+		if contextCacheBytes > 0 {
+			contextStorage = ContextStorage.NewCachingContextStorage(contextStorage, contextCacheBytes, contextCacheTTL)
+			log.Infof("Caching up to %d bytes of contexts for %s", contextCacheBytes, contextCacheTTL)
+		}
+		srv := Server.NewServer(llamaService, sessionManager, contextStorage)
+		defer srv.Stop() // Ensure cleanup on exit
+		turnWait := Server.DefaultTurnWaitPolicy
+		turnWait.Deadline = turnWaitDeadline
+		srv.SetTurnWaitPolicy(turnWait)
+		srv.SetConsistencyTokens(consistencyTokens)
+		srv.SetChatTemplates(chatTemplates)
+		if err := srv.SetTokenizedBackend(tokenizedBackend); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		srv.SetContextWindowPolicy(contextWindow)
+		compaction := ContextWindow.DefaultCompactionPolicy
+		compaction.ThresholdTokens = compactionThreshold
+		compaction.KeepTurns = compactionKeepTurns
+		srv.SetCompactionPolicy(compaction)
+		if tokenizerPath != "" {
+			if tokenizer, err := Tokenizer.Load(tokenizerPath); err != nil {
+				log.Warnf("Failed to load the native tokenizer, using LLaMa.cpp's /tokenize: %v", err)
+			} else {
+				log.Infof("Loaded native tokenizer from %s (%d tokens)", tokenizerPath, tokenizer.VocabSize())
+				srv.SetTokenizer(tokenizer)
+			}
+		}
+		for _, path := range conversionTokenizerPaths {
+			tokenizer, err := Tokenizer.Load(path)
+			if err != nil {
+				log.Fatalf("Failed to load conversion tokenizer %s: %v", path, err)
+			}
+			fingerprint, err := srv.AddConversionTokenizer(tokenizer)
+			if err != nil {
+				log.Fatalf("Failed to fingerprint conversion tokenizer %s: %v", path, err)
+			}
+			log.Infof("Loaded conversion tokenizer %s (fingerprint %s)", path, fingerprint)
+		}
+
+		sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stopSignals()
+		serverErr := make(chan error, 1)
+		go func() { serverErr <- srv.Start(serverListenAddr) }()
+
+		select {
+		case err := <-serverErr:
+			if err != nil {
+				log.Errorf("Server failed: %v", err)
+			}
+		case <-sigCtx.Done():
+			log.Infof("Received shutdown signal, draining server (deadline %s)...", shutdownTimeout)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Errorf("Graceful shutdown failed: %v", err)
+			}
+			cancel()
+		}
 
 	} else {
 		// --- Interactive Scenario Mode ---
 		log.Info("Starting in Interactive Scenario Mode...")
+		ctx := context.Background()
 
 		var csvFile *os.File
 		var csvWriter *csv.Writer
@@ -96,6 +191,25 @@ func main() {
 		log.Infof("Scenario.LoadScenario took %v", loadScenDuration)
 		log.Infof("Loaded scenario: %s", scen.Name)
 		log.Infof("Using model: %s", scen.ModelName)
+		chatTemplate, ok := chatTemplates.ForModel(scen.ModelName)
+		if !ok {
+			chatTemplate = chatTemplates.Default()
+		}
+		log.Infof("Using chat template: %s", chatTemplate.Name)
+		nCtx := 0
+		if contextMaxTokens <= 0 {
+			props, errProps := llamaService.Props(ctx)
+			if errProps != nil {
+				log.Fatalf("Failed to read LLaMa.cpp properties for the context size: %v", errProps)
+			}
+			nCtx = Llama.ContextSize(props)
+		}
+		promptBudget := contextWindow.PromptBudget(nCtx, 0)
+		log.Infof("Using a prompt budget of %d tokens", promptBudget)
+		countTokens := func(ctx context.Context, text string) (int, error) {
+			tokens, err := llamaService.Tokenize(ctx, text)
+			return len(tokens), err
+		}
 
 		// Create a new session for the scenario
 		createSessOpStartTime := time.Now()
@@ -174,7 +288,7 @@ func main() {
 				opStartTime = time.Now()
 				var fetchedMessages []ContextStorage.RawMessage
 				var fredTurn int
-				fetchedMessages, fredTurn, errCtx = fredContextStorage.GetRawSessionContext(sessionID)
+				fetchedMessages, fredTurn, _, errCtx = fredContextStorage.GetRawSessionContext(ctx, sessionID)
 				opDuration = time.Since(opStartTime)
 				log.Debugf("fredContextStorage.GetRawSessionContext took %v", opDuration)
 				writeOperationToCsv(csvWriter, opStartTime, "fredContextStorage.GetRawSessionContext", opDuration, contextMethod, scen.Name, sessionID, -1, -1, -1, currentTurn, fmt.Sprintf("MessageIndex: %d", i))
@@ -191,11 +305,15 @@ func main() {
 					log.Infof("No existing raw context found for session %s, starting fresh.", sessionID)
 				}
 
-				var textContextBuilder strings.Builder
-				for _, msg := range currentRawMessages {
-					textContextBuilder.WriteString(fmt.Sprintf("<|im_start|>%s\n%s<|im_end|>\n", msg.Role, msg.Content))
+				newTurn := []ContextStorage.RawMessage{{Role: "user", Content: message}}
+				promptMessages, droppedTurns, errFit := ContextWindow.FitMessages(ctx, currentRawMessages, newTurn, promptBudget, chatTemplate.Render, countTokens)
+				if errFit != nil {
+					log.Fatalf("Failed to fit raw context into the prompt budget: %v", errFit)
+				}
+				if droppedTurns > 0 {
+					log.Infof("Dropped the %d oldest turns to fit the prompt into %d tokens", droppedTurns, promptBudget)
 				}
-				prompt = textContextBuilder.String() + "<|im_start|>user\n" + message + "<|im_end|>\n"
+				prompt = chatTemplate.Render(append(promptMessages, newTurn...))
 
 				req = map[string]interface{}{
 					"model":       scen.ModelName,
@@ -210,7 +328,7 @@ func main() {
 				if i == 0 {
 					var fetchedTokens []int
 					var fredTurn int
-					fetchedTokens, fredTurn, errCtx = fredContextStorage.GetTokenizedSessionContext(sessionID)
+					fetchedTokens, fredTurn, _, errCtx = fredContextStorage.GetTokenizedSessionContext(ctx, sessionID)
 					opDuration = time.Since(opStartTime)
 					log.Infof("fredContextStorage.GetTokenizedSessionContext (initial) took %v", opDuration)
 					writeOperationToCsv(csvWriter, opStartTime, "fredContextStorage.GetTokenizedSessionContext (initial)", opDuration, contextMethod, scen.Name, sessionID, -1, -1, -1, currentTurn, fmt.Sprintf("MessageIndex: %d", i))
@@ -240,13 +358,38 @@ func main() {
 					"seed":        123,
 					"stream":      false,
 				}
-				if len(currentTokenizedContext) > 0 { // only add context if it's not empty
-					req["context"] = currentTokenizedContext
+				// The prompt array ends with the rendered turn, the context backend renders the message itself
+				promptText := prompt
+				if tokenizedBackend == Server.TokenizedBackendPromptArray {
+					promptText = chatTemplate.Render([]ContextStorage.RawMessage{{Role: "user", Content: message}}) + chatTemplate.GenerationPrompt
+				}
+				promptContext := currentTokenizedContext
+				if promptBudget > 0 {
+					promptTokens, errPrompt := countTokens(ctx, promptText)
+					if errPrompt != nil {
+						log.Fatalf("Failed to tokenize the prompt for the prompt budget: %v", errPrompt)
+					}
+					if contextBudget := promptBudget - promptTokens; len(currentTokenizedContext) > contextBudget {
+						markerTokens, errMarker := llamaService.Tokenize(ctx, chatTemplate.TurnMarker())
+						if errMarker != nil {
+							log.Fatalf("Failed to tokenize the turn marker for the prompt budget: %v", errMarker)
+						}
+						var droppedTurns int
+						promptContext, droppedTurns = ContextWindow.FitTokens(currentTokenizedContext, ContextWindow.TurnBoundaries(currentTokenizedContext, markerTokens), contextBudget)
+						if droppedTurns > 0 {
+							log.Infof("Dropped the %d oldest turns to fit the context into %d tokens", droppedTurns, contextBudget)
+						}
+					}
+				}
+				if tokenizedBackend == Server.TokenizedBackendPromptArray {
+					req["prompt"] = Llama.MixedPrompt(promptContext, promptText)
+				} else if len(promptContext) > 0 { // only add context if it's not empty
+					req["context"] = promptContext
 				}
 			}
 
 			opStartTime = time.Now()
-			resp, errCompletion := llamaService.Completion(req)
+			resp, errCompletion := llamaService.Completion(ctx, req)
 			opDuration = time.Since(opStartTime)
 			log.Infof("llamaService.Completion took %v", opDuration)
 			writeOperationToCsv(csvWriter, opStartTime, "llamaService.Completion", opDuration, contextMethod, scen.Name, sessionID, -1, len(prompt), len(currentTokenizedContext), currentTurn+1, fmt.Sprintf("MessageIndex: %d", i))
@@ -267,7 +410,7 @@ func main() {
 
 					// --- Update raw context in FReD ---
 					updateCtxOpStartTime := time.Now()
-					errUpdateCtx := fredContextStorage.UpdateRawSessionContext(sessionID, newHistory, currentTurn+1)
+					errUpdateCtx := fredContextStorage.UpdateRawSessionContext(ctx, sessionID, newHistory, currentTurn+1, ContextStorage.SessionMetadata{Owner: scen.UserID})
 					updateCtxOpDuration := time.Since(updateCtxOpStartTime)
 					log.Infof("fredContextStorage.UpdateRawSessionContext took %v", updateCtxOpDuration)
 					writeOperationToCsv(csvWriter, updateCtxOpStartTime, "fredContextStorage.UpdateRawSessionContext", updateCtxOpDuration, contextMethod, scen.Name, sessionID, -1, -1, len(newHistory), currentTurn+1, fmt.Sprintf("MessageIndex: %d", i))
@@ -294,11 +437,13 @@ func main() {
 				if contextMethod == "tokenized" {
 					// Construct the text for the new interaction part
 					// This format should match how the initial context was (or would have been) tokenized.
-					// Assuming the format is: <|im_start|>user\nUSER_MSG<|im_end|>\n<|im_start|>assistant\nASSISTANT_MSG<|im_end|>\n
-					newUserInteractionText := fmt.Sprintf("<|im_start|>user\n%s<|im_end|>\n<|im_start|>assistant\n%s<|im_end|>\n", message, assistantMsg)
+					newUserInteractionText := chatTemplate.Render([]ContextStorage.RawMessage{
+						{Role: "user", Content: message},
+						{Role: "assistant", Content: assistantMsg},
+					})
 
 					tokenizeNewOpStartTime := time.Now()
-					newInteractionTokens, errTokenize := llamaService.Tokenize(newUserInteractionText)
+					newInteractionTokens, errTokenize := llamaService.Tokenize(ctx, newUserInteractionText)
 					tokenizeNewOpDuration := time.Since(tokenizeNewOpStartTime)
 					log.Infof("llamaService.Tokenize (new interaction) took %v", tokenizeNewOpDuration)
 					writeOperationToCsv(csvWriter, tokenizeNewOpStartTime, "llamaService.Tokenize (new interaction)", tokenizeNewOpDuration, contextMethod, scen.Name, sessionID, -1, len(newUserInteractionText), -1, currentTurn+1, fmt.Sprintf("MessageIndex: %d", i))
@@ -315,7 +460,7 @@ func main() {
 
 						updateCtxOpStartTime := time.Now()
 						// Pass the complete, updated tokenized context to FReD
-						errUpdateCtx := fredContextStorage.UpdateSessionContext(sessionID, updatedFullTokenizedContext, currentTurn+1)
+						errUpdateCtx := fredContextStorage.UpdateSessionContext(ctx, sessionID, updatedFullTokenizedContext, currentTurn+1, ContextStorage.SessionMetadata{Owner: scen.UserID})
 						updateCtxOpDuration := time.Since(updateCtxOpStartTime)
 						log.Infof("fredContextStorage.UpdateSessionContext took %v", updateCtxOpDuration)
 						writeOperationToCsv(csvWriter, updateCtxOpStartTime, "fredContextStorage.UpdateSessionContext", updateCtxOpDuration, contextMethod, scen.Name, sessionID, -1, -1, len(updatedFullTokenizedContext), currentTurn+1, fmt.Sprintf("MessageIndex: %d", i))
@@ -353,7 +498,7 @@ func main() {
 					log.Printf("Deleted session %s.", sessionID)
 				}
 				delCtxStartTime := time.Now()
-				if errDelCtx := fredContextStorage.DeleteSessionContext(sessionID); errDelCtx != nil {
+				if errDelCtx := fredContextStorage.DeleteSessionContext(ctx, sessionID); errDelCtx != nil {
 					log.Printf("Failed to delete FReD context for session %s: %v", sessionID, errDelCtx)
 				} else {
 					log.Debugf("fredContextStorage.DeleteSessionContext took %v", time.Since(delCtxStartTime))
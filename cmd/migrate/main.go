@@ -0,0 +1,61 @@
+// Command migrate rewrites the session contexts stored before the key schema to its keys and envelope, see
+// context_storage.KeySchema. Run it from the repository root, like the server, so FReD's certificates are found:
+//
+//	go run ./cmd/migrate -backend fred -fred-addr 127.0.0.1:9001 -keygroup qwen15test -namespace qwen15 -dry-run
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+)
+
+func main() {
+	backend := flag.String("backend", "fred", "storage backend to migrate: fred or redis")
+	fredAddr := flag.String("fred-addr", "localhost:9001", "FReD node address")
+	fredKeygroup := flag.String("keygroup", "", "FReD keygroup to migrate")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "Redis address")
+	redisDB := flag.Int("redis-db", 0, "Redis database")
+	namespace := flag.String("namespace", ContextStorage.DefaultNamespace, "model namespace for the legacy tokenized contexts, as configured on the nodes")
+	dryRun := flag.Bool("dry-run", false, "only log what would be migrated")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	keys := ContextStorage.KeySchema{Namespace: *namespace}
+	var stats ContextStorage.MigrationStats
+	var err error
+	switch *backend {
+	case "fred":
+		if *fredKeygroup == "" {
+			log.Fatal("-keygroup is required for FReD")
+		}
+		storage, errInit := ContextStorage.NewFReDContextStorage(*fredAddr, *fredKeygroup, false)
+		if errInit != nil {
+			log.Fatalf("Failed to initialize FReDContextStorage: %v", errInit)
+		}
+		storage.Keys = keys
+		log.Infof("Migrating keygroup %s on %s (dry run: %t)", *fredKeygroup, *fredAddr, *dryRun)
+		stats, err = storage.MigrateLegacyKeys(ctx, *dryRun)
+	case "redis":
+		storage := ContextStorage.NewRedisContextStorage(*redisAddr, os.Getenv("REDIS_PASSWORD"), *redisDB)
+		storage.Keys = keys
+		log.Infof("Migrating Redis %s, database %d (dry run: %t)", *redisAddr, *redisDB, *dryRun)
+		stats, err = storage.MigrateLegacyKeys(ctx, *dryRun)
+	default:
+		log.Fatalf("Unknown backend %q, use fred or redis", *backend)
+	}
+	if err != nil {
+		log.Fatalf("Migration stopped (%s): %v", stats, err)
+	}
+	log.Infof("Migration finished: %s", stats)
+	if stats.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	ChatTemplate "llm-context-management/internal/pkg/chat_template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetChatTemplates replaces the registry used to render raw prompts and tokenized interactions. Call it before Start.
+func (s *Server) SetChatTemplates(registry *ChatTemplate.Registry) {
+	s.chatTemplates = registry
+}
+
+// llamaProps returns LLaMa.cpp's /props. A successful response is cached, the loaded model does not change at runtime.
+func (s *Server) llamaProps(ctx context.Context) (map[string]interface{}, error) {
+	s.llamaPropsMu.Lock()
+	defer s.llamaPropsMu.Unlock()
+	if s.cachedLlamaProps != nil {
+		return s.cachedLlamaProps, nil
+	}
+	opStartTime := time.Now()
+	props, err := s.llamaService.Props(ctx)
+	s.writeOperationToCsv(opStartTime, "llamaService.Props", time.Since(opStartTime), "", "ServerMode", "", -1, -1, -1, -1, -1, "")
+	if err != nil {
+		return nil, err // Not cached, so the next request tries again
+	}
+	s.cachedLlamaProps = props
+	return props, nil
+}
+
+// templateFor selects the chat template of a request: by the request's model first, then by the model LLaMa.cpp
+// reports in /props, falling back to ChatML.
+func (s *Server) templateFor(ctx context.Context, model string) *ChatTemplate.Template {
+	if t, ok := s.chatTemplates.ForModel(model); ok {
+		return t
+	}
+	props, err := s.llamaProps(ctx)
+	if err != nil {
+		log.Warnf("Could not read LLaMa.cpp properties to detect the chat template, using %s: %v", ChatTemplate.DefaultTemplateName, err)
+		return s.chatTemplates.Default()
+	}
+	if t, ok := s.chatTemplates.ForProps(props); ok {
+		return t
+	}
+	log.Warnf("Chat template of the loaded model is unknown, using %s", ChatTemplate.DefaultTemplateName)
+	return s.chatTemplates.Default()
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ChatTemplate "llm-context-management/internal/pkg/chat_template"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	ContextWindow "llm-context-management/internal/pkg/context_window"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const compactionTimeout = 2 * time.Minute // Deadline of a compaction, including the summary completion
+
+// errContextChanged aborts a compaction whose summarized turns are no longer the start of the stored context.
+var errContextChanged = errors.New("stored context changed during compaction")
+
+// SetCompactionPolicy replaces the policy for summarizing the older turns of long contexts. Call it before Start.
+func (s *Server) SetCompactionPolicy(policy ContextWindow.CompactionPolicy) {
+	s.compaction = policy
+}
+
+// startCompaction compacts the context just written for clientReq's turn in the background, if it passed the
+// threshold. Only one compaction per session runs at a time and none are started during shutdown.
+// The summary is generated without holding the session lock, so the next turn of the session is not delayed.
+func (s *Server) startCompaction(clientReq CompletionRequest, rawMessages []ContextStorage.RawMessage, tokens []int) {
+	if !s.compaction.Enabled() || s.shuttingDown.Load() {
+		return
+	}
+	if _, running := s.compacting.LoadOrStore(clientReq.SessionID, struct{}{}); running {
+		log.Debugf("Compaction of session %s is already running", clientReq.SessionID)
+		return
+	}
+	s.pendingUpdates.Add(1)
+	go func() {
+		defer s.pendingUpdates.Done()
+		defer s.compacting.Delete(clientReq.SessionID)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Recovered in compaction for session %s: %v", clientReq.SessionID, r)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), compactionTimeout)
+		defer cancel()
+		ctx = ContextStorage.WithVersions(ctx, &ContextStorage.Versions{}) // The compacted context replaces the one re-read
+		opStartTime := time.Now()
+		var err error
+		if clientReq.Mode == "raw" {
+			err = s.compactRawContext(ctx, clientReq, rawMessages)
+		} else {
+			err = s.compactTokenizedContext(ctx, clientReq, tokens)
+		}
+		if err != nil {
+			log.Warnf("Compaction of session %s failed after %s, the context is kept unchanged: %v", clientReq.SessionID, time.Since(opStartTime), err)
+		}
+	}()
+}
+
+// compactRawContext replaces the turns of history before the newest KeepTurns by a summary system message, which
+// follows the system prompt and includes the summary of earlier compactions.
+func (s *Server) compactRawContext(ctx context.Context, clientReq CompletionRequest, history []ContextStorage.RawMessage) error {
+	system, turns := ContextWindow.SplitTurns(history)
+	if len(turns) <= s.compaction.KeepTurns {
+		return nil
+	}
+	chatTemplate := s.templateFor(ctx, clientReq.Model)
+	// A token has at least one byte, so short contexts are not tokenized.
+	if rendered := chatTemplate.Render(history); len(rendered) <= s.compaction.ThresholdTokens {
+		return nil
+	} else if size, err := s.countTokens(ctx, rendered); err != nil {
+		return fmt.Errorf("failed to count context tokens: %w", err)
+	} else if size <= s.compaction.ThresholdTokens {
+		return nil
+	}
+
+	systemPrompt, previousSummary := ContextWindow.SplitSummary(system)
+	cut := len(system)
+	for _, turn := range turns[:len(turns)-s.compaction.KeepTurns] {
+		cut += len(turn)
+	}
+	summary, err := s.summarize(ctx, clientReq, chatTemplate, previousSummary, ContextWindow.Transcript(history[len(system):cut]))
+	if err != nil {
+		return err
+	}
+	prefix := append(slices.Clone(systemPrompt), ContextWindow.SummaryMessage(summary))
+
+	return s.writeCompaction(ctx, clientReq, func() (int, int, error) {
+		stored, turn, meta, err := s.contextStorage.GetRawSessionContext(ctx, clientReq.SessionID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(stored) < cut || !slices.Equal(stored[:cut], history[:cut]) {
+			return 0, 0, errContextChanged
+		}
+		compacted := append(prefix, stored[cut:]...)
+		meta.SystemMessages = len(prefix)
+		if err := s.contextStorage.UpdateRawSessionContext(ctx, clientReq.SessionID, compacted, turn, meta); err != nil {
+			return 0, 0, err
+		}
+		return len(stored), len(compacted), nil
+	})
+}
+
+// compactTokenizedContext replaces the turns of tokens before the newest KeepTurns by the tokens of a summary system
+// message. Turns are found by the template's turn marker. The tokens before the first turn (the system prompt) are kept,
+// except for the summary of an earlier compaction, which is extended by the new summary. The summary is rendered like
+// the system prompt and counted in the metadata's SystemMessages, so it is not taken for a turn, see renderContext.
+func (s *Server) compactTokenizedContext(ctx context.Context, clientReq CompletionRequest, tokens []int) error {
+	if len(tokens) <= s.compaction.ThresholdTokens {
+		return nil
+	}
+	chatTemplate := s.templateFor(ctx, clientReq.Model)
+	marker, err := s.messageMarkerTokens(ctx, chatTemplate, "user")
+	if err != nil {
+		return fmt.Errorf("failed to tokenize turn marker: %w", err)
+	}
+	boundaries := contextTurnBoundaries(chatTemplate, &clientReq, tokens, marker)
+	if len(boundaries) <= s.compaction.KeepTurns {
+		return nil
+	}
+	firstTurn := boundaries[0]
+	cut := boundaries[len(boundaries)-s.compaction.KeepTurns]
+
+	keptPrefix, previousSummary, err := s.splitTokenizedSummary(ctx, chatTemplate, tokens[:firstTurn])
+	if err != nil {
+		return err
+	}
+	transcript, err := s.llamaService.Detokenize(ctx, tokens[firstTurn:cut])
+	if err != nil {
+		return fmt.Errorf("failed to detokenize old turns: %w", err)
+	}
+	summary, err := s.summarize(ctx, clientReq, chatTemplate, previousSummary, transcript)
+	if err != nil {
+		return err
+	}
+	summaryText, _ := chatTemplate.RenderContext([]ContextStorage.RawMessage{ContextWindow.SummaryMessage(summary)})
+	summaryTokens, err := s.tokenize(ctx, summaryText)
+	if err != nil {
+		return fmt.Errorf("failed to tokenize summary: %w", err)
+	}
+	prefix := append(slices.Clone(keptPrefix), summaryTokens...)
+	systemMessages := clientReq.systemMessages
+	if previousSummary == "" {
+		systemMessages++
+	}
+
+	return s.writeCompaction(ctx, clientReq, func() (int, int, error) {
+		stored, turn, meta, err := s.contextStorage.GetTokenizedSessionContext(ctx, clientReq.SessionID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(stored) < cut || !slices.Equal(stored[:cut], tokens[:cut]) {
+			return 0, 0, errContextChanged
+		}
+		compacted := append(prefix, stored[cut:]...)
+		meta.SystemMessages = systemMessages
+		if err := s.contextStorage.UpdateSessionContext(ctx, clientReq.SessionID, compacted, turn, meta); err != nil {
+			return 0, 0, err
+		}
+		return len(stored), len(compacted), nil
+	})
+}
+
+// splitTokenizedSummary separates the summary of an earlier compaction from the tokens before the first turn.
+// The summary is the last system message of the prefix, if it starts with the summary header. Templates that merge
+// system messages into user messages render it as a user message, see RenderContext.
+func (s *Server) splitTokenizedSummary(ctx context.Context, chatTemplate *ChatTemplate.Template, prefix []int) ([]int, string, error) {
+	role := "system"
+	if chatTemplate.MergeSystem {
+		role = "user"
+	}
+	if chatTemplate.MessageMarker(role) == "" {
+		return prefix, "", nil
+	}
+	systemMarker, err := s.messageMarkerTokens(ctx, chatTemplate, role)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to tokenize system marker: %w", err)
+	}
+	starts := ContextWindow.TurnBoundaries(prefix, systemMarker)
+	if len(starts) == 0 {
+		return prefix, "", nil
+	}
+	last := starts[len(starts)-1]
+	text, err := s.llamaService.Detokenize(ctx, prefix[last:])
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to detokenize system prompt: %w", err)
+	}
+	_, summary, found := strings.Cut(text, ContextWindow.SummaryHeader)
+	if !found {
+		return prefix, "", nil
+	}
+	return prefix[:last], strings.TrimSpace(summary), nil
+}
+
+// summarize asks the LLM for a summary of transcript that extends previousSummary.
+func (s *Server) summarize(ctx context.Context, clientReq CompletionRequest, chatTemplate *ChatTemplate.Template, previousSummary string, transcript string) (string, error) {
+	prompt := chatTemplate.Render(ContextWindow.SummaryRequest(previousSummary, transcript)) + chatTemplate.GenerationPrompt
+	llamaReq := map[string]interface{}{
+		"model":       clientReq.Model,
+		"prompt":      prompt,
+		"n_predict":   s.compaction.SummaryTokens,
+		"temperature": 0,
+		"stream":      false,
+	}
+	opStartTime := time.Now()
+	resp, err := s.llamaService.Completion(ctx, llamaReq)
+	opDuration := time.Since(opStartTime)
+	log.Debugf("s.llamaService.Completion (summary) for session %s took %s", clientReq.SessionID, opDuration)
+	s.writeOperationToCsv(opStartTime, "llamaService.Completion", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(prompt), -1, clientReq.Turn, -1, "Compaction summary")
+	if err != nil {
+		return "", fmt.Errorf("failed to generate summary: %w", err)
+	}
+	summary, _ := resp["content"].(string)
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return "", errors.New("the LLM returned an empty summary")
+	}
+	return summary, nil
+}
+
+// writeCompaction runs write under the session lock. write re-reads the stored context, checks that the summarized
+// turns are still its start and stores the compacted context with the turn and metadata read with it, so turns that
+// were added in the meantime are kept and the metadata matches the compacted tokens or messages. It returns the context length before and after.
+func (s *Server) writeCompaction(ctx context.Context, clientReq CompletionRequest, write func() (int, int, error)) error {
+	sessionLock, err := s.sessionLocks.Acquire(ctx, clientReq.SessionID)
+	if err != nil {
+		return fmt.Errorf("failed to lock session: %w", err)
+	}
+	defer sessionLock.Unlock()
+
+	opStartTime := time.Now()
+	before, after, err := write()
+	opDuration := time.Since(opStartTime)
+	if err != nil {
+		return err
+	}
+	log.Infof("Compacted %s context of session %s from %d to %d (took %s)", clientReq.Mode, clientReq.SessionID, before, after, opDuration)
+	s.writeOperationToCsv(opStartTime, "contextStorage.Compaction", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, after, clientReq.Turn, -1, fmt.Sprintf("Before: %d", before))
+	return nil
+}
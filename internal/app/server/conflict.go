@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// contextConflictError is returned when the session's context has concurrent versions, e.g. because two edge nodes
+// accepted the same turn. Kept is the version the conflict was resolved to, nil if it could not be resolved.
+type contextConflictError struct {
+	Mode     string
+	Branches []ContextStorage.ConflictBranch
+	Kept     *ContextStorage.ConflictBranch
+	Err      error
+}
+
+func (e *contextConflictError) Error() string {
+	if e.Kept == nil {
+		return fmt.Sprintf("The session's %s context was updated concurrently: %v", e.Mode, e.Err)
+	}
+	return fmt.Sprintf("The session's %s context was updated concurrently, it continues from turn %d", e.Mode, e.Kept.Turn)
+}
+
+func (e *contextConflictError) Unwrap() error {
+	return e.Err
+}
+
+// conflictTurn is the newest turn of the concurrent versions of a context.
+func conflictTurn(conflict *ContextStorage.ConflictError) int {
+	turn := 0
+	for _, branch := range conflict.Branches {
+		turn = max(turn, branch.Turn)
+	}
+	return turn
+}
+
+// resolveConflict resolves the concurrent versions of the session's context, if the storage supports it, so that the
+// client can retry on the kept version. The request itself fails either way: its turn may follow a discarded version.
+func (s *Server) resolveConflict(ctx context.Context, clientReq *CompletionRequest, conflict *ContextStorage.ConflictError) error {
+	result := &contextConflictError{Mode: conflict.Mode, Branches: conflict.Branches, Err: conflict}
+	resolver, ok := s.contextStorage.(ContextStorage.ConflictResolver)
+	if !ok {
+		log.Errorf("Context of session %s has %d concurrent versions, the storage cannot resolve them", clientReq.SessionID, len(conflict.Branches))
+		return result
+	}
+
+	opStartTime := time.Now()
+	kept, err := resolver.ResolveConflict(ctx, clientReq.SessionID, conflict.Mode)
+	opDuration := time.Since(opStartTime)
+	if err != nil {
+		log.Errorf("Failed to resolve the concurrent versions of session %s (took %s): %v", clientReq.SessionID, opDuration, err)
+		s.writeOperationToCsv(opStartTime, "contextStorage.ResolveConflict", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, -1, clientReq.Turn, clientReq.Retries, fmt.Sprintf("Branches: %d, failed: %v", len(conflict.Branches), err))
+		return result
+	}
+	log.Warnf("Resolved %d concurrent versions of session %s to turn %d of request %q (took %s)", len(conflict.Branches), clientReq.SessionID, kept.Turn, kept.LastRequestID, opDuration)
+	s.writeOperationToCsv(opStartTime, "contextStorage.ResolveConflict", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, -1, kept.Turn, clientReq.Retries, fmt.Sprintf("Branches: %d", len(conflict.Branches)))
+	result.Kept = &kept
+	return result
+}
+
+// conflictDetails describes the versions of a context conflict in an error response. The reply of a version is only
+// known if its client sent a request_id, see sessionMetadata.
+func conflictDetails(sessionID string, conflict *contextConflictError) map[string]interface{} {
+	branch := func(b ContextStorage.ConflictBranch) map[string]interface{} {
+		details := map[string]interface{}{"turn": b.Turn}
+		if b.LastRequestID != "" {
+			details["request_id"] = b.LastRequestID
+			details["reply"] = b.LastReply
+		}
+		return details
+	}
+	branches := make([]map[string]interface{}, len(conflict.Branches))
+	for i, b := range conflict.Branches {
+		branches[i] = branch(b)
+	}
+	details := map[string]interface{}{
+		"session_id": sessionID,
+		"mode":       conflict.Mode,
+		"branches":   branches,
+	}
+	if conflict.Kept != nil {
+		details["kept"] = branch(*conflict.Kept)
+		details["expected_turn"] = conflict.Kept.Turn + 1
+	}
+	return details
+}
+
+// logUpdateError logs a failed context update after a completion. The reply was sent already, so a conflict with a
+// concurrent update of the session only shows up here; the next turn of the session resolves it.
+func logUpdateError(clientReq CompletionRequest, mode string, err error) {
+	var conflict *ContextStorage.ConflictError
+	if errors.As(err, &conflict) {
+		log.Errorf("Turn %d of session %s was stored next to a concurrent version of the %s context: %v", clientReq.Turn, clientReq.SessionID, mode, err)
+		return
+	}
+	log.Errorf("Failed to update %s session context for session %s: %v", mode, clientReq.SessionID, err)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+)
+
+// parseConsistencyToken parses the consistency_token echoed by the client, which must belong to its session.
+func (cr *CompletionRequest) parseConsistencyToken() error {
+	if cr.Consistency == "" {
+		return nil
+	}
+	token, err := ContextStorage.ParseConsistencyToken(cr.Consistency)
+	if err != nil {
+		return err
+	}
+	if token.SessionID != cr.SessionID {
+		return fmt.Errorf("the consistency token belongs to another session")
+	}
+	cr.readAfter = &token
+	return nil
+}
+
+// storageContext returns the ctx for the context reads of clientReq. They record the versions read in
+// clientReq.StoredVersions, so that its update is checked against them, and require the versions of the client's
+// consistency token, so that the reads include its previous turn. A context cache only answers them with that turn,
+// and not at all for a request with a request_id, which may retry a turn: the turn may have been stored on another
+// node after this node cached its previous one, and only the stored turn lets the idempotency and conflict checks see
+// the retry. The re-reads of waitForTurn (clientReq.Retries > 0) miss the cache anyway, a wrong turn drops the entry.
+func storageContext(ctx context.Context, clientReq *CompletionRequest) context.Context {
+	if clientReq.StoredVersions == nil {
+		clientReq.StoredVersions = &ContextStorage.Versions{}
+	}
+	ctx = ContextStorage.WithVersions(ctx, clientReq.StoredVersions)
+	if clientReq.RequestID == "" {
+		ctx = ContextStorage.WithExpectedTurn(ctx, clientReq.Turn-1)
+	}
+	if clientReq.readAfter != nil {
+		ctx = ContextStorage.WithConsistencyToken(ctx, *clientReq.readAfter)
+	}
+	return ctx
+}
+
+// SetConsistencyTokens makes responses of raw and tokenized requests carry a consistency token, for the client to
+// echo with its next request. The token holds the versions of the turn's write, so responses wait until the write is
+// acknowledged. Call it before Start.
+func (s *Server) SetConsistencyTokens(enabled bool) {
+	s.consistencyTokens = enabled
+}
+
+// reportWrite hands the consistency token of clientReq's acknowledged write to written, if a response waits for it.
+// clientReq.StoredVersions holds the versions the write recorded, which replaced those read for the written key.
+func reportWrite(written chan<- ContextStorage.ConsistencyToken, clientReq CompletionRequest) {
+	if written == nil {
+		return
+	}
+	written <- ContextStorage.NewConsistencyToken(clientReq.SessionID, clientReq.Turn, clientReq.StoredVersions)
+}
+
+// awaitConsistencyToken waits for the token of the turn's write, see startAsyncUpdate. It returns false if tokens are
+// disabled, the write failed or ctx ended first; the response then has no token.
+func awaitConsistencyToken(ctx context.Context, written <-chan ContextStorage.ConsistencyToken) (string, bool) {
+	if written == nil {
+		return "", false
+	}
+	select {
+	case token, ok := <-written:
+		if !ok {
+			return "", false
+		}
+		return token.Encode(), true
+	case <-ctx.Done():
+		return "", false
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	ChatTemplate "llm-context-management/internal/pkg/chat_template"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	ContextWindow "llm-context-management/internal/pkg/context_window"
+	Llama "llm-context-management/internal/pkg/llama_wrapper"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetContextWindowPolicy replaces the policy that fits stored contexts into the model's context. Call it before Start.
+func (s *Server) SetContextWindowPolicy(policy ContextWindow.Policy) {
+	s.contextWindow = policy
+}
+
+// promptBudget returns the token budget for the prompt of clientReq, 0 if it is unknown.
+func (s *Server) promptBudget(ctx context.Context, clientReq *CompletionRequest) int {
+	nCtx := 0
+	if s.contextWindow.MaxTokens <= 0 {
+		props, err := s.llamaProps(ctx)
+		if err != nil {
+			log.Warnf("Could not read LLaMa.cpp properties for the context size of session %s, not truncating: %v", clientReq.SessionID, err)
+			return 0
+		}
+		nCtx = Llama.ContextSize(props)
+	}
+	nPredict := 0
+	for _, key := range []string{"n_predict", "max_tokens"} {
+		if n, ok := clientReq.OtherParams[key].(float64); ok && n > 0 {
+			nPredict = int(n)
+		}
+	}
+	return s.contextWindow.PromptBudget(nCtx, nPredict)
+}
+
+// countTokens is the ContextWindow.TokenCounter, backed by the native tokenizer or LLaMa.cpp's /tokenize.
+func (s *Server) countTokens(ctx context.Context, text string) (int, error) {
+	tokens, err := s.tokenize(ctx, text)
+	return len(tokens), err
+}
+
+// fitRawMessages drops the oldest turns of the stored history, so that the prompt rendered from it and newTurn fits
+// into the budget. On failure the full history is used and LLaMa.cpp decides.
+func (s *Server) fitRawMessages(
+	ctx context.Context,
+	clientReq *CompletionRequest,
+	chatTemplate *ChatTemplate.Template,
+	history []ContextStorage.RawMessage,
+	newTurn []ContextStorage.RawMessage,
+) []ContextStorage.RawMessage {
+	budget := s.promptBudget(ctx, clientReq)
+	if budget <= 0 {
+		return history
+	}
+	opStartTime := time.Now()
+	kept, dropped, err := ContextWindow.FitMessages(ctx, history, newTurn, budget, chatTemplate.Render, s.countTokens)
+	opDuration := time.Since(opStartTime)
+	if err != nil {
+		log.Warnf("Could not fit raw context of session %s into %d tokens, using it unchanged: %v", clientReq.SessionID, budget, err)
+		return history
+	}
+	if dropped > 0 {
+		log.Infof("Dropped the %d oldest turns of session %s to fit the prompt into %d tokens (took %s)", dropped, clientReq.SessionID, budget, opDuration)
+		s.writeOperationToCsv(opStartTime, "contextWindow.FitMessages", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(kept), clientReq.Turn, clientReq.Retries, fmt.Sprintf("DroppedTurns: %d, Budget: %d", dropped, budget))
+	}
+	return kept
+}
+
+// fitTokenizedContext drops the oldest turns of a tokenized context, so that it fits into the budget together with
+// the prompt and extraTokens further context tokens. Turns are found by the tokens of the template's TurnMarker.
+// On failure the full context is used and LLaMa.cpp decides.
+func (s *Server) fitTokenizedContext(
+	ctx context.Context,
+	clientReq *CompletionRequest,
+	chatTemplate *ChatTemplate.Template,
+	tokens []int,
+	extraTokens int,
+) []int {
+	budget := s.promptBudget(ctx, clientReq)
+	// A token has at least one byte, so the prompt only needs to be tokenized if its byte length could exceed the budget.
+	if budget <= 0 || len(tokens)+extraTokens+len(clientReq.Prompt) <= budget {
+		return tokens
+	}
+	opStartTime := time.Now()
+	promptTokens, err := s.countTokens(ctx, clientReq.Prompt)
+	if err != nil {
+		log.Warnf("Could not count prompt tokens of session %s, using the context unchanged: %v", clientReq.SessionID, err)
+		return tokens
+	}
+	contextBudget := budget - promptTokens - extraTokens
+	if len(tokens) <= contextBudget {
+		return tokens
+	}
+	marker, err := s.messageMarkerTokens(ctx, chatTemplate, "user")
+	if err != nil {
+		log.Warnf("Could not tokenize the turn marker of template '%s', using the context of session %s unchanged: %v", chatTemplate.Name, clientReq.SessionID, err)
+		return tokens
+	}
+	kept, dropped := ContextWindow.FitTokens(tokens, contextTurnBoundaries(chatTemplate, clientReq, tokens, marker), contextBudget)
+	opDuration := time.Since(opStartTime)
+	if dropped == 0 {
+		log.Warnf("Tokenized context of session %s (%d tokens) exceeds the budget of %d tokens but has no turn boundaries of template '%s'", clientReq.SessionID, len(tokens), contextBudget, chatTemplate.Name)
+		return tokens
+	}
+	log.Infof("Dropped the %d oldest turns of session %s to fit the context into %d tokens (took %s)", dropped, clientReq.SessionID, contextBudget, opDuration)
+	s.writeOperationToCsv(opStartTime, "contextWindow.FitTokens", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(clientReq.Prompt), len(kept), clientReq.Turn, clientReq.Retries, fmt.Sprintf("DroppedTurns: %d, Budget: %d", dropped, contextBudget))
+	return kept
+}
+
+// renderContext renders messages of a tokenized context. If they start the context, they are rendered with
+// RenderContext, which keeps the system prompt apart from the first turn, and its system messages are recorded in
+// clientReq for the metadata.
+func renderContext(chatTemplate *ChatTemplate.Template, clientReq *CompletionRequest, messages []ContextStorage.RawMessage, startsContext bool) string {
+	if !startsContext {
+		return chatTemplate.Render(messages)
+	}
+	text, systemMessages := chatTemplate.RenderContext(messages)
+	clientReq.systemMessages = systemMessages
+	return text
+}
+
+// contextTurnBoundaries is ContextWindow.TurnBoundaries for the tokenized context of clientReq. Templates with
+// MergeSystem render the system prompt, and the summary of a compaction after it, as user messages, which are not
+// turns and kept like other system prompts.
+func contextTurnBoundaries(chatTemplate *ChatTemplate.Template, clientReq *CompletionRequest, tokens []int, marker []int) []int {
+	boundaries := ContextWindow.TurnBoundaries(tokens, marker)
+	if chatTemplate.MergeSystem && clientReq.systemMessages > 0 && len(boundaries) > 0 && boundaries[0] == 0 {
+		return boundaries[min(clientReq.systemMessages, len(boundaries)):]
+	}
+	return boundaries
+}
+
+// messageMarkerTokens returns the tokens of chatTemplate's MessageMarker for role, cached per template and role.
+func (s *Server) messageMarkerTokens(ctx context.Context, chatTemplate *ChatTemplate.Template, role string) ([]int, error) {
+	key := chatTemplate.Name + "/" + role
+	s.llamaPropsMu.Lock()
+	marker, ok := s.messageMarkers[key]
+	s.llamaPropsMu.Unlock()
+	if ok {
+		return marker, nil
+	}
+	marker, err := s.tokenize(ctx, chatTemplate.MessageMarker(role))
+	if err != nil {
+		return nil, err
+	}
+	s.llamaPropsMu.Lock()
+	s.messageMarkers[key] = marker
+	s.llamaPropsMu.Unlock()
+	return marker, nil
+}
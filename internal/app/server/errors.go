@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is the machine-readable code of an error response. Codes are stable, clients should match on them
+// instead of the message.
+type ErrorCode string
+
+const (
+	ErrCodeInvalidRequest          ErrorCode = "invalid_request"
+	ErrCodeNotFound                ErrorCode = "not_found" // No endpoint at the path
+	ErrCodeMethodNotAllowed        ErrorCode = "method_not_allowed"
+	ErrCodeInvalidMode             ErrorCode = "invalid_mode"
+	ErrCodeInvalidTurn             ErrorCode = "invalid_turn"
+	ErrCodeTurnConflict            ErrorCode = "turn_conflict"
+	ErrCodeModelMismatch           ErrorCode = "model_mismatch" // The tokenized context belongs to another model
+	ErrCodeModeConversionFailed    ErrorCode = "mode_conversion_failed"
+	ErrCodeContextConflict         ErrorCode = "context_conflict" // The context was updated concurrently, e.g. on two edge nodes
+	ErrCodeSessionNotFound         ErrorCode = "session_not_found"
+	ErrCodeSessionForbidden        ErrorCode = "session_forbidden"
+	ErrCodeUserNotFound            ErrorCode = "user_not_found"
+	ErrCodeSessionBusy             ErrorCode = "session_busy"      // Timed out waiting for the previous request of the session
+	ErrCodeTooManyRequests         ErrorCode = "too_many_requests" // Too many requests queued for the session
+	ErrCodeRequestCanceled         ErrorCode = "request_canceled"  // The client went away or its deadline passed
+	ErrCodeLLMUnavailable          ErrorCode = "llm_unavailable"   // LLaMa.cpp failed or could not be reached
+	ErrCodeContextStoreUnavailable ErrorCode = "context_store_unavailable"
+	ErrCodeShuttingDown            ErrorCode = "shutting_down"
+	ErrCodeInternal                ErrorCode = "internal_error"
+)
+
+// APIError is the body of every error response, wrapped in ErrorResponse.
+type APIError struct {
+	Code    ErrorCode              `json:"code"`
+	Status  int                    `json:"status"` // HTTP status code, repeated for errors reported inside an event stream
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"` // Code specific fields, e.g. expected_turn for turn_conflict
+}
+
+// ErrorResponse is the JSON envelope of error responses: {"error": {...}}.
+// The shape matches OpenAI's error responses, so OpenAI SDKs surface the message.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// newAPIError creates the error for status and code; details may be nil.
+func newAPIError(status int, code ErrorCode, message string, details map[string]interface{}) APIError {
+	return APIError{Code: code, Status: status, Message: message, Details: details}
+}
+
+// writeError sends a JSON error response. It replaces http.Error on all endpoints.
+func writeError(w http.ResponseWriter, status int, code ErrorCode, message string, details map[string]interface{}) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, ErrorResponse{Error: newAPIError(status, code, message, details)})
+}
+
+// routeErrors answers requests without a matching route of mux with an error envelope instead of the mux's plain text:
+// 405 if the path has routes for other methods, 404 otherwise.
+func routeErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &routeErrorWriter{ResponseWriter: w, r: r}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// routeErrorWriter replaces the mux's 404 and 405 responses by writeError, discarding their plain text body.
+type routeErrorWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (w *routeErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		w.replaced = true
+		writeError(w.ResponseWriter, status, ErrCodeNotFound, fmt.Sprintf("No endpoint at %s", w.r.URL.Path), nil)
+	case http.StatusMethodNotAllowed:
+		w.replaced = true
+		allowed := w.Header().Get("Allow") // Set by the mux
+		writeError(w.ResponseWriter, status, ErrCodeMethodNotAllowed, fmt.Sprintf("Method %s is not allowed on %s, use %s", w.r.Method, w.r.URL.Path, allowed), map[string]interface{}{"allow": allowed})
+	default:
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *routeErrorWriter) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
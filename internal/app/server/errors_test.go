@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"id": r.PathValue("id")})
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := routeErrors(mux)
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantCode   ErrorCode // Empty for the route's own response
+	}{
+		{method: http.MethodGet, path: "/sessions/s1", wantStatus: http.StatusOK},
+		{method: http.MethodPut, path: "/sessions/s1", wantStatus: http.StatusMethodNotAllowed, wantCode: ErrCodeMethodNotAllowed},
+		{method: http.MethodGet, path: "/nothing", wantStatus: http.StatusNotFound, wantCode: ErrCodeNotFound},
+		{method: http.MethodGet, path: "/sessions/s1/x", wantStatus: http.StatusNotFound, wantCode: ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body %q is not an error envelope: %v", rec.Body.String(), err)
+			}
+			if resp.Error.Code != tt.wantCode || resp.Error.Status != tt.wantStatus {
+				t.Errorf("error = %s/%d, want %s/%d", resp.Error.Code, resp.Error.Status, tt.wantCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed && rec.Header().Get("Allow") == "" {
+				t.Error("405 without an Allow header")
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	Tokenizer "llm-context-management/internal/pkg/tokenizer"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modelMismatchError is returned when a stored tokenized context was written for a model with another tokenizer
+// and cannot be converted.
+type modelMismatchError struct {
+	Stored string // Fingerprint stored with the context
+	Served string // Fingerprint of the model served by LLaMa.cpp
+}
+
+func (e *modelMismatchError) Error() string {
+	return fmt.Sprintf("The stored context was tokenized for another model (tokenizer %s, this node serves %s)", e.Stored, e.Served)
+}
+
+// AddConversionTokenizer registers the tokenizer of another model of the deployment, so that tokenized contexts
+// written by nodes serving that model can be converted. It returns the tokenizer's fingerprint. Call it before Start.
+func (s *Server) AddConversionTokenizer(tokenizer *Tokenizer.BPE) (string, error) {
+	fingerprint, err := Tokenizer.Fingerprint(context.Background(), tokenizer)
+	if err != nil {
+		return "", err
+	}
+	s.conversionTokenizers[fingerprint] = tokenizer
+	return fingerprint, nil
+}
+
+// modelFingerprint returns the tokenizer fingerprint of the model served by LLaMa.cpp. A successful result is
+// cached, like llamaProps.
+func (s *Server) modelFingerprint(ctx context.Context) (string, error) {
+	s.llamaPropsMu.Lock()
+	fingerprint := s.servedFingerprint
+	s.llamaPropsMu.Unlock()
+	if fingerprint != "" {
+		return fingerprint, nil
+	}
+
+	opStartTime := time.Now()
+	fingerprint, err := Tokenizer.Fingerprint(ctx, s.llamaService)
+	s.writeOperationToCsv(opStartTime, "tokenizer.Fingerprint", time.Since(opStartTime), "", "ServerMode", "", -1, -1, -1, -1, -1, fingerprint)
+	if err != nil {
+		return "", err
+	}
+	s.llamaPropsMu.Lock()
+	s.servedFingerprint = fingerprint
+	s.llamaPropsMu.Unlock()
+	log.Infof("Tokenizer fingerprint of the served model: %s", fingerprint)
+	return fingerprint, nil
+}
+
+// tokenizedMetadata is sessionMetadata for a tokenized context, stamped with the served model's fingerprint.
+// If the fingerprint is unknown it is left empty, and the context is accepted by any node.
+func (s *Server) tokenizedMetadata(ctx context.Context, clientReq CompletionRequest, assistantMsg string) ContextStorage.SessionMetadata {
+	meta := sessionMetadata(clientReq, assistantMsg)
+	fingerprint, err := s.modelFingerprint(ctx)
+	if err != nil {
+		log.Warnf("Storing the context of session %s without a tokenizer fingerprint: %v", clientReq.SessionID, err)
+	}
+	meta.Fingerprint = fingerprint
+	meta.SystemMessages = clientReq.systemMessages
+	return meta
+}
+
+// compatibleContext checks that tokens stored with fingerprint can be used with the served model. Tokens of
+// another model are detokenized with its conversion tokenizer and re-tokenized; if the other model uses another
+// chat template, the messages are parsed and rendered with the served model's. Otherwise a *modelMismatchError
+// is returned.
+func (s *Server) compatibleContext(ctx context.Context, clientReq *CompletionRequest, tokens []int, fingerprint string) ([]int, error) {
+	if fingerprint == "" || len(tokens) == 0 {
+		return tokens, nil // Written before fingerprints were stored, or nothing to convert
+	}
+	served, err := s.modelFingerprint(ctx)
+	if err != nil {
+		log.Warnf("Could not determine the served model's tokenizer fingerprint, using the context of session %s unchecked: %v", clientReq.SessionID, err)
+		return tokens, nil
+	}
+	if fingerprint == served {
+		return tokens, nil
+	}
+
+	mismatch := &modelMismatchError{Stored: fingerprint, Served: served}
+	source, ok := s.conversionTokenizers[fingerprint]
+	if !ok {
+		log.Warnf("Session %s: %v, and no conversion tokenizer is configured for it", clientReq.SessionID, mismatch)
+		return nil, mismatch
+	}
+	opStartTime := time.Now()
+	text, err := source.Decode(tokens)
+	if err != nil {
+		log.Warnf("Failed to detokenize the context of session %s with tokenizer %s: %v", clientReq.SessionID, fingerprint, err)
+		return nil, mismatch
+	}
+	chatTemplate := s.templateFor(ctx, clientReq.Model)
+	if !strings.Contains(text, chatTemplate.TurnMarker()) {
+		sourceTemplate, ok := s.chatTemplates.ForRendered(text)
+		if !ok {
+			log.Warnf("Session %s: %v, and its chat template is unknown", clientReq.SessionID, mismatch)
+			return nil, mismatch
+		}
+		messages, err := sourceTemplate.ParseContext(text, clientReq.systemMessages)
+		if err != nil {
+			log.Warnf("Failed to parse the context of session %s with chat template %s: %v", clientReq.SessionID, sourceTemplate.Name, err)
+			return nil, mismatch
+		}
+		text, clientReq.systemMessages = chatTemplate.RenderContext(messages)
+	}
+	converted, err := s.tokenize(ctx, text)
+	opDuration := time.Since(opStartTime)
+	s.writeOperationToCsv(opStartTime, "convertTokenizedContext", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(text), len(converted), clientReq.Turn, clientReq.Retries, fmt.Sprintf("From %s to %s, %d tokens before", fingerprint, served, len(tokens)))
+	if err != nil {
+		log.Errorf("Failed to re-tokenize the converted context of session %s: %v", clientReq.SessionID, err)
+		return nil, mismatch
+	}
+	log.Infof("Converted the context of session %s from tokenizer %s to %s (%d -> %d tokens, took %s)", clientReq.SessionID, fingerprint, served, len(tokens), len(converted), opDuration)
+	return converted, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	ChatTemplate "llm-context-management/internal/pkg/chat_template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// replyTokens collects the token IDs of the assistant reply from LLaMa.cpp /completion responses or stream chunks,
+// requested with "return_tokens". They are appended to the stored context instead of re-tokenizing the reply text.
+type replyTokens struct {
+	tokens   []int
+	missing  bool // A response had content but no tokens, e.g. from a llama.cpp version without return_tokens
+	stopWord bool // The text was cut at a stop word, so the tokens do not match the reply
+	eos      bool // The last token is the end-of-generation token, which is not part of the reply
+}
+
+// add takes the tokens of a response or chunk. Unless the client asked for them, they are removed from resp.
+func (r *replyTokens) add(resp map[string]interface{}, clientReq *CompletionRequest) {
+	rawTokens, ok := resp["tokens"].([]interface{})
+	if !clientReq.hasParam("return_tokens") {
+		delete(resp, "tokens")
+	}
+	if !ok {
+		if content, _ := resp["content"].(string); content != "" {
+			r.missing = true
+		}
+	}
+	for _, rawToken := range rawTokens {
+		token, isNumber := rawToken.(float64)
+		if !isNumber {
+			r.missing = true
+			return
+		}
+		r.tokens = append(r.tokens, int(token))
+	}
+
+	stopType, _ := resp["stop_type"].(string)
+	if stoppedWord, _ := resp["stopped_word"].(bool); stoppedWord || stopType == "word" {
+		r.stopWord = true
+	}
+	if stoppedEOS, _ := resp["stopped_eos"].(bool); stoppedEOS || stopType == "eos" {
+		r.eos = true
+	}
+}
+
+// result returns the reply's token IDs, or nil if they cannot be used and the reply has to be re-tokenized.
+func (r *replyTokens) result() []int {
+	if r.missing || r.stopWord || len(r.tokens) == 0 {
+		return nil
+	}
+	if r.eos {
+		return r.tokens[:len(r.tokens)-1]
+	}
+	return r.tokens
+}
+
+// interactionTokens returns the tokens of clientReq's turn for the stored context: the tokenized new messages and
+// assistant header, the generated tokens and the tokens ending the assistant message. Only the new messages and
+// the template markers are tokenized, the reply keeps the token boundaries the model generated.
+// startsContext is true if the turn is the start of the stored context, see renderContext.
+func (s *Server) interactionTokens(ctx context.Context, clientReq *CompletionRequest, chatTemplate *ChatTemplate.Template, startsContext bool) ([]int, error) {
+	turnText := renderContext(chatTemplate, clientReq, clientReq.turnMessages(), startsContext) + chatTemplate.GenerationPrompt
+	opStartTime := time.Now()
+	turnTokens, err := s.tokenize(ctx, turnText)
+	opDuration := time.Since(opStartTime)
+	log.Debugf("%s (new turn) for session %s took %s", s.tokenizeOp(), clientReq.SessionID, opDuration)
+	s.writeOperationToCsv(opStartTime, s.tokenizeOp(), opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(turnText), -1, clientReq.Turn, clientReq.Retries, fmt.Sprintf("New turn, GeneratedTokens: %d", len(clientReq.GeneratedTokens)))
+	if err != nil {
+		return nil, err
+	}
+	suffixTokens, err := s.messageSuffixTokens(ctx, chatTemplate, "assistant")
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]int, 0, len(turnTokens)+len(clientReq.GeneratedTokens)+len(suffixTokens))
+	tokens = append(tokens, turnTokens...)
+	tokens = append(tokens, clientReq.GeneratedTokens...)
+	return append(tokens, suffixTokens...), nil
+}
+
+// messageSuffixTokens returns the tokens of chatTemplate's MessageSuffix for role, cached like the message markers.
+func (s *Server) messageSuffixTokens(ctx context.Context, chatTemplate *ChatTemplate.Template, role string) ([]int, error) {
+	key := chatTemplate.Name + "/" + role + "/suffix"
+	s.llamaPropsMu.Lock()
+	suffix, ok := s.messageMarkers[key]
+	s.llamaPropsMu.Unlock()
+	if ok {
+		return suffix, nil
+	}
+	suffix, err := s.tokenize(ctx, chatTemplate.MessageSuffix(role))
+	if err != nil {
+		return nil, err
+	}
+	s.llamaPropsMu.Lock()
+	s.messageMarkers[key] = suffix
+	s.llamaPropsMu.Unlock()
+	return suffix, nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionMetadata returns the metadata stored with the context written for clientReq's turn.
+// The assistant reply is only kept if the client sent a request_id, so sessions without retries do not replicate it.
+func sessionMetadata(clientReq CompletionRequest, assistantMsg string) ContextStorage.SessionMetadata {
+	meta := ContextStorage.SessionMetadata{Owner: clientReq.UserID}
+	if clientReq.RequestID != "" {
+		meta.LastRequestID = clientReq.RequestID
+		meta.LastReply = assistantMsg
+	}
+	return meta
+}
+
+// storedReply checks whether a turn mismatch is a retry of the last applied turn, i.e. the client did not receive the
+// answer of a request that was processed. It returns the stored reply if the turn and request_id both match.
+func (s *Server) storedReply(ctx context.Context, clientReq *CompletionRequest, loadErr error) (string, bool) {
+	var mismatch *turnMismatchError
+	if clientReq.RequestID == "" || !errors.As(loadErr, &mismatch) || mismatch.ServerTurn != clientReq.Turn {
+		return "", false
+	}
+
+	opStartTime := time.Now()
+	meta, err := s.contextStorage.GetSessionMetadata(ctx, clientReq.SessionID)
+	s.writeOperationToCsv(opStartTime, "contextStorage.GetSessionMetadata", time.Since(opStartTime), clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, -1, clientReq.Turn, clientReq.Retries, fmt.Sprintf("Replay RequestID: %s", clientReq.RequestID))
+	if err != nil {
+		log.Warnf("Could not read stored reply of session %s for request %s: %v", clientReq.SessionID, clientReq.RequestID, err)
+		return "", false
+	}
+	if meta.LastRequestID != clientReq.RequestID {
+		log.Infof("Turn %d of session %s was applied by request %q, not %q", clientReq.Turn, clientReq.SessionID, meta.LastRequestID, clientReq.RequestID)
+		return "", false
+	}
+	log.Infof("Replaying stored reply of turn %d for retried request %s in session %s", clientReq.Turn, clientReq.RequestID, clientReq.SessionID)
+	return meta.LastReply, true
+}
+
+// writeReplayedCompletion answers a retried /completion request with the stored reply, as JSON or as a single event stream chunk.
+func writeReplayedCompletion(w http.ResponseWriter, clientReq CompletionRequest, effectiveUserID string, reply string) {
+	resp := map[string]interface{}{
+		"content":    reply,
+		"stop":       true,
+		"session_id": clientReq.SessionID,
+		"user_id":    effectiveUserID,
+		"mode":       clientReq.Mode,
+		"request_id": clientReq.RequestID,
+		"replayed":   true,
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	if !clientReq.Stream {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	writeReplayStream(w, clientReq.SessionID, resp, false)
+}
+
+// writeReplayedChatCompletion answers a retried /v1/chat/completions request with the stored reply in the OpenAI format.
+func writeReplayedChatCompletion(w http.ResponseWriter, clientReq CompletionRequest, effectiveUserID string, reply string) {
+	id := "chatcmpl-" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	created := time.Now().Unix()
+	llamaResp := map[string]interface{}{"content": reply, "stop": true}
+
+	var resp map[string]interface{}
+	if clientReq.Stream {
+		resp = chatChunkFromLlama(llamaResp, id, created, clientReq.Model, true)
+	} else {
+		resp = chatCompletionFromLlama(llamaResp, id, created, clientReq.Model)
+		delete(resp, "usage") // The token counts of the original generation are not stored
+	}
+	resp["session_id"] = clientReq.SessionID
+	resp["user_id"] = effectiveUserID
+	resp["mode"] = clientReq.Mode
+	resp["request_id"] = clientReq.RequestID
+	resp["replayed"] = true
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	if !clientReq.Stream {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	writeReplayStream(w, clientReq.SessionID, resp, true)
+}
+
+// writeReplayStream sends payload as a complete, single event stream, optionally terminated by "[DONE]".
+func writeReplayStream(w http.ResponseWriter, sessionID string, payload interface{}, done bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Streaming is not supported", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := writeSSEEvent(w, flusher, payload); err != nil {
+		log.Debugf("Could not write replayed event for session %s: %v", sessionID, err)
+		return
+	}
+	if done {
+		if _, err := fmt.Fprint(w, "data: [DONE]\n\n"); err == nil {
+			flusher.Flush()
+		}
+	}
+}
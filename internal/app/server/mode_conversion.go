@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modeConversionError is returned when a session switched modes and its stored context could not be converted.
+type modeConversionError struct {
+	From, To string
+	Err      error
+}
+
+func (e *modeConversionError) Error() string {
+	return fmt.Sprintf("The session's %s context could not be converted to %s: %v", e.From, e.To, e.Err)
+}
+
+func (e *modeConversionError) Unwrap() error {
+	return e.Err
+}
+
+// readTokenizedForConversion reads the session's context as tokens, for a raw request that found no raw context of
+// the previous turn. Raw and tokenized contexts are stored under separate keys, so the raw one may be left from
+// before a mode switch. It returns the tokens, turn and metadata and false if the session has no tokenized
+// context newer than ownTurn, the turn of its raw context.
+func (s *Server) readTokenizedForConversion(ctx context.Context, clientReq *CompletionRequest, ownTurn int) ([]int, int, ContextStorage.SessionMetadata, bool) {
+	if clientReq.Turn <= 1 {
+		return nil, 0, ContextStorage.SessionMetadata{}, false // A new session, nothing to convert
+	}
+	opStartTime := time.Now()
+	tokens, turn, meta, err := s.contextStorage.GetTokenizedSessionContext(ctx, clientReq.SessionID)
+	s.writeOperationToCsv(opStartTime, "contextStorage.GetTokenizedSessionContext", time.Since(opStartTime), clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(tokens), turn, clientReq.Retries, "Mode switch")
+	if err != nil || tokens == nil || turn <= ownTurn {
+		return nil, 0, ContextStorage.SessionMetadata{}, false
+	}
+	log.Infof("Session %s has a tokenized context (length %d, turn %d), converting it for the raw request", clientReq.SessionID, len(tokens), turn)
+	return tokens, turn, meta, true
+}
+
+// readRawForConversion reads the session's context as messages, for a tokenized request that found no tokenized
+// context of the previous turn. It returns false if the session has no raw context newer than ownTurn.
+func (s *Server) readRawForConversion(ctx context.Context, clientReq *CompletionRequest, ownTurn int) ([]ContextStorage.RawMessage, int, bool) {
+	if clientReq.Turn <= 1 {
+		return nil, 0, false
+	}
+	opStartTime := time.Now()
+	messages, turn, _, err := s.contextStorage.GetRawSessionContext(ctx, clientReq.SessionID)
+	s.writeOperationToCsv(opStartTime, "contextStorage.GetRawSessionContext", time.Since(opStartTime), clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(messages), turn, clientReq.Retries, "Mode switch")
+	if err != nil || messages == nil || turn <= ownTurn {
+		return nil, 0, false
+	}
+	log.Infof("Session %s has a raw context (message count %d, turn %d), converting it for the tokenized request", clientReq.SessionID, len(messages), turn)
+	return messages, turn, true
+}
+
+// rawFromTokenized converts a tokenized context, stored with meta, to messages: the tokens are detokenized and split
+// at the markers of the chat template, and the system prompt gets its role back, see ChatTemplate.Template.ParseContext.
+// Tokens of another model are converted to the served model's first, see compatibleContext.
+func (s *Server) rawFromTokenized(ctx context.Context, clientReq *CompletionRequest, tokens []int, meta ContextStorage.SessionMetadata) ([]ContextStorage.RawMessage, error) {
+	clientReq.systemMessages = meta.SystemMessages
+	tokens, err := s.compatibleContext(ctx, clientReq, tokens, meta.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	opStartTime := time.Now()
+	text, err := s.llamaService.Detokenize(ctx, tokens)
+	if err != nil {
+		log.Errorf("Failed to detokenize the context of session %s: %v", clientReq.SessionID, err)
+		return nil, &modeConversionError{From: "tokenized", To: "raw", Err: err}
+	}
+	chatTemplate := s.templateFor(ctx, clientReq.Model)
+	messages, err := chatTemplate.ParseContext(text, clientReq.systemMessages)
+	opDuration := time.Since(opStartTime)
+	s.writeOperationToCsv(opStartTime, "convertContextMode", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(text), len(tokens), clientReq.Turn, clientReq.Retries, fmt.Sprintf("Tokenized to raw, messages: %d", len(messages)))
+	if err != nil {
+		log.Errorf("Failed to parse the detokenized context of session %s: %v", clientReq.SessionID, err)
+		return nil, &modeConversionError{From: "tokenized", To: "raw", Err: err}
+	}
+	log.Infof("Converted the tokenized context of session %s to %d messages (took %s)", clientReq.SessionID, len(messages), opDuration)
+	return messages, nil
+}
+
+// tokenizedFromRaw converts a raw context to tokens, by rendering it with the chat template and tokenizing it.
+func (s *Server) tokenizedFromRaw(ctx context.Context, clientReq *CompletionRequest, messages []ContextStorage.RawMessage) ([]int, error) {
+	opStartTime := time.Now()
+	text := renderContext(s.templateFor(ctx, clientReq.Model), clientReq, messages, true)
+	tokens, err := s.tokenize(ctx, text)
+	opDuration := time.Since(opStartTime)
+	s.writeOperationToCsv(opStartTime, "convertContextMode", opDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(text), len(tokens), clientReq.Turn, clientReq.Retries, fmt.Sprintf("Raw to tokenized, messages: %d", len(messages)))
+	if err != nil {
+		log.Errorf("Failed to tokenize the raw context of session %s: %v", clientReq.SessionID, err)
+		return nil, &modeConversionError{From: "raw", To: "tokenized", Err: err}
+	}
+	log.Infof("Converted the raw context of session %s to %d tokens (took %s)", clientReq.SessionID, len(tokens), opDuration)
+	return tokens, nil
+}
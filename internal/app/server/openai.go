@@ -0,0 +1,524 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	SessionManager "llm-context-management/internal/app/session_manager"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// ChatCompletionRequest is an OpenAI-compatible chat completion request extended with DisCEdge's session fields.
+// The messages are the new messages of this turn; the stored session context is prepended by the server.
+type ChatCompletionRequest struct {
+	Model       string                      `json:"model"`
+	Messages    []ContextStorage.RawMessage `json:"messages"`
+	Stream      bool                        `json:"stream"`
+	User        string                      `json:"user,omitempty"`       // OpenAI end-user identifier, used when user_id is empty
+	Mode        string                      `json:"mode,omitempty"`       // "raw" (default), "tokenized", or "client-side"
+	SessionID   string                      `json:"session_id,omitempty"` // Session extension, same semantics as in CompletionRequest
+	UserID      string                      `json:"user_id,omitempty"`
+	Turn        int                         `json:"turn"`
+	RequestID   string                      `json:"request_id,omitempty"`        // Idempotency key, see CompletionRequest
+	Consistency string                      `json:"consistency_token,omitempty"` // See CompletionRequest
+	OtherParams map[string]interface{}      `json:"-"`                           // Catches other params (temperature, max_tokens, ...) for forwarding
+}
+
+// UnmarshalJSON custom unmarshaller to capture extra fields for forwarding.
+func (cr *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
+	type Alias ChatCompletionRequest
+	aux := &struct {
+		*Alias
+	}{
+		Alias: (*Alias)(cr),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	var allFields map[string]interface{}
+	if err := json.Unmarshal(data, &allFields); err != nil {
+		return err
+	}
+	if _, found := allFields["context"]; found {
+		return errors.New("the 'context' field is not allowed in the request body")
+	}
+
+	// Remove known fields that are explicitly handled
+	delete(allFields, "model")
+	delete(allFields, "messages")
+	delete(allFields, "stream")
+	delete(allFields, "user")
+	delete(allFields, "mode")
+	delete(allFields, "session_id")
+	delete(allFields, "user_id")
+	delete(allFields, "turn")
+	delete(allFields, "request_id")
+	delete(allFields, "consistency_token")
+
+	cr.OtherParams = allFields
+	return nil
+}
+
+// handleChatCompletions handles requests to the OpenAI-compatible /v1/chat/completions endpoint.
+// In raw and client-side mode the request is served by llama.cpp's chat endpoint, which applies the model's chat template.
+// In tokenized mode the stored tokens are sent to /completion and the reply is converted into the OpenAI format.
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	handleStartTime := time.Now()
+	var clientReq CompletionRequest
+	defer func() {
+		log.Infof("handleChatCompletions for session %s took %s", clientReq.SessionID, time.Since(handleStartTime))
+	}()
+
+	if r.Method != http.MethodPost {
+		log.Warnf("Invalid method %s received from %s", r.Method, r.RemoteAddr)
+		writeError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Only POST method is allowed", nil)
+		return
+	}
+
+	requestSize := r.ContentLength
+	log.Infof("Received chat request from %s with content length: %d bytes", r.RemoteAddr, requestSize)
+
+	var chatReq ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&chatReq); err != nil {
+		log.Errorf("Failed to decode chat request body from %s: %v", r.RemoteAddr, err)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err), nil)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(chatReq.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The 'messages' field must contain at least one message.", nil)
+		return
+	}
+	if chatReq.Mode == "" {
+		chatReq.Mode = "raw"
+	}
+	if chatReq.Mode != "raw" && chatReq.Mode != "tokenized" && chatReq.Mode != "client-side" {
+		log.Warnf("Invalid mode '%s' requested for chat completion", chatReq.Mode)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidMode, fmt.Sprintf("Invalid mode: %s. Use 'raw', 'tokenized', or 'client-side'", chatReq.Mode), nil)
+		return
+	}
+	lastMessage := chatReq.Messages[len(chatReq.Messages)-1]
+	if chatReq.Mode == "tokenized" && lastMessage.Role != "user" {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "In 'tokenized' mode the last message must have the 'user' role.", nil)
+		return
+	}
+
+	clientReq = CompletionRequest{
+		Mode:        chatReq.Mode,
+		SessionID:   chatReq.SessionID,
+		UserID:      chatReq.UserID,
+		Turn:        chatReq.Turn,
+		Prompt:      lastMessage.Content,
+		Model:       chatReq.Model,
+		Stream:      chatReq.Stream,
+		OtherParams: chatReq.OtherParams,
+		Messages:    chatReq.Messages,
+		RequestID:   chatReq.RequestID,
+		Consistency: chatReq.Consistency,
+	}
+	if clientReq.UserID == "" {
+		clientReq.UserID = chatReq.User
+	}
+
+	s.writeOperationToCsv(handleStartTime, "Network.Request.Size", -1, clientReq.Mode, "ServerMode", clientReq.SessionID, int(requestSize), len(clientReq.Prompt), -1, clientReq.Turn, -1, "Endpoint: /v1/chat/completions")
+	log.Infof(">> Received chat completion request from %s with %d messages <<", r.RemoteAddr, len(chatReq.Messages))
+
+	effectiveUserID, err := s.resolveSession(ctx, &clientReq)
+	if err != nil {
+		writeSessionError(w, clientReq.SessionID, err)
+		return
+	}
+	if err := clientReq.parseConsistencyToken(); err != nil {
+		log.Warnf("Rejected consistency token for session %s: %v", clientReq.SessionID, err)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error(), map[string]interface{}{"session_id": clientReq.SessionID})
+		return
+	}
+
+	sessionLock := s.acquireSessionLock(w, r, clientReq.SessionID)
+	if sessionLock == nil {
+		return
+	}
+
+	if clientReq.Turn < 1 {
+		log.Errorf("Invalid turn number for session %s. Client turn: %d", clientReq.SessionID, clientReq.Turn)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidTurn, "Invalid turn number. Must be >= 1.", map[string]interface{}{"client_turn": clientReq.Turn})
+		sessionLock.Unlock()
+		log.Infof("Lock released for session %s due to invalid turn", clientReq.SessionID)
+		return
+	}
+
+	completionID := "chatcmpl-" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	created := time.Now().Unix()
+	var tokenizedContext []int
+	var rawMessages []ContextStorage.RawMessage
+	var llamaReq map[string]interface{}
+	profile := s.userProfile(&clientReq)
+
+	switch clientReq.Mode {
+	case "raw":
+		rawMessages, _, err = s.loadRawContext(ctx, &clientReq)
+		if err != nil {
+			if reply, ok := s.storedReply(ctx, &clientReq, err); ok {
+				writeReplayedChatCompletion(w, clientReq, effectiveUserID, reply)
+			} else {
+				writeTurnError(w, clientReq.SessionID, err)
+			}
+			sessionLock.Unlock()
+			log.Infof("Lock released for session %s due to failed turn validation", clientReq.SessionID)
+			return
+		}
+		rawMessages = profileMessages(&clientReq, profile, rawMessages)
+		promptMessages := s.fitRawMessages(ctx, &clientReq, s.templateFor(ctx, clientReq.Model), rawMessages, chatReq.Messages)
+		merged := make([]ContextStorage.RawMessage, 0, len(promptMessages)+len(chatReq.Messages))
+		merged = append(merged, promptMessages...)
+		merged = append(merged, chatReq.Messages...)
+		llamaReq = chatLlamaRequest(clientReq, profile, merged)
+	case "client-side":
+		llamaReq = chatLlamaRequest(clientReq, profile, chatReq.Messages)
+	case "tokenized":
+		tokenizedContext, _, err = s.loadTokenizedContext(ctx, &clientReq)
+		if err != nil {
+			if reply, ok := s.storedReply(ctx, &clientReq, err); ok {
+				writeReplayedChatCompletion(w, clientReq, effectiveUserID, reply)
+			} else {
+				writeTurnError(w, clientReq.SessionID, err)
+			}
+			sessionLock.Unlock()
+			log.Infof("Lock released for session %s due to failed turn validation", clientReq.SessionID)
+			return
+		}
+		tokenizedContext, err = s.profileTokens(ctx, &clientReq, profile, tokenizedContext)
+		if err != nil {
+			log.Errorf("Failed to start session %s with the user's system prompt: %v", clientReq.SessionID, err)
+			writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
+			sessionLock.Unlock()
+			log.Warnf("Lock released for session %s due to tokenize error", clientReq.SessionID)
+			return
+		}
+		chatTemplate := s.templateFor(ctx, clientReq.Model)
+		var leadingTokens []int
+		if len(chatReq.Messages) > 1 {
+			// Messages before the final user message (e.g. a system message) are added to the context as tokens.
+			leading := renderContext(chatTemplate, &clientReq, chatReq.Messages[:len(chatReq.Messages)-1], len(tokenizedContext) == 0)
+			tokenizeStartTime := time.Now()
+			var errTokenize error
+			leadingTokens, errTokenize = s.tokenize(ctx, leading)
+			s.writeOperationToCsv(tokenizeStartTime, s.tokenizeOp(), time.Since(tokenizeStartTime), clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(leading), -1, clientReq.Turn, clientReq.Retries, "Leading chat messages")
+			if errTokenize != nil {
+				log.Errorf("Failed to tokenize leading chat messages for session %s: %v", clientReq.SessionID, errTokenize)
+				writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
+				sessionLock.Unlock()
+				log.Warnf("Lock released for session %s due to tokenize error", clientReq.SessionID)
+				return
+			}
+		}
+		promptContext := s.fitTokenizedContext(ctx, &clientReq, chatTemplate, tokenizedContext, len(leadingTokens))
+		if len(leadingTokens) > 0 {
+			promptContext = append(append(make([]int, 0, len(promptContext)+len(leadingTokens)), promptContext...), leadingTokens...)
+		}
+		llamaReq = completionLlamaRequest(clientReq, profile)
+		s.setTokenizedPrompt(llamaReq, &clientReq, chatTemplate, promptContext, []ContextStorage.RawMessage{lastMessage})
+	}
+
+	if clientReq.Stream {
+		s.handleStreamingChatCompletion(ctx, w, clientReq, effectiveUserID, llamaReq, completionID, created, tokenizedContext, rawMessages, sessionLock)
+		return
+	}
+
+	llamaCallStartTime := time.Now()
+	var resp map[string]interface{}
+	if clientReq.Mode == "tokenized" {
+		resp, err = s.llamaService.Completion(ctx, llamaReq)
+		if err == nil {
+			var generated replyTokens
+			generated.add(resp, &clientReq)
+			clientReq.GeneratedTokens = generated.result()
+			resp = chatCompletionFromLlama(resp, completionID, created, clientReq.Model)
+		}
+	} else {
+		resp, err = s.llamaService.ChatCompletions(ctx, llamaReq)
+	}
+	llamaCallDuration := time.Since(llamaCallStartTime)
+	s.writeOperationToCsv(llamaCallStartTime, "llamaService.ChatCompletions", llamaCallDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(clientReq.Prompt), len(tokenizedContext), clientReq.Turn, clientReq.Retries, "")
+	if err != nil {
+		log.Errorf("Llama chat completion error for session %s: %v", clientReq.SessionID, err)
+		writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
+		sessionLock.Unlock()
+		log.Warnf("Lock released for session %s due to llama completion error", clientReq.SessionID)
+		return
+	}
+	if resp == nil {
+		resp = make(map[string]interface{})
+	}
+
+	assistantMsg := chatMessageContent(resp)
+	var written <-chan ContextStorage.ConsistencyToken
+	if clientReq.Mode == "client-side" {
+		sessionLock.Unlock()
+		log.Infof("Lock released for session %s (client-side mode)", clientReq.SessionID)
+	} else {
+		written = s.startAsyncUpdate(clientReq, assistantMsg, tokenizedContext, rawMessages, sessionLock)
+	}
+
+	resp["session_id"] = clientReq.SessionID
+	resp["user_id"] = effectiveUserID
+	resp["mode"] = clientReq.Mode
+	if token, ok := awaitConsistencyToken(ctx, written); ok {
+		resp["consistency_token"] = token
+	}
+	if clientReq.Retries > 0 {
+		resp["retries"] = clientReq.Retries
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("Failed to write chat response for session %s: %v", clientReq.SessionID, err)
+	}
+}
+
+// handleStreamingChatCompletion relays a chat completion as OpenAI "chat.completion.chunk" events, terminated by "[DONE]".
+// Like handleStreamingCompletion, it owns the session lock and persists the context only after a complete stream.
+func (s *Server) handleStreamingChatCompletion(
+	ctx context.Context,
+	w http.ResponseWriter,
+	clientReq CompletionRequest,
+	effectiveUserID string,
+	llamaReq map[string]interface{},
+	completionID string,
+	created int64,
+	tokenizedContext []int,
+	rawMessages []ContextStorage.RawMessage,
+	sessionLock *sessionLockHandle,
+) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Errorf("Streaming not supported by the response writer for session %s", clientReq.SessionID)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Streaming is not supported", nil)
+		sessionLock.Unlock()
+		log.Warnf("Lock released for session %s due to unsupported streaming", clientReq.SessionID)
+		return
+	}
+
+	var assistantBuilder strings.Builder
+	chunksRelayed := 0
+	headersSent := false
+	finished := false
+	relay := func(chunk map[string]interface{}) error {
+		if !headersSent {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.WriteHeader(http.StatusOK)
+			headersSent = true
+		}
+		assistantBuilder.WriteString(chatDeltaContent(chunk))
+		chunk["session_id"] = clientReq.SessionID
+		if firstChoice(chunk)["finish_reason"] != nil {
+			finished = true
+		}
+		if errWrite := writeSSEEvent(w, flusher, chunk); errWrite != nil {
+			return fmt.Errorf("failed to relay chunk to client: %w", errWrite)
+		}
+		chunksRelayed++
+		return nil
+	}
+
+	llamaCallStartTime := time.Now()
+	var err error
+	var generated replyTokens
+	if clientReq.Mode == "tokenized" {
+		first := true
+		_, err = s.llamaService.CompletionStream(ctx, llamaReq, func(chunk map[string]interface{}) error {
+			generated.add(chunk, &clientReq)
+			converted := chatChunkFromLlama(chunk, completionID, created, clientReq.Model, first)
+			first = false
+			return relay(converted)
+		})
+	} else {
+		_, err = s.llamaService.ChatCompletionsStream(ctx, llamaReq, relay)
+	}
+	llamaCallDuration := time.Since(llamaCallStartTime)
+	s.writeOperationToCsv(llamaCallStartTime, "llamaService.ChatCompletionsStream", llamaCallDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(clientReq.Prompt), len(tokenizedContext), clientReq.Turn, clientReq.Retries, fmt.Sprintf("Chunks: %d", chunksRelayed))
+
+	if err == nil && chunksRelayed > 0 && !finished {
+		// The stream broke off before its finish_reason, the reply is truncated and must not be stored.
+		err = fmt.Errorf("stream ended without a finish_reason, turn %d is not stored", clientReq.Turn)
+	}
+	if err != nil || chunksRelayed == 0 {
+		log.Errorf("Llama streaming chat completion error for session %s after %d chunks: %v", clientReq.SessionID, chunksRelayed, err)
+		if !headersSent {
+			writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
+		} else if errWrite := writeSSEEvent(w, flusher, ErrorResponse{Error: newAPIError(http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)}); errWrite != nil {
+			log.Debugf("Could not report stream error to client for session %s: %v", clientReq.SessionID, errWrite)
+		}
+		sessionLock.Unlock()
+		log.Warnf("Lock released for session %s due to llama streaming error", clientReq.SessionID)
+		return
+	}
+
+	var written <-chan ContextStorage.ConsistencyToken
+	if clientReq.Mode == "client-side" {
+		sessionLock.Unlock()
+		log.Infof("Lock released for session %s (client-side mode)", clientReq.SessionID)
+	} else {
+		if clientReq.Mode == "tokenized" {
+			clientReq.GeneratedTokens = generated.result()
+		}
+		written = s.startAsyncUpdate(clientReq, assistantBuilder.String(), tokenizedContext, rawMessages, sessionLock)
+	}
+	if token, ok := awaitConsistencyToken(ctx, written); ok {
+		// A chunk without choices after the finish_reason, like OpenAI's usage chunk, sent once the turn is written.
+		if errWrite := writeSSEEvent(w, flusher, map[string]interface{}{
+			"id":                completionID,
+			"object":            "chat.completion.chunk",
+			"created":           created,
+			"model":             clientReq.Model,
+			"choices":           []interface{}{},
+			"session_id":        clientReq.SessionID,
+			"consistency_token": token,
+		}); errWrite != nil {
+			log.Debugf("Could not send the consistency token to the client of session %s: %v", clientReq.SessionID, errWrite)
+		}
+	}
+	if _, errWrite := fmt.Fprint(w, "data: [DONE]\n\n"); errWrite == nil {
+		flusher.Flush()
+	}
+	log.Infof("Finished relaying %d chat chunks for session %s (user %s)", chunksRelayed, clientReq.SessionID, effectiveUserID)
+}
+
+// chatLlamaRequest builds the request for llama.cpp's /v1/chat/completions endpoint, with the generation defaults
+// of profile for the parameters the client did not set.
+func chatLlamaRequest(clientReq CompletionRequest, profile *SessionManager.UserProfile, messages []ContextStorage.RawMessage) map[string]interface{} {
+	llamaReq := make(map[string]interface{})
+	for k, v := range clientReq.OtherParams {
+		llamaReq[k] = v
+	}
+	applyGenerationDefaults(llamaReq, &clientReq, profile)
+	llamaReq["model"] = clientReq.Model
+	llamaReq["messages"] = messages
+	llamaReq["stream"] = clientReq.Stream
+	return llamaReq
+}
+
+// completionLlamaRequest builds the request for llama.cpp's /completion endpoint from OpenAI parameters and the
+// generation defaults of profile.
+func completionLlamaRequest(clientReq CompletionRequest, profile *SessionManager.UserProfile) map[string]interface{} {
+	llamaReq := make(map[string]interface{})
+	for k, v := range clientReq.OtherParams {
+		llamaReq[k] = v
+	}
+	applyGenerationDefaults(llamaReq, &clientReq, profile)
+	if maxTokens, ok := llamaReq["max_tokens"]; ok {
+		llamaReq["n_predict"] = maxTokens
+		delete(llamaReq, "max_tokens")
+	}
+	llamaReq["model"] = clientReq.Model
+	llamaReq["stream"] = clientReq.Stream
+	return llamaReq
+}
+
+// firstChoice returns the first element of the "choices" array of an OpenAI response or chunk.
+func firstChoice(resp map[string]interface{}) map[string]interface{} {
+	choices, ok := resp["choices"].([]interface{})
+	if !ok || len(choices) == 0 {
+		return nil
+	}
+	choice, _ := choices[0].(map[string]interface{})
+	return choice
+}
+
+// chatMessageContent extracts choices[0].message.content from an OpenAI chat completion.
+func chatMessageContent(resp map[string]interface{}) string {
+	message, _ := firstChoice(resp)["message"].(map[string]interface{})
+	content, _ := message["content"].(string)
+	return content
+}
+
+// chatDeltaContent extracts choices[0].delta.content from an OpenAI chat completion chunk.
+func chatDeltaContent(chunk map[string]interface{}) string {
+	delta, _ := firstChoice(chunk)["delta"].(map[string]interface{})
+	content, _ := delta["content"].(string)
+	return content
+}
+
+// llamaFinishReason maps llama.cpp's stop flags to an OpenAI finish_reason.
+func llamaFinishReason(resp map[string]interface{}) interface{} {
+	if stop, _ := resp["stop"].(bool); !stop {
+		return nil
+	}
+	if limit, _ := resp["stopped_limit"].(bool); limit {
+		return "length"
+	}
+	return "stop"
+}
+
+// llamaUsage builds an OpenAI usage object from llama.cpp's token counters.
+func llamaUsage(resp map[string]interface{}) map[string]interface{} {
+	promptTokens, _ := resp["tokens_evaluated"].(float64)
+	completionTokens, _ := resp["tokens_predicted"].(float64)
+	return map[string]interface{}{
+		"prompt_tokens":     int(promptTokens),
+		"completion_tokens": int(completionTokens),
+		"total_tokens":      int(promptTokens + completionTokens),
+	}
+}
+
+// chatCompletionFromLlama converts a llama.cpp /completion response into an OpenAI chat completion.
+func chatCompletionFromLlama(resp map[string]interface{}, id string, created int64, model string) map[string]interface{} {
+	content, _ := resp["content"].(string)
+	finishReason := llamaFinishReason(resp)
+	if finishReason == nil {
+		finishReason = "stop"
+	}
+	return map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": created,
+		"model":   model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"message":       map[string]interface{}{"role": "assistant", "content": content},
+				"finish_reason": finishReason,
+			},
+		},
+		"usage": llamaUsage(resp),
+	}
+}
+
+// chatChunkFromLlama converts a streamed llama.cpp /completion chunk into an OpenAI chat completion chunk.
+// The delta of the first chunk of a stream carries the assistant role, as OpenAI clients expect.
+func chatChunkFromLlama(chunk map[string]interface{}, id string, created int64, model string, first bool) map[string]interface{} {
+	content, _ := chunk["content"].(string)
+	delta := map[string]interface{}{"content": content}
+	if first {
+		delta["role"] = "assistant"
+	}
+	converted := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": llamaFinishReason(chunk),
+			},
+		},
+	}
+	if stop, _ := chunk["stop"].(bool); stop {
+		converted["usage"] = llamaUsage(chunk)
+	}
+	return converted
+}
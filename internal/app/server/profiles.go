@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	SessionManager "llm-context-management/internal/app/session_manager"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	"net/http"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reservedGenerationParams are request fields a profile cannot set, they are managed by the Context Manager.
+// return_tokens is needed to store the generated tokens of tokenized sessions, see replyTokens.
+var reservedGenerationParams = []string{"prompt", "messages", "context", "stream", "model", "session_id", "user_id", "mode", "turn", "request_id", "return_tokens"}
+
+// generationParamAliases are parameters with another name in the OpenAI API, a client setting either one overrides the default.
+var generationParamAliases = map[string]string{"n_predict": "max_tokens", "max_tokens": "n_predict"}
+
+// userProfile returns the profile of the request's user, nil if the user has none or it cannot be read.
+// A missing profile must not fail the completion, so errors are only logged.
+func (s *Server) userProfile(clientReq *CompletionRequest) *SessionManager.UserProfile {
+	opStartTime := time.Now()
+	profile, err := s.sessionManager.GetUserProfile(clientReq.UserID)
+	s.writeOperationToCsv(opStartTime, "sessionManager.GetUserProfile", time.Since(opStartTime), clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, -1, clientReq.Turn, -1, fmt.Sprintf("UserID: %s", clientReq.UserID))
+	if err != nil {
+		if !errors.Is(err, SessionManager.ErrUserNotFound) {
+			log.Warnf("Could not read profile of user '%s', continuing without: %v", clientReq.UserID, err)
+		}
+		return nil
+	}
+	return profile
+}
+
+// applyGenerationDefaults sets the profile's generation parameters in llamaReq that the client did not send.
+// It runs before the Context Manager sets its own fields, which therefore take precedence. Reserved fields of
+// profiles stored before they were reserved are skipped.
+func applyGenerationDefaults(llamaReq map[string]interface{}, clientReq *CompletionRequest, profile *SessionManager.UserProfile) {
+	if profile == nil {
+		return
+	}
+	for key, value := range profile.GenerationParams {
+		if slices.Contains(reservedGenerationParams, key) {
+			continue
+		}
+		if !clientReq.hasParam(key) && !clientReq.hasParam(generationParamAliases[key]) {
+			llamaReq[key] = value
+		}
+	}
+}
+
+// profileMessages returns the messages starting a new session of the profile's user, the raw context of the first turn.
+// Sessions that already have a context, e.g. created by another node, are not changed.
+func profileMessages(clientReq *CompletionRequest, profile *SessionManager.UserProfile, rawMessages []ContextStorage.RawMessage) []ContextStorage.RawMessage {
+	if profile == nil || clientReq.Turn != 1 || len(rawMessages) > 0 {
+		return rawMessages
+	}
+	content := profile.SystemMessage()
+	if content == "" {
+		return rawMessages
+	}
+	log.Infof("Starting session %s with the system prompt of user '%s'", clientReq.SessionID, clientReq.UserID)
+	return []ContextStorage.RawMessage{{Role: "system", Content: content}}
+}
+
+// profileTokens is profileMessages for tokenized contexts, the system message is rendered with the session's template.
+func (s *Server) profileTokens(ctx context.Context, clientReq *CompletionRequest, profile *SessionManager.UserProfile, tokenizedContext []int) ([]int, error) {
+	if len(tokenizedContext) > 0 {
+		return tokenizedContext, nil
+	}
+	messages := profileMessages(clientReq, profile, nil)
+	if len(messages) == 0 {
+		return tokenizedContext, nil
+	}
+	text := renderContext(s.templateFor(ctx, clientReq.Model), clientReq, messages, true)
+	opStartTime := time.Now()
+	tokens, err := s.tokenize(ctx, text)
+	s.writeOperationToCsv(opStartTime, s.tokenizeOp(), time.Since(opStartTime), clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(text), -1, clientReq.Turn, clientReq.Retries, "Profile system prompt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize the system prompt of user '%s': %w", clientReq.UserID, err)
+	}
+	return tokens, nil
+}
+
+// handleGetUserProfile handles GET /users/{id}/profile.
+func (s *Server) handleGetUserProfile(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	opStartTime := time.Now()
+	profile, err := s.sessionManager.GetUserProfile(userID)
+	s.writeOperationToCsv(opStartTime, "sessionManager.GetUserProfile", time.Since(opStartTime), "", "ServerMode", "", -1, -1, -1, -1, -1, fmt.Sprintf("UserID: %s", userID))
+	if errors.Is(err, SessionManager.ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, ErrCodeUserNotFound, fmt.Sprintf("User %s not found", userID), map[string]interface{}{"user_id": userID})
+		return
+	} else if err != nil {
+		log.Errorf("Failed to get profile of user '%s': %v", userID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to get user profile", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// handlePutUserProfile handles PUT /users/{id}/profile, replacing the user's profile. Unknown users are created.
+// The profile applies to sessions started afterwards, running sessions keep their system prompt.
+func (s *Server) handlePutUserProfile(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	var profile SessionManager.UserProfile
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profile); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err), nil)
+		return
+	}
+	for _, key := range reservedGenerationParams {
+		if _, found := profile.GenerationParams[key]; found {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("The '%s' field cannot be set in generation_params", key), map[string]interface{}{"field": key})
+			return
+		}
+	}
+
+	opStartTime := time.Now()
+	err := s.sessionManager.SetUserProfile(userID, profile)
+	s.writeOperationToCsv(opStartTime, "sessionManager.SetUserProfile", time.Since(opStartTime), "", "ServerMode", "", -1, -1, -1, -1, -1, fmt.Sprintf("UserID: %s", userID))
+	if err != nil {
+		log.Errorf("Failed to set profile of user '%s': %v", userID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to set user profile", nil)
+		return
+	}
+	log.Infof("Updated profile of user '%s'", userID)
+	writeJSON(w, http.StatusOK, profile)
+}
@@ -1,19 +1,23 @@
 package server
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	SessionManager "llm-context-management/internal/app/session_manager"
+	ChatTemplate "llm-context-management/internal/pkg/chat_template"
 	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	ContextWindow "llm-context-management/internal/pkg/context_window"
 	Llama "llm-context-management/internal/pkg/llama_wrapper"
+	Tokenizer "llm-context-management/internal/pkg/tokenizer"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,19 +25,40 @@ import (
 
 // const rawHistoryLength = 100
 const sessionDurationDays = 1
-const defaultUserID = "default_user" // Default user ID if none provided
-const maxTurnRetries = 5
-const turnRetryDelay = 10 * time.Millisecond
+const defaultUserID = "default_user"        // Default user ID if none provided
+const asyncUpdateTimeout = 20 * time.Second // Deadline of the tokenize and context write after a completion
 
 // Server holds dependencies for the HTTP server.
 type Server struct {
 	llamaService   *Llama.LlamaClient
 	sessionManager *SessionManager.SQLiteSessionManager // NOTE Assuming SQLite
 	contextStorage ContextStorage.ContextStorage
-	sessionLocks   map[string]*sync.Mutex
-	locksMutex     sync.RWMutex
+	sessionLocks   *sessionLockManager
 	csvWriter      *csv.Writer
 	csvFile        *os.File
+	httpServer     *http.Server
+	turnWait       TurnWaitPolicy
+	pendingUpdates sync.WaitGroup // Async context updates that are still writing to the context storage
+	shuttingDown   atomic.Bool
+
+	consistencyTokens bool // Responses carry the consistency token of the turn's write, see SetConsistencyTokens
+
+	chatTemplates    *ChatTemplate.Registry
+	tokenizedBackend TokenizedBackend
+	contextWindow    ContextWindow.Policy
+	compaction       ContextWindow.CompactionPolicy
+	compacting       sync.Map               // Sessions with a running compaction
+	cachedLlamaProps map[string]interface{} // LLaMa.cpp's /props, nil until read
+	messageMarkers   map[string][]int       // Tokens of the chat templates' message markers and suffixes, by template name and role
+	llamaPropsMu     sync.Mutex             // Guards cachedLlamaProps and messageMarkers
+
+	nativeTokenizer      Tokenizer.Tokenizer // In-process tokenizer, nil to always use LLaMa.cpp's /tokenize
+	nativeTokenizerState atomic.Int32        // tokenizerUnverified, tokenizerVerified or tokenizerRejected
+	nativeTokenizerMu    sync.Mutex          // Held while verifying the native tokenizer
+	nativeTokenizerTry   time.Time           // Last verification attempt, guarded by nativeTokenizerMu
+
+	servedFingerprint    string                    // Tokenizer fingerprint of LLaMa.cpp's model, "" until computed, guarded by llamaPropsMu
+	conversionTokenizers map[string]*Tokenizer.BPE // Tokenizers of the deployment's other models by fingerprint, see AddConversionTokenizer
 }
 
 // NewServer creates a new Server instance.
@@ -43,10 +68,18 @@ func NewServer(
 	cs ContextStorage.ContextStorage,
 ) *Server {
 	s := &Server{
-		llamaService:   llama,
-		sessionManager: sm,
-		contextStorage: cs,
-		sessionLocks:   make(map[string]*sync.Mutex),
+		llamaService:     llama,
+		sessionManager:   sm,
+		contextStorage:   cs,
+		sessionLocks:     newSessionLockManager(maxSessionLockWaiters),
+		turnWait:         DefaultTurnWaitPolicy,
+		tokenizedBackend: TokenizedBackendContext,
+		chatTemplates:    ChatTemplate.NewRegistry(),
+		contextWindow:    ContextWindow.DefaultPolicy,
+		compaction:       ContextWindow.DefaultCompactionPolicy,
+		messageMarkers:   make(map[string][]int),
+
+		conversionTokenizers: make(map[string]*Tokenizer.BPE),
 	}
 
 	// Initialize CSV logger
@@ -74,17 +107,42 @@ func NewServer(
 
 // CompletionRequest defines the expected structure of the incoming JSON request.
 type CompletionRequest struct {
-	Mode        string                 `json:"mode"` // "raw", "tokenized", or "client-side"
-	SessionID   string                 `json:"session_id,omitempty"`
-	UserID      string                 `json:"user_id,omitempty"` // UserID field
-	Turn        int                    `json:"turn"`              // Client-side turn counter, must be >= 1
-	Prompt      string                 `json:"prompt"`
-	Model       string                 `json:"model"`
-	Temperature float64                `json:"temperature"`
-	Seed        int                    `json:"seed"`
-	Stream      bool                   `json:"stream"`
-	OtherParams map[string]interface{} `json:"-"` // Catches other params for forwarding
-	Retries     int                    `json:"-"` // Internal field to track retries
+	Mode        string                      `json:"mode"` // "raw", "tokenized", or "client-side"
+	SessionID   string                      `json:"session_id,omitempty"`
+	UserID      string                      `json:"user_id,omitempty"` // UserID field
+	Turn        int                         `json:"turn"`              // Client-side turn counter, must be >= 1
+	Prompt      string                      `json:"prompt"`
+	Model       string                      `json:"model"`
+	Temperature float64                     `json:"temperature"`
+	Seed        int                         `json:"seed"`
+	Stream      bool                        `json:"stream"`
+	RequestID   string                      `json:"request_id,omitempty"` // Optional idempotency key, a retry of the same turn and request_id gets the stored reply
+	OtherParams map[string]interface{}      `json:"-"`                    // Catches other params for forwarding
+	Retries     int                         `json:"-"`                    // Internal field to track retries
+	Messages    []ContextStorage.RawMessage `json:"-"`                    // Internal field: messages added by this turn, defaults to the user prompt
+	sentParams  map[string]bool             // Typed generation parameters present in the body, e.g. temperature
+
+	Consistency     string                           `json:"consistency_token,omitempty"` // Optional token of the previous response, see ContextStorage.ConsistencyToken
+	GeneratedTokens []int                            `json:"-"`                           // Internal field: token IDs of the assistant reply returned by LLaMa.cpp, nil to re-tokenize it
+	StoredVersions  *ContextStorage.Versions         `json:"-"`                           // Internal field: versions of the stored context read for this turn, checked by its update
+	readAfter       *ContextStorage.ConsistencyToken // Parsed Consistency, nil if the client sent none
+	systemMessages  int                              // Leading messages of the tokenized context that are the system prompt, see ContextStorage.SessionMetadata
+}
+
+// hasParam reports whether the client set the generation parameter key.
+func (cr *CompletionRequest) hasParam(key string) bool {
+	if _, ok := cr.OtherParams[key]; ok {
+		return true
+	}
+	return cr.sentParams[key]
+}
+
+// turnMessages returns the messages this turn adds to the conversation, excluding the assistant's reply.
+func (cr *CompletionRequest) turnMessages() []ContextStorage.RawMessage {
+	if len(cr.Messages) > 0 {
+		return cr.Messages
+	}
+	return []ContextStorage.RawMessage{{Role: "user", Content: cr.Prompt}}
 }
 
 // UnmarshalJSON custom unmarshaller to capture extra fields and disallow "context".
@@ -114,6 +172,11 @@ func (cr *CompletionRequest) UnmarshalJSON(data []byte) error {
 		return errors.New("the 'context' field is not allowed in the request body")
 	}
 
+	cr.sentParams = make(map[string]bool)
+	for _, key := range []string{"temperature", "seed"} {
+		_, cr.sentParams[key] = allFields[key]
+	}
+
 	// Remove known fields that are explicitly handled
 	delete(allFields, "mode")
 	delete(allFields, "session_id")
@@ -124,6 +187,8 @@ func (cr *CompletionRequest) UnmarshalJSON(data []byte) error {
 	delete(allFields, "temperature")
 	delete(allFields, "seed")
 	delete(allFields, "stream")
+	delete(allFields, "request_id")
+	delete(allFields, "consistency_token")
 
 	// Store remaining fields as OtherParams
 	cr.OtherParams = allFields
@@ -156,8 +221,181 @@ func (s *Server) writeOperationToCsv(opActualStartTime time.Time, operationName
 	s.csvWriter.Flush() // Flush after each write to ensure data is saved
 }
 
+// writeJSON sends v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write JSON response: %v", err)
+	}
+}
+
+// resolveSession makes sure clientReq refers to a session, creating a new one if no session_id was given.
+// An existing session must be owned by the request's user, see authorizeSession. Only a request from turn 2 on shows
+// that a session unknown to this node has a stored context, so only then the full turn wait deadline is spent on it.
+// It returns the effective user ID of the request, which is also stored in clientReq.UserID.
+func (s *Server) resolveSession(ctx context.Context, clientReq *CompletionRequest) (string, error) {
+	effectiveUserID := clientReq.UserID
+	if effectiveUserID == "" {
+		effectiveUserID = defaultUserID
+		log.Warnf("No UserID provided in request, using default: %s", effectiveUserID)
+	}
+	clientReq.UserID = effectiveUserID
+
+	if clientReq.SessionID == "" {
+		log.Infof("No session_id provided, creating a new session for user '%s'.", effectiveUserID)
+		createSessStartTime := time.Now()
+		sessionID, err := s.sessionManager.CreateSession(effectiveUserID, sessionDurationDays)
+		createSessDuration := time.Since(createSessStartTime)
+		log.Debugf("s.sessionManager.CreateSession for user '%s' took %s", effectiveUserID, createSessDuration)
+		if err != nil {
+			log.Errorf("Failed to create session for user '%s': %v", effectiveUserID, err)
+			return effectiveUserID, fmt.Errorf("failed to create session: %w", err)
+		}
+		clientReq.SessionID = sessionID
+		s.writeOperationToCsv(createSessStartTime, "sessionManager.CreateSession", createSessDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, -1, -1, -1, fmt.Sprintf("UserID: %s", effectiveUserID))
+		log.Infof("Created new session ID: %s for user %s", clientReq.SessionID, effectiveUserID)
+	} else {
+		wait := s.turnWait.UnknownSessionDeadline
+		if clientReq.Turn > 1 {
+			wait = s.turnWait.Deadline
+		}
+		if err := s.authorizeSession(ctx, clientReq.SessionID, effectiveUserID, wait); err != nil {
+			return effectiveUserID, err
+		}
+		log.Infof("Using existing session ID: %s (Effective UserID: %s)", clientReq.SessionID, effectiveUserID)
+	}
+	return effectiveUserID, nil
+}
+
+// loadRawContext retrieves the raw context of the session and validates the client's turn against the stored one.
+// Reads are repeated according to the turn wait policy, giving the replication of a previous turn time to arrive.
+// Missing or unreadable contexts are treated as a fresh session; the error is a *turnMismatchError or the ctx's error.
+// A context stored in tokenized mode is converted, failing with a *modeConversionError, see rawFromTokenized.
+// Concurrent versions of the context fail with a *contextConflictError, see resolveConflict.
+func (s *Server) loadRawContext(ctx context.Context, clientReq *CompletionRequest) ([]ContextStorage.RawMessage, int, error) {
+	ctx = storageContext(ctx, clientReq)
+	var rawMessages []ContextStorage.RawMessage
+	var storedTokens []int // Context stored in tokenized mode, converted once the turn is validated
+	var storedMeta ContextStorage.SessionMetadata
+	var conflict *ContextStorage.ConflictError
+	currentTurn, err := s.waitForTurn(ctx, clientReq, "contextStorage.GetRawSessionContext", func() (int, int) {
+		getRawCtxStartTime := time.Now()
+		var currentTurn int
+		var errCtx error
+		rawMessages, currentTurn, _, errCtx = s.contextStorage.GetRawSessionContext(ctx, clientReq.SessionID)
+		log.Debugf("s.contextStorage.GetRawSessionContext for session %s took %s (attempt %d)", clientReq.SessionID, time.Since(getRawCtxStartTime), clientReq.Retries)
+
+		storedTokens = nil
+		conflict = nil
+		if errors.As(errCtx, &conflict) {
+			log.Warnf("Raw context of session %s has concurrent versions: %v", clientReq.SessionID, conflict)
+			return conflictTurn(conflict), 0
+		}
+		ownTurn := currentTurn
+		if errCtx != nil || rawMessages == nil {
+			ownTurn = 0
+		}
+		if ownTurn < clientReq.Turn-1 && (errCtx == nil || s.contextStorage.IsNotFoundError(errCtx)) {
+			// No raw context of the previous turn, the session may have continued in tokenized mode
+			if tokens, turn, meta, ok := s.readTokenizedForConversion(ctx, clientReq, ownTurn); ok {
+				storedTokens, storedMeta = tokens, meta
+				return turn, len(tokens)
+			}
+		}
+
+		if errCtx != nil {
+			if !s.contextStorage.IsNotFoundError(errCtx) {
+				log.Warnf("Failed to get raw session context for %s (proceeding without): %v", clientReq.SessionID, errCtx)
+			} else {
+				log.Infof("No existing raw context found for session %s, starting fresh.", clientReq.SessionID)
+			}
+			rawMessages = []ContextStorage.RawMessage{} // Initialize to empty if error or not found
+			currentTurn = 0                             // For a new session, turn is 0
+		} else if rawMessages != nil {
+			log.Infof("Retrieved raw context (message count %d, turn %d) for session %s", len(rawMessages), currentTurn, clientReq.SessionID)
+		} else {
+			log.Infof("No existing raw context found for session %s, starting fresh.", clientReq.SessionID)
+			rawMessages = []ContextStorage.RawMessage{} // Initialize to empty if nil
+			currentTurn = 0                             // For a new session, turn is 0
+		}
+		return currentTurn, len(rawMessages)
+	})
+	if conflict != nil && ctx.Err() == nil {
+		return nil, currentTurn, s.resolveConflict(ctx, clientReq, conflict)
+	}
+	if err == nil && storedTokens != nil {
+		rawMessages, err = s.rawFromTokenized(ctx, clientReq, storedTokens, storedMeta)
+	}
+	return rawMessages, currentTurn, err
+}
+
+// loadTokenizedContext retrieves the tokenized context of the session and validates the client's turn against the stored one.
+// It follows the same wait and error semantics as loadRawContext. A context of another model is converted, or
+// rejected with a *modelMismatchError, see compatibleContext. A context stored in raw mode is converted too.
+func (s *Server) loadTokenizedContext(ctx context.Context, clientReq *CompletionRequest) ([]int, int, error) {
+	ctx = storageContext(ctx, clientReq)
+	var tokenizedContext []int
+	var meta ContextStorage.SessionMetadata
+	var storedMessages []ContextStorage.RawMessage // Context stored in raw mode, converted once the turn is validated
+	var conflict *ContextStorage.ConflictError
+	currentTurn, err := s.waitForTurn(ctx, clientReq, "contextStorage.GetTokenizedSessionContext", func() (int, int) {
+		getTokenCtxStartTime := time.Now()
+		var currentTurn int
+		var errCtx error
+		tokenizedContext, currentTurn, meta, errCtx = s.contextStorage.GetTokenizedSessionContext(ctx, clientReq.SessionID)
+		log.Debugf("s.contextStorage.GetTokenizedSessionContext for session %s took %s (attempt %d)", clientReq.SessionID, time.Since(getTokenCtxStartTime), clientReq.Retries)
+
+		storedMessages = nil
+		conflict = nil
+		if errors.As(errCtx, &conflict) {
+			log.Warnf("Tokenized context of session %s has concurrent versions: %v", clientReq.SessionID, conflict)
+			return conflictTurn(conflict), 0
+		}
+		ownTurn := currentTurn
+		if errCtx != nil || tokenizedContext == nil {
+			ownTurn = 0
+		}
+		if ownTurn < clientReq.Turn-1 && (errCtx == nil || s.contextStorage.IsNotFoundError(errCtx)) {
+			// No tokenized context of the previous turn, the session may have continued in raw mode
+			if messages, turn, ok := s.readRawForConversion(ctx, clientReq, ownTurn); ok {
+				storedMessages = messages
+				return turn, len(messages)
+			}
+		}
+
+		if errCtx != nil {
+			if !s.contextStorage.IsNotFoundError(errCtx) {
+				log.Warnf("Failed to get tokenized session context for %s (proceeding without): %v", clientReq.SessionID, errCtx)
+			} else {
+				log.Infof("No existing tokenized context found for session %s, starting fresh.", clientReq.SessionID)
+			}
+			tokenizedContext = []int{} // Initialize to empty if error or not found
+			currentTurn = 0            // For a new session, turn is 0
+		} else if tokenizedContext != nil {
+			log.Infof("Retrieved tokenized context (length %d, turn %d) for session %s", len(tokenizedContext), currentTurn, clientReq.SessionID)
+		} else {
+			log.Infof("No existing tokenized context found for session %s, starting fresh.", clientReq.SessionID)
+			tokenizedContext = []int{} // Initialize to empty if nil
+			currentTurn = 0            // For a new session, turn is 0
+		}
+		return currentTurn, len(tokenizedContext)
+	})
+	if conflict != nil && ctx.Err() == nil {
+		return nil, currentTurn, s.resolveConflict(ctx, clientReq, conflict)
+	}
+	if err == nil && storedMessages != nil {
+		tokenizedContext, err = s.tokenizedFromRaw(ctx, clientReq, storedMessages)
+	} else if err == nil {
+		clientReq.systemMessages = meta.SystemMessages
+		tokenizedContext, err = s.compatibleContext(ctx, clientReq, tokenizedContext, meta.Fingerprint)
+	}
+	return tokenizedContext, currentTurn, err
+}
+
 // handleCompletion handles requests to the /completion endpoint.
 func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context() // Canceled when the client disconnects
 	handleStartTime := time.Now()
 	defer func() {
 		log.Infof("handleCompletion for session %s took %s", r.Header.Get("X-Session-ID"), time.Since(handleStartTime)) // X-Session-ID will be set later if new
@@ -165,7 +403,7 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodPost {
 		log.Warnf("Invalid method %s received from %s", r.Method, r.RemoteAddr)
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Only POST method is allowed", nil)
 		return
 	}
 
@@ -177,7 +415,7 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 	decodeStartTime := time.Now()
 	if err := json.NewDecoder(r.Body).Decode(&clientReq); err != nil {
 		log.Errorf("Failed to decode request body from %s: %v (took %s)", r.RemoteAddr, err, time.Since(decodeStartTime))
-		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err), nil)
 		return
 	}
 	log.Debugf("Request body decoding took %s", time.Since(decodeStartTime))
@@ -210,60 +448,30 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 	log.Infof(">> Received completion request from %s '%s'<<", r.RemoteAddr, clientReq.Prompt)
 	log.Debugf("Decoded request: Mode=%s, SessionID=%s, UserID=%s, Model=%s", clientReq.Mode, clientReq.SessionID, clientReq.UserID, clientReq.Model)
 
-	effectiveUserID := clientReq.UserID
-	if effectiveUserID == "" {
-		effectiveUserID = defaultUserID
-		log.Warnf("No UserID provided in request, using default: %s", effectiveUserID)
+	effectiveUserID, err := s.resolveSession(ctx, &clientReq)
+	if err != nil {
+		writeSessionError(w, clientReq.SessionID, err)
+		return
 	}
-
-	if clientReq.SessionID == "" {
-		log.Infof("No session_id provided, creating a new session for user '%s'.", effectiveUserID)
-		createSessStartTime := time.Now()
-		sessionID, err := s.sessionManager.CreateSession(effectiveUserID, sessionDurationDays)
-		createSessDuration := time.Since(createSessStartTime)
-		log.Debugf("s.sessionManager.CreateSession for user '%s' took %s", effectiveUserID, createSessDuration)
-		if err != nil {
-			log.Errorf("Failed to create session for user '%s': %v", effectiveUserID, err)
-			http.Error(w, "Failed to create session", http.StatusInternalServerError)
-			return
-		}
-		clientReq.SessionID = sessionID
-		s.writeOperationToCsv(createSessStartTime, "sessionManager.CreateSession", createSessDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, -1, -1, -1, fmt.Sprintf("UserID: %s", effectiveUserID))
-		r.Header.Set("X-Session-ID", clientReq.SessionID) // Update for defer log
-		log.Infof("Created new session ID: %s for user %s", clientReq.SessionID, effectiveUserID)
-	} else {
-		// TODO: validate if the provided sessionID belongs to the effectiveUserID.
-		r.Header.Set("X-Session-ID", clientReq.SessionID) // Ensure it's set for defer log
-		log.Infof("Using existing session ID: %s (Effective UserID: %s)", clientReq.SessionID, effectiveUserID)
+	r.Header.Set("X-Session-ID", clientReq.SessionID) // Update for defer log
+	if err := clientReq.parseConsistencyToken(); err != nil {
+		log.Warnf("Rejected consistency token for session %s: %v", clientReq.SessionID, err)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error(), map[string]interface{}{"session_id": clientReq.SessionID})
+		return
 	}
 
 	// --- Session Locking for data consistency ---
-	// Get or create a lock for the session to ensure sequential processing.
-	s.locksMutex.RLock()
-	sessionLock, ok := s.sessionLocks[clientReq.SessionID]
-	s.locksMutex.RUnlock()
-
-	if !ok {
-		s.locksMutex.Lock()
-		// Double-check in case another goroutine created it while we were waiting for the write lock.
-		if _, ok := s.sessionLocks[clientReq.SessionID]; !ok {
-			s.sessionLocks[clientReq.SessionID] = &sync.Mutex{}
-			log.Debugf("Created new mutex for session %s", clientReq.SessionID)
-		}
-		sessionLock = s.sessionLocks[clientReq.SessionID]
-		s.locksMutex.Unlock()
+	// Wait for the previous operation on this session to complete, bounded by sessionLockTimeout.
+	sessionLock := s.acquireSessionLock(w, r, clientReq.SessionID)
+	if sessionLock == nil {
+		return
 	}
-
-	log.Debugf("Acquiring lock for session %s", clientReq.SessionID)
-	lockAcquireStartTime := time.Now()
-	sessionLock.Lock() // Block until the previous operation on this session is complete.
-	log.Infof("Lock acquired for session %s (waited %s)", clientReq.SessionID, time.Since(lockAcquireStartTime))
 	// The lock will be released in the async update goroutine.
 
 	// Validate turn number
 	if clientReq.Turn < 1 {
 		log.Errorf("Invalid turn number for session %s. Client turn: %d", clientReq.SessionID, clientReq.Turn)
-		http.Error(w, "Invalid turn number. Must be >= 1.", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidTurn, "Invalid turn number. Must be >= 1.", map[string]interface{}{"client_turn": clientReq.Turn})
 		sessionLock.Unlock()
 		log.Infof("Lock released for session %s due to invalid turn", clientReq.SessionID)
 		return
@@ -272,137 +480,73 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 	llamaReq := make(map[string]interface{})
 
 	// Copy explicitly known parameters
-	llamaReq["model"] = clientReq.Model
 	llamaReq["temperature"] = clientReq.Temperature
 	llamaReq["seed"] = clientReq.Seed
-	llamaReq["stream"] = clientReq.Stream
 	// Copy other parameters captured in OtherParams
 	for k, v := range clientReq.OtherParams {
 		llamaReq[k] = v
 	}
+	// The profile's defaults only fill in client parameters, the fields set by the Context Manager come after them
+	profile := s.userProfile(&clientReq)
+	applyGenerationDefaults(llamaReq, &clientReq, profile)
+	llamaReq["model"] = clientReq.Model
+	llamaReq["stream"] = clientReq.Stream
 	log.Debugf("Prepared Llama request parameters for session %s (excluding prompt/context)", clientReq.SessionID)
 
-	var err error
 	var finalPrompt string // Store the final prompt sent to Llama for logging/history
 	var tokenizedContext []int
 	var rawMessages []ContextStorage.RawMessage
 
 	if clientReq.Mode == "raw" {
 		log.Infof("Using 'raw' context retrieval for session %s", clientReq.SessionID)
-		var errCtx error
-		var currentTurn int
-		var getRawCtxDuration time.Duration
-		var getRawCtxStartTime time.Time
-
-		// Turn validation with retry logic
-		for i := 0; i <= maxTurnRetries; i++ {
-			clientReq.Retries = i
-			getRawCtxStartTime = time.Now()
-			rawMessages, currentTurn, errCtx = s.contextStorage.GetRawSessionContext(clientReq.SessionID)
-			getRawCtxDuration = time.Since(getRawCtxStartTime)
-			log.Debugf("s.contextStorage.GetRawSessionContext for session %s took %s (attempt %d)", clientReq.SessionID, getRawCtxDuration, i)
-
-			if errCtx != nil {
-				if !s.contextStorage.IsNotFoundError(errCtx) {
-					log.Warnf("Failed to get raw session context for %s (proceeding without): %v", clientReq.SessionID, errCtx)
-				} else {
-					log.Infof("No existing raw context found for session %s, starting fresh.", clientReq.SessionID)
-				}
-				rawMessages = []ContextStorage.RawMessage{} // Initialize to empty if error or not found
-				currentTurn = 0                             // For a new session, turn is 0
-			} else if rawMessages != nil {
-				log.Infof("Retrieved raw context (message count %d, turn %d) for session %s", len(rawMessages), currentTurn, clientReq.SessionID)
+		rawMessages, _, err = s.loadRawContext(ctx, &clientReq)
+		if err != nil {
+			if reply, ok := s.storedReply(ctx, &clientReq, err); ok {
+				writeReplayedCompletion(w, clientReq, effectiveUserID, reply)
 			} else {
-				log.Infof("No existing raw context found for session %s, starting fresh.", clientReq.SessionID)
-				rawMessages = []ContextStorage.RawMessage{} // Initialize to empty if nil
-				currentTurn = 0                             // For a new session, turn is 0
-			}
-
-			if clientReq.Turn == currentTurn+1 {
-				log.Infof("Turn validation successful for session %s on attempt %d. Client turn: %d, Server turn: %d", clientReq.SessionID, i, clientReq.Turn, currentTurn)
-				break // Correct turn, exit loop
-			}
-
-			log.Warnf("Turn mismatch for session %s on attempt %d. Client turn: %d, Server turn: %d. Retrying...", clientReq.SessionID, i, clientReq.Turn, currentTurn)
-
-			if i == maxTurnRetries {
-				log.Errorf("Turn mismatch for session %s after %d retries. Client turn: %d, Server turn: %d", clientReq.SessionID, maxTurnRetries, clientReq.Turn, currentTurn)
-				s.writeOperationToCsv(getRawCtxStartTime, "contextStorage.GetRawSessionContext", getRawCtxDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(rawMessages), currentTurn, clientReq.Retries, "Final attempt failed turn validation")
-				http.Error(w, fmt.Sprintf("Turn mismatch after retries. Expected turn %d, but got %d.", currentTurn+1, clientReq.Turn), http.StatusConflict)
-				sessionLock.Unlock()
-				log.Infof("Lock released for session %s due to turn mismatch after retries", clientReq.SessionID)
-				return
+				writeTurnError(w, clientReq.SessionID, err)
 			}
-			time.Sleep(turnRetryDelay)
+			sessionLock.Unlock()
+			log.Infof("Lock released for session %s due to failed turn validation", clientReq.SessionID)
+			return
 		}
-		s.writeOperationToCsv(getRawCtxStartTime, "contextStorage.GetRawSessionContext", getRawCtxDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(rawMessages), currentTurn, clientReq.Retries, "")
 
 		// Construct the prompt including context and user message for Llama.cpp
-		var textContextBuilder strings.Builder
-		for _, msg := range rawMessages {
-			textContextBuilder.WriteString(fmt.Sprintf("<|im_start|>%s\n%s<|im_end|>\n", msg.Role, msg.Content))
-		}
-		finalPrompt = textContextBuilder.String() + "<|im_start|>user\n" + clientReq.Prompt + "<|im_end|>\n"
+		rawMessages = profileMessages(&clientReq, profile, rawMessages)
+		chatTemplate := s.templateFor(ctx, clientReq.Model)
+		promptMessages := s.fitRawMessages(ctx, &clientReq, chatTemplate, rawMessages, clientReq.turnMessages())
+		finalPrompt = chatTemplate.Render(append(promptMessages, clientReq.turnMessages()...))
 		llamaReq["prompt"] = finalPrompt
-		log.Debugf("Prepared raw prompt for session %s", clientReq.SessionID)
+		log.Debugf("Prepared raw prompt for session %s using chat template '%s'", clientReq.SessionID, chatTemplate.Name)
 
 	} else if clientReq.Mode == "tokenized" {
 		log.Infof("Using 'tokenized' context retrieval for session %s", clientReq.SessionID)
-		var errCtx error
-		var currentTurn int
-		var getTokenCtxDuration time.Duration
-		var getTokenCtxStartTime time.Time
-
-		// Turn validation with retry logic
-		for i := 0; i <= maxTurnRetries; i++ {
-			clientReq.Retries = i
-			getTokenCtxStartTime = time.Now()
-			tokenizedContext, currentTurn, errCtx = s.contextStorage.GetTokenizedSessionContext(clientReq.SessionID)
-			getTokenCtxDuration = time.Since(getTokenCtxStartTime)
-			log.Debugf("s.contextStorage.GetTokenizedSessionContext for session %s took %s (attempt %d)", clientReq.SessionID, getTokenCtxDuration, i)
-
-			if errCtx != nil {
-				if !s.contextStorage.IsNotFoundError(errCtx) {
-					log.Warnf("Failed to get tokenized session context for %s (proceeding without): %v", clientReq.SessionID, errCtx)
-				} else {
-					log.Infof("No existing tokenized context found for session %s, starting fresh.", clientReq.SessionID)
-				}
-				tokenizedContext = []int{} // Initialize to empty if error or not found
-				currentTurn = 0            // For a new session, turn is 0
-			} else if tokenizedContext != nil {
-				log.Infof("Retrieved tokenized context (length %d, turn %d) for session %s", len(tokenizedContext), currentTurn, clientReq.SessionID)
+		tokenizedContext, _, err = s.loadTokenizedContext(ctx, &clientReq)
+		if err != nil {
+			if reply, ok := s.storedReply(ctx, &clientReq, err); ok {
+				writeReplayedCompletion(w, clientReq, effectiveUserID, reply)
 			} else {
-				log.Infof("No existing tokenized context found for session %s, starting fresh.", clientReq.SessionID)
-				tokenizedContext = []int{} // Initialize to empty if nil
-				currentTurn = 0            // For a new session, turn is 0
+				writeTurnError(w, clientReq.SessionID, err)
 			}
-
-			if clientReq.Turn == currentTurn+1 {
-				log.Infof("Turn validation successful for session %s on attempt %d. Client turn: %d, Server turn: %d", clientReq.SessionID, i, clientReq.Turn, currentTurn)
-				break // Correct turn, exit loop
-			}
-
-			log.Warnf("Turn mismatch for session %s on attempt %d. Client turn: %d, Server turn: %d. Retrying...", clientReq.SessionID, i, clientReq.Turn, currentTurn)
-
-			if i == maxTurnRetries {
-				log.Errorf("Turn mismatch for session %s after %d retries. Client turn: %d, Server turn: %d", clientReq.SessionID, maxTurnRetries, clientReq.Turn, currentTurn)
-				s.writeOperationToCsv(getTokenCtxStartTime, "contextStorage.GetTokenizedSessionContext", getTokenCtxDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(tokenizedContext), currentTurn, clientReq.Retries, "Final attempt failed turn validation")
-				http.Error(w, fmt.Sprintf("Turn mismatch after retries. Expected turn %d, but got %d.", currentTurn+1, clientReq.Turn), http.StatusConflict)
-				sessionLock.Unlock()
-				log.Infof("Lock released for session %s due to turn mismatch after retries", clientReq.SessionID)
-				return
-			}
-			time.Sleep(turnRetryDelay)
+			sessionLock.Unlock()
+			log.Infof("Lock released for session %s due to failed turn validation", clientReq.SessionID)
+			return
 		}
-		s.writeOperationToCsv(getTokenCtxStartTime, "contextStorage.GetTokenizedSessionContext", getTokenCtxDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(tokenizedContext), currentTurn, clientReq.Retries, "")
 
-		finalPrompt = clientReq.Prompt // the template is added by LLama.cpp internally
-		llamaReq["prompt"] = finalPrompt
-		// Add the retrieved tokenized context if available
-		if len(tokenizedContext) > 0 {
-			llamaReq["context"] = tokenizedContext // This key is added internally, not accepted from client
-			log.Debugf("Added tokenized context to Llama request for session %s", clientReq.SessionID)
+		tokenizedContext, err = s.profileTokens(ctx, &clientReq, profile, tokenizedContext)
+		if err != nil {
+			log.Errorf("Failed to start session %s with the user's system prompt: %v", clientReq.SessionID, err)
+			writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
+			sessionLock.Unlock()
+			log.Warnf("Lock released for session %s due to tokenize error", clientReq.SessionID)
+			return
 		}
+
+		// Add the retrieved tokenized context, without the turns exceeding the token budget
+		chatTemplate := s.templateFor(ctx, clientReq.Model)
+		promptContext := s.fitTokenizedContext(ctx, &clientReq, chatTemplate, tokenizedContext, 0)
+		finalPrompt = s.setTokenizedPrompt(llamaReq, &clientReq, chatTemplate, promptContext, clientReq.turnMessages())
+		log.Debugf("Added tokenized context (%d tokens) to Llama request for session %s using the '%s' backend", len(promptContext), clientReq.SessionID, s.tokenizedBackend)
 	} else if clientReq.Mode == "client-side" {
 		log.Infof("Using 'client-side' mode for session %s, forwarding request.", clientReq.SessionID)
 		finalPrompt = clientReq.Prompt
@@ -411,22 +555,28 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 		// The lock will be released immediately after the call.
 	} else {
 		log.Warnf("Invalid mode '%s' requested for session %s", clientReq.Mode, clientReq.SessionID)
-		http.Error(w, fmt.Sprintf("Invalid mode: %s. Use 'raw', 'tokenized', or 'client-side'", clientReq.Mode), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidMode, fmt.Sprintf("Invalid mode: %s. Use 'raw', 'tokenized', or 'client-side'", clientReq.Mode), nil)
 		sessionLock.Unlock()
 		log.Infof("Lock released for session %s due to invalid mode", clientReq.SessionID)
 		return
 	}
 
+	// --- Streaming requests are relayed chunk by chunk, the context is persisted after the stream ends ---
+	if clientReq.Stream {
+		s.handleStreamingCompletion(ctx, w, clientReq, effectiveUserID, requestSize, llamaReq, finalPrompt, tokenizedContext, rawMessages, sessionLock)
+		return
+	}
+
 	// --- Call LlamaClient ---
 	log.Infof("Sending completion request to Llama service for session %s", clientReq.SessionID)
 	llamaCallStartTime := time.Now()
-	resp, err := s.llamaService.Completion(llamaReq) // llamaService.Completion has internal timing
+	resp, err := s.llamaService.Completion(ctx, llamaReq) // llamaService.Completion has internal timing
 	llamaCallDuration := time.Since(llamaCallStartTime)
 	log.Debugf("s.llamaService.Completion call for session %s took %s (overall)", clientReq.SessionID, llamaCallDuration)
 	s.writeOperationToCsv(llamaCallStartTime, "llamaService.Completion", llamaCallDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(finalPrompt), len(tokenizedContext), clientReq.Turn, clientReq.Retries, "")
 	if err != nil {
 		log.Errorf("Llama completion error for session %s: %v", clientReq.SessionID, err)
-		http.Error(w, "Error processing completion request", http.StatusInternalServerError)
+		writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
 		sessionLock.Unlock()
 		log.Warnf("Lock released for session %s due to llama completion error", clientReq.SessionID)
 		return
@@ -436,6 +586,11 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 	// --- Process response ---
 	assistantMsg := ""
 	if resp != nil {
+		if clientReq.Mode == "tokenized" {
+			var generated replyTokens
+			generated.add(resp, &clientReq)
+			clientReq.GeneratedTokens = generated.result()
+		}
 		if content, ok := resp["content"].(string); ok {
 			assistantMsg = content
 		} else {
@@ -449,11 +604,12 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 	// --- Asynchronously update history and context ---
 	// This is done in a goroutine to avoid making the client wait.
 	// The lock for the session is passed to the goroutine and released there.
+	var written <-chan ContextStorage.ConsistencyToken
 	if clientReq.Mode == "client-side" {
 		sessionLock.Unlock()
 		log.Infof("Lock released for session %s (client-side mode)", clientReq.SessionID)
 	} else {
-		go s.updateHistoryAndContextAsync(clientReq, assistantMsg, tokenizedContext, rawMessages, sessionLock)
+		written = s.startAsyncUpdate(clientReq, assistantMsg, tokenizedContext, rawMessages, sessionLock)
 	}
 
 	// --- Add session_id, user_id, and mode to the response ---
@@ -461,6 +617,9 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 	resp["user_id"] = effectiveUserID        // Add the effective user_id used/provided
 	resp["mode"] = clientReq.Mode            // Add the mode used for the request
 	resp["request_size"] = requestSize
+	if token, ok := awaitConsistencyToken(ctx, written); ok {
+		resp["consistency_token"] = token
+	}
 	if clientReq.Retries > 0 {
 		resp["retries"] = clientReq.Retries
 		log.Infof("Completion for session %s required %d retries for turn consistency.", clientReq.SessionID, clientReq.Retries)
@@ -479,19 +638,24 @@ func (s *Server) handleCompletion(w http.ResponseWriter, r *http.Request) {
 }
 
 // updateHistoryAndContextAsync handles the saving of conversation history and context
-// in the background to avoid blocking the client response.
+// in the background to avoid blocking the client response. If written is not nil, it receives the consistency
+// token of the acknowledged write and is closed.
 func (s *Server) updateHistoryAndContextAsync(
 	clientReq CompletionRequest,
 	assistantMsg string,
 	initialTokenizedContext []int,
 	initialRawMessages []ContextStorage.RawMessage,
-	sessionLock *sync.Mutex,
+	sessionLock *sessionLockHandle,
+	written chan<- ContextStorage.ConsistencyToken,
 ) {
 	// Recover from potential panics in the goroutine to prevent server crash
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorf("Recovered in updateHistoryAndContextAsync for session %s: %v", clientReq.SessionID, r)
 		}
+		if written != nil {
+			close(written)
+		}
 		sessionLock.Unlock()
 		log.Infof("Lock released for session %s", clientReq.SessionID)
 	}()
@@ -503,27 +667,37 @@ func (s *Server) updateHistoryAndContextAsync(
 
 	log.Infof("Starting async history/context update for session %s", clientReq.SessionID)
 
+	// The client request may already be finished, so the update runs on its own deadline.
+	// It still holds the session lock, so this also bounds how long later requests of the session wait.
+	// The versions read by the request are passed on, so an update based on a context replaced in the meantime fails.
+	ctx, cancel := context.WithTimeout(context.Background(), asyncUpdateTimeout)
+	defer cancel()
+	ctx = ContextStorage.WithVersions(ctx, clientReq.StoredVersions)
+
 	if clientReq.Mode == "raw" {
 		// --- Construct new message history ---
 		if initialRawMessages == nil {
 			initialRawMessages = []ContextStorage.RawMessage{}
 		}
-		newHistory := append(initialRawMessages, ContextStorage.RawMessage{Role: "user", Content: clientReq.Prompt})
+		newHistory := append(initialRawMessages, clientReq.turnMessages()...)
 		if assistantMsg != "" {
 			newHistory = append(newHistory, ContextStorage.RawMessage{Role: "assistant", Content: assistantMsg})
 		}
 
 		// --- Update raw context in FReD ---
+		var payloadStats ContextStorage.PayloadStats
 		updateCtxOpStartTime := time.Now()
-		errUpdateCtx := s.contextStorage.UpdateRawSessionContext(clientReq.SessionID, newHistory, clientReq.Turn)
+		errUpdateCtx := s.contextStorage.UpdateRawSessionContext(ContextStorage.WithPayloadStats(ctx, &payloadStats), clientReq.SessionID, newHistory, clientReq.Turn, sessionMetadata(clientReq, assistantMsg))
 		updateCtxOpDuration := time.Since(updateCtxOpStartTime)
 		log.Debugf("s.contextStorage.UpdateRawSessionContext for session %s took %s", clientReq.SessionID, updateCtxOpDuration)
-		s.writeOperationToCsv(updateCtxOpStartTime, "contextStorage.UpdateRawSessionContext", updateCtxOpDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(newHistory), clientReq.Turn, clientReq.Retries, "")
+		s.writeOperationToCsv(updateCtxOpStartTime, "contextStorage.UpdateRawSessionContext", updateCtxOpDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(newHistory), clientReq.Turn, clientReq.Retries, payloadStats.String())
 
 		if errUpdateCtx != nil {
-			log.Errorf("Failed to update raw session context for session %s: %v", clientReq.SessionID, errUpdateCtx)
+			logUpdateError(clientReq, "raw", errUpdateCtx)
 		} else {
 			log.Infof("Updated raw context for session %s, new total messages: %d, new turn: %d", clientReq.SessionID, len(newHistory), clientReq.Turn)
+			reportWrite(written, clientReq)
+			s.startCompaction(clientReq, newHistory, nil)
 		}
 
 		//// --- Increment turn in SQLite ---
@@ -541,13 +715,22 @@ func (s *Server) updateHistoryAndContextAsync(
 			return
 		}
 
-		newUserInteractionText := fmt.Sprintf("<|im_start|>user\n%s<|im_end|>\n<|im_start|>assistant\n%s<|im_end|>\n", clientReq.Prompt, assistantMsg)
+		chatTemplate := s.templateFor(ctx, clientReq.Model)
+		startsContext := len(initialTokenizedContext) == 0
+		var newInteractionTokens []int
+		var errTokenize error
+		if clientReq.GeneratedTokens != nil {
+			// Reuse the tokens the model generated, only the new messages and template markers are tokenized.
+			newInteractionTokens, errTokenize = s.interactionTokens(ctx, &clientReq, chatTemplate, startsContext)
+		} else {
+			newUserInteractionText := renderContext(chatTemplate, &clientReq, append(clientReq.turnMessages(), ContextStorage.RawMessage{Role: "assistant", Content: assistantMsg}), startsContext)
 
-		tokenizeNewOpStartTime := time.Now()
-		newInteractionTokens, errTokenize := s.llamaService.Tokenize(newUserInteractionText)
-		tokenizeNewOpDuration := time.Since(tokenizeNewOpStartTime)
-		log.Debugf("s.llamaService.Tokenize (new interaction) for session %s took %s", clientReq.SessionID, tokenizeNewOpDuration)
-		s.writeOperationToCsv(tokenizeNewOpStartTime, "llamaService.Tokenize", tokenizeNewOpDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(newUserInteractionText), -1, clientReq.Turn, clientReq.Retries, "New interaction")
+			tokenizeNewOpStartTime := time.Now()
+			newInteractionTokens, errTokenize = s.tokenize(ctx, newUserInteractionText)
+			tokenizeNewOpDuration := time.Since(tokenizeNewOpStartTime)
+			log.Debugf("%s (new interaction) for session %s took %s", s.tokenizeOp(), clientReq.SessionID, tokenizeNewOpDuration)
+			s.writeOperationToCsv(tokenizeNewOpStartTime, s.tokenizeOp(), tokenizeNewOpDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(newUserInteractionText), -1, clientReq.Turn, clientReq.Retries, "New interaction")
+		}
 
 		if errTokenize != nil {
 			log.Errorf("Failed to tokenize new interaction for session %s: %v", clientReq.SessionID, errTokenize)
@@ -559,31 +742,118 @@ func (s *Server) updateHistoryAndContextAsync(
 		}
 		updatedFullTokenizedContext := append(initialTokenizedContext, newInteractionTokens...)
 
+		var payloadStats ContextStorage.PayloadStats
 		updateCtxOpStartTime := time.Now()
-		errUpdateCtx := s.contextStorage.UpdateSessionContext(clientReq.SessionID, updatedFullTokenizedContext, clientReq.Turn)
+		errUpdateCtx := s.contextStorage.UpdateSessionContext(ContextStorage.WithPayloadStats(ctx, &payloadStats), clientReq.SessionID, updatedFullTokenizedContext, clientReq.Turn, s.tokenizedMetadata(ctx, clientReq, assistantMsg))
 		updateCtxOpDuration := time.Since(updateCtxOpStartTime)
 		log.Debugf("s.contextStorage.UpdateSessionContext for session %s took %s", clientReq.SessionID, updateCtxOpDuration)
-		s.writeOperationToCsv(updateCtxOpStartTime, "contextStorage.UpdateSessionContext", updateCtxOpDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(updatedFullTokenizedContext), clientReq.Turn, clientReq.Retries, "")
+		s.writeOperationToCsv(updateCtxOpStartTime, "contextStorage.UpdateSessionContext", updateCtxOpDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, len(updatedFullTokenizedContext), clientReq.Turn, clientReq.Retries, payloadStats.String())
 
 		if errUpdateCtx != nil {
-			log.Errorf("Failed to update tokenized session context for session %s: %v", clientReq.SessionID, errUpdateCtx)
+			logUpdateError(clientReq, "tokenized", errUpdateCtx)
 		} else {
 			log.Infof("Updated tokenized context for session %s, new total length: %d, new turn: %d", clientReq.SessionID, len(updatedFullTokenizedContext), clientReq.Turn)
+			reportWrite(written, clientReq)
+			s.startCompaction(clientReq, nil, updatedFullTokenizedContext)
 		}
 	}
 }
 
 // Start registers the HTTP handlers and starts the server.
+// It blocks until the server fails or is shut down; after Shutdown it returns nil.
 func (s *Server) Start(addr string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/completion", s.handleCompletion)
-	// TODO: Add handlers for session management (list, delete)
+	mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("GET /sessions", s.handleListSessions)
+	mux.HandleFunc("GET /sessions/{id}", s.handleGetSession)
+	mux.HandleFunc("DELETE /sessions/{id}", s.handleDeleteSession)
+	mux.HandleFunc("POST /sessions/{id}/extend", s.handleExtendSession)
+	mux.HandleFunc("GET /users/{id}/profile", s.handleGetUserProfile)
+	mux.HandleFunc("PUT /users/{id}/profile", s.handlePutUserProfile)
 	log.Infof("Starting server on %s", addr)
+	if s.nativeTokenizer != nil {
+		go func() { // verify the native tokenizer before the first request needs it
+			ctx, cancel := context.WithTimeout(context.Background(), asyncUpdateTimeout)
+			defer cancel()
+			s.useNativeTokenizer(ctx)
+		}()
+	}
 
-	return http.ListenAndServe(addr, mux)
+	s.httpServer = &http.Server{Addr: addr, Handler: s.rejectWhenShuttingDown(routeErrors(mux))}
+	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// rejectWhenShuttingDown answers requests arriving after Shutdown was called with 503, instead of starting a new turn.
+func (s *Server) rejectWhenShuttingDown(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.shuttingDown.Load() {
+			log.Warnf("Rejecting %s %s from %s, server is shutting down", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("Connection", "close")
+			writeError(w, http.StatusServiceUnavailable, ErrCodeShuttingDown, "Server is shutting down", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startAsyncUpdate runs updateHistoryAndContextAsync in a goroutine tracked by Shutdown. With consistency tokens
+// enabled, the returned channel receives the token of the acknowledged write, or is closed without one if the write
+// failed; otherwise it is nil. See awaitConsistencyToken.
+func (s *Server) startAsyncUpdate(
+	clientReq CompletionRequest,
+	assistantMsg string,
+	initialTokenizedContext []int,
+	initialRawMessages []ContextStorage.RawMessage,
+	sessionLock *sessionLockHandle,
+) <-chan ContextStorage.ConsistencyToken {
+	var written chan ContextStorage.ConsistencyToken
+	if s.consistencyTokens {
+		written = make(chan ContextStorage.ConsistencyToken, 1)
+	}
+	s.pendingUpdates.Add(1)
+	go func() {
+		defer s.pendingUpdates.Done()
+		s.updateHistoryAndContextAsync(clientReq, assistantMsg, initialTokenizedContext, initialRawMessages, sessionLock, written)
+	}()
+	return written
+}
+
+// Shutdown stops accepting requests, lets in-flight completions finish and waits for their async context updates.
+// Requests arriving in the meantime are rejected with 503. If ctx expires first, the pending work is abandoned and ctx's error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	shutdownStartTime := time.Now()
+	s.shuttingDown.Store(true)
+	log.Infof("Shutting down server, waiting for in-flight requests...")
+
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			log.Errorf("HTTP server shutdown did not complete: %v", err)
+			return err
+		}
+	}
+
+	// All handlers have returned, so no new async updates can be started.
+	log.Infof("Waiting for pending context updates...")
+	done := make(chan struct{})
+	go func() {
+		s.pendingUpdates.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Infof("Server shut down cleanly (took %s)", time.Since(shutdownStartTime))
+		return nil
+	case <-ctx.Done():
+		log.Errorf("Shutdown deadline exceeded while context updates were still pending: %v", ctx.Err())
+		return ctx.Err()
+	}
 }
 
-// Stop gracefully shuts down the server (defered from main), closing resources like the CSV logger.
+// Stop closes resources like the CSV logger (defered from main). Call Shutdown first so pending context updates can still log.
 func (s *Server) Stop() {
 	log.Infof("Stopping server...")
 	if s.csvFile != nil {
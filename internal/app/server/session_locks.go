@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const sessionLockTimeout = 30 * time.Second // Maximum time a request waits for its session's lock
+const maxSessionLockWaiters = 8             // Requests allowed to queue for one session's lock
+
+var errSessionLockTimeout = errors.New("timed out waiting for the session lock")
+var errSessionLockQueueFull = errors.New("too many requests waiting for the session lock")
+
+// sessionLockManager serializes operations on a session.
+// Entries are reference counted by their holder and waiters and evicted as soon as they are unused,
+// so the table only holds sessions with a request in flight.
+type sessionLockManager struct {
+	mu         sync.Mutex
+	entries    map[string]*sessionLockEntry
+	maxWaiters int
+}
+
+type sessionLockEntry struct {
+	sem     chan struct{} // Buffered with capacity 1, full while the lock is held
+	refs    int           // Holder plus waiters, the entry is evicted at 0
+	waiters int
+}
+
+// sessionLockHandle is a held lock of a session, released with Unlock.
+type sessionLockHandle struct {
+	manager   *sessionLockManager
+	sessionID string
+	entry     *sessionLockEntry
+}
+
+func newSessionLockManager(maxWaiters int) *sessionLockManager {
+	return &sessionLockManager{
+		entries:    make(map[string]*sessionLockEntry),
+		maxWaiters: maxWaiters,
+	}
+}
+
+// Acquire blocks until the lock of sessionID is held or ctx is done.
+// It returns errSessionLockQueueFull without waiting if too many requests already queue for the session,
+// and errSessionLockTimeout if ctx's deadline passes first.
+func (m *sessionLockManager) Acquire(ctx context.Context, sessionID string) (*sessionLockHandle, error) {
+	m.mu.Lock()
+	entry, ok := m.entries[sessionID]
+	if !ok {
+		entry = &sessionLockEntry{sem: make(chan struct{}, 1)}
+		m.entries[sessionID] = entry
+		log.Debugf("Created lock entry for session %s (%d entries)", sessionID, len(m.entries))
+	}
+	if entry.waiters >= m.maxWaiters {
+		m.mu.Unlock()
+		return nil, errSessionLockQueueFull
+	}
+	entry.refs++
+	entry.waiters++
+	m.mu.Unlock()
+
+	select {
+	case entry.sem <- struct{}{}:
+		m.mu.Lock()
+		entry.waiters--
+		m.mu.Unlock()
+		return &sessionLockHandle{manager: m, sessionID: sessionID, entry: entry}, nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		entry.waiters--
+		m.releaseRef(sessionID, entry)
+		m.mu.Unlock()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errSessionLockTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// QueueDepth returns the number of requests waiting for the lock of sessionID and whether it is currently held.
+func (m *sessionLockManager) QueueDepth(sessionID string) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[sessionID]
+	if !ok {
+		return 0, false
+	}
+	return entry.waiters, len(entry.sem) > 0
+}
+
+// releaseRef drops a reference of entry and evicts it once unused. m.mu must be held.
+func (m *sessionLockManager) releaseRef(sessionID string, entry *sessionLockEntry) {
+	entry.refs--
+	if entry.refs == 0 && m.entries[sessionID] == entry {
+		delete(m.entries, sessionID)
+		log.Debugf("Evicted idle lock entry for session %s (%d entries)", sessionID, len(m.entries))
+	}
+}
+
+// Unlock releases the session lock. It panics if the lock is not held, like sync.Mutex.
+func (l *sessionLockHandle) Unlock() {
+	select {
+	case <-l.entry.sem:
+	default:
+		panic(fmt.Sprintf("unlock of unlocked session lock %s", l.sessionID))
+	}
+	l.manager.mu.Lock()
+	l.manager.releaseRef(l.sessionID, l.entry)
+	l.manager.mu.Unlock()
+}
+
+// acquireSessionLock takes the lock of sessionID on behalf of r, waiting at most sessionLockTimeout.
+// On failure the error response has already been written and nil is returned.
+func (s *Server) acquireSessionLock(w http.ResponseWriter, r *http.Request, sessionID string) *sessionLockHandle {
+	log.Debugf("Acquiring lock for session %s", sessionID)
+	lockAcquireStartTime := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), sessionLockTimeout)
+	defer cancel()
+
+	sessionLock, err := s.sessionLocks.Acquire(ctx, sessionID)
+	lockWait := time.Since(lockAcquireStartTime)
+	if err != nil {
+		s.writeOperationToCsv(lockAcquireStartTime, "sessionLocks.Acquire", lockWait, "", "ServerMode", sessionID, -1, -1, -1, -1, -1, fmt.Sprintf("Error: %v", err))
+		switch {
+		case errors.Is(err, errSessionLockQueueFull):
+			log.Warnf("Rejecting request for session %s, %d requests already waiting for its lock", sessionID, maxSessionLockWaiters)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, ErrCodeTooManyRequests, fmt.Sprintf("Too many concurrent requests for session %s", sessionID), map[string]interface{}{"session_id": sessionID, "max_waiters": maxSessionLockWaiters})
+		case errors.Is(err, errSessionLockTimeout):
+			log.Errorf("Timed out after %s waiting for the lock of session %s", lockWait, sessionID)
+			w.Header().Set("Retry-After", strconv.Itoa(int(sessionLockTimeout.Seconds())))
+			writeError(w, http.StatusServiceUnavailable, ErrCodeSessionBusy, fmt.Sprintf("Session %s is busy, timed out waiting for the previous request", sessionID), map[string]interface{}{"session_id": sessionID})
+		default:
+			log.Warnf("Stopped waiting for the lock of session %s: %v", sessionID, err) // Client went away
+			writeError(w, http.StatusServiceUnavailable, ErrCodeRequestCanceled, "Request canceled while waiting for the session", nil)
+		}
+		return nil
+	}
+	log.Infof("Lock acquired for session %s (waited %s)", sessionID, lockWait)
+	return sessionLock
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionLockManagerAcquire(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxWaiters int
+		waiters    int  // Requests already queued behind the holder
+		cancel     bool // Cancel instead of letting the deadline pass
+		wantErr    error
+	}{
+		{name: "times out behind holder", maxWaiters: 2, waiters: 0, wantErr: errSessionLockTimeout},
+		{name: "canceled behind holder", maxWaiters: 2, waiters: 0, cancel: true, wantErr: context.Canceled},
+		{name: "times out with a queue", maxWaiters: 2, waiters: 1, wantErr: errSessionLockTimeout},
+		{name: "queue full", maxWaiters: 2, waiters: 2, wantErr: errSessionLockQueueFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newSessionLockManager(tt.maxWaiters)
+			holder, err := m.Acquire(context.Background(), "s1")
+			if err != nil {
+				t.Fatalf("Acquire of free lock: %v", err)
+			}
+
+			queueCtx, stopQueue := context.WithCancel(context.Background())
+			queued := make(chan error, tt.waiters)
+			for i := 0; i < tt.waiters; i++ {
+				go func() {
+					_, err := m.Acquire(queueCtx, "s1")
+					queued <- err
+				}()
+			}
+			waitFor(t, func() bool { depth, _ := m.QueueDepth("s1"); return depth == tt.waiters })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			if _, err := m.Acquire(ctx, "s1"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Acquire = %v, want %v", err, tt.wantErr)
+			}
+
+			stopQueue()
+			for i := 0; i < tt.waiters; i++ {
+				if err := <-queued; !errors.Is(err, context.Canceled) {
+					t.Errorf("queued Acquire = %v, want %v", err, context.Canceled)
+				}
+			}
+			if depth, locked := m.QueueDepth("s1"); depth != 0 || !locked {
+				t.Errorf("QueueDepth = %d, %v; want 0, true", depth, locked)
+			}
+			holder.Unlock()
+			if len(m.entries) != 0 {
+				t.Errorf("%d entries left after the last Unlock, want 0", len(m.entries))
+			}
+		})
+	}
+}
+
+func TestSessionLockManagerHandsOver(t *testing.T) {
+	m := newSessionLockManager(1)
+	holder, err := m.Acquire(context.Background(), "s1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	other, err := m.Acquire(context.Background(), "s2")
+	if err != nil {
+		t.Fatalf("Acquire of another session: %v", err)
+	}
+	other.Unlock()
+
+	acquired := make(chan *sessionLockHandle)
+	go func() {
+		next, err := m.Acquire(context.Background(), "s1")
+		if err != nil {
+			t.Errorf("queued Acquire: %v", err)
+		}
+		acquired <- next
+	}()
+	waitFor(t, func() bool { depth, _ := m.QueueDepth("s1"); return depth == 1 })
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	holder.Unlock()
+	next := <-acquired
+	if depth, locked := m.QueueDepth("s1"); depth != 0 || !locked {
+		t.Errorf("QueueDepth after hand over = %d, %v; want 0, true", depth, locked)
+	}
+	next.Unlock()
+	if len(m.entries) != 0 {
+		t.Errorf("%d entries left after the last Unlock, want 0", len(m.entries))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Unlock of an unlocked session lock did not panic")
+		}
+	}()
+	next.Unlock()
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached within a second")
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	SessionManager "llm-context-management/internal/app/session_manager"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultSessionMessagesLimit = 100
+
+// errSessionNotOwned is returned when a session exists but does not belong to the requesting user.
+var errSessionNotOwned = errors.New("session does not belong to the user")
+
+// errContextStorageUnavailable wraps failures reading the session owner from the context storage.
+var errContextStorageUnavailable = errors.New("context storage unavailable")
+
+// SessionDetails is the response of GET /sessions/{id}.
+type SessionDetails struct {
+	Session       *SessionManager.SessionInfo  `json:"session"`
+	Mode          string                       `json:"mode,omitempty"` // Mode of the stored context, empty if there is none
+	Turn          int                          `json:"turn"`
+	Context       interface{}                  `json:"context"` // []RawMessage in raw mode, []int in tokenized mode
+	ContextLength int                          `json:"context_length"`
+	Fingerprint   string                       `json:"fingerprint,omitempty"`
+	Messages      []SessionManager.MessageInfo `json:"messages"`    // Messages logged in the session database
+	Locked        bool                         `json:"locked"`      // A request or async context update currently holds the session
+	QueueDepth    int                          `json:"queue_depth"` // Requests waiting for the session
+}
+
+// ExtendSessionRequest is the body of POST /sessions/{id}/extend.
+type ExtendSessionRequest struct {
+	Days int `json:"days"`
+}
+
+// authorizeSession checks that sessionID exists and is owned by userID.
+// A session deleted on any node is not found, and dropped from the local database, once its tombstone is replicated.
+// The owner is taken from the local session database. Sessions created on another node are unknown there,
+// in that case the owner replicated with the context is used and the session is adopted into the local database.
+// Until that context has been replicated to this node the read is repeated for up to wait, see waitForSessionMetadata.
+func (s *Server) authorizeSession(ctx context.Context, sessionID string, userID string, wait time.Duration) error {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("authorizeSession for session %s took %s", sessionID, time.Since(startTime))
+	}()
+
+	tombstoneStartTime := time.Now()
+	deleted, err := s.contextStorage.IsSessionDeleted(ctx, sessionID)
+	s.writeOperationToCsv(tombstoneStartTime, "contextStorage.IsSessionDeleted", time.Since(tombstoneStartTime), "", "ServerMode", sessionID, -1, -1, -1, -1, -1, fmt.Sprintf("UserID: %s", userID))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errContextStorageUnavailable, err)
+	}
+	if deleted {
+		if err := s.sessionManager.DeleteSession(sessionID); err != nil {
+			log.Warnf("Failed to drop the deleted session %s from the session database: %v", sessionID, err)
+		}
+		log.Infof("Session %s was deleted, rejecting request of user '%s'", sessionID, userID)
+		return SessionManager.ErrSessionNotFound
+	}
+
+	info, err := s.sessionManager.GetSession(sessionID)
+	if err == nil {
+		if info.UserID != userID {
+			log.Warnf("User '%s' is not the owner of session %s", userID, sessionID)
+			return errSessionNotOwned
+		}
+		return nil
+	}
+	if !errors.Is(err, SessionManager.ErrSessionNotFound) {
+		return fmt.Errorf("failed to get session %s: %w", sessionID, err)
+	}
+
+	// Not created on this node, fall back to the owner stored with the replicated context.
+	meta, err := s.waitForSessionMetadata(ctx, sessionID, userID, wait)
+	if err != nil {
+		if s.contextStorage.IsNotFoundError(err) {
+			return SessionManager.ErrSessionNotFound
+		}
+		return fmt.Errorf("%w: %v", errContextStorageUnavailable, err)
+	}
+	if meta.Owner == "" {
+		// Context written before owners were stored, the ownership cannot be verified.
+		log.Warnf("Session %s has no stored owner, rejecting request of user '%s'", sessionID, userID)
+		return errSessionNotOwned
+	}
+	if meta.Owner != userID {
+		log.Warnf("User '%s' is not the owner of session %s (owner from context storage)", userID, sessionID)
+		return errSessionNotOwned
+	}
+
+	if err := s.sessionManager.AdoptSession(sessionID, userID, sessionDurationDays); err != nil {
+		log.Errorf("Failed to adopt session %s of user '%s': %v", sessionID, userID, err)
+		return fmt.Errorf("failed to adopt session %s: %w", sessionID, err)
+	}
+	log.Infof("Adopted session %s of user '%s' from the context storage", sessionID, userID)
+	return nil
+}
+
+// waitForSessionMetadata reads the metadata replicated with the session's context. A client roaming to this node can
+// be faster than the replication of its session's first turn, so a missing context is re-read with the delays of
+// s.turnWait, like a previous turn in waitForTurn; only once wait passed is it reported as not found. A wait of 0 reads once.
+func (s *Server) waitForSessionMetadata(ctx context.Context, sessionID string, userID string, wait time.Duration) (ContextStorage.SessionMetadata, error) {
+	waitStartTime := time.Now()
+	deadline := waitStartTime.Add(wait)
+	delay := s.turnWait.InitialDelay
+
+	for attempt := 0; ; attempt++ {
+		metaStartTime := time.Now()
+		meta, err := s.contextStorage.GetSessionMetadata(ctx, sessionID)
+		s.writeOperationToCsv(metaStartTime, "contextStorage.GetSessionMetadata", time.Since(metaStartTime), "", "ServerMode", sessionID, -1, -1, -1, -1, attempt, fmt.Sprintf("UserID: %s", userID))
+		if err == nil || !s.contextStorage.IsNotFoundError(err) {
+			return meta, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			log.Warnf("Session %s is unknown to this node and its context was not replicated within %s (%d attempts)", sessionID, time.Since(waitStartTime), attempt+1)
+			return meta, err
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		log.Warnf("Session %s is unknown to this node and has no replicated context yet on attempt %d. Retrying in %s...", sessionID, attempt, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			log.Warnf("Stopped waiting for the context of session %s: %v", sessionID, ctx.Err())
+			return meta, ctx.Err()
+		}
+		delay = time.Duration(float64(delay) * s.turnWait.Multiplier)
+		if delay > s.turnWait.MaxDelay {
+			delay = s.turnWait.MaxDelay
+		}
+	}
+}
+
+// writeSessionError maps errors of resolveSession and authorizeSession to an HTTP response.
+func writeSessionError(w http.ResponseWriter, sessionID string, err error) {
+	switch {
+	case errors.Is(err, SessionManager.ErrSessionNotFound):
+		writeError(w, http.StatusNotFound, ErrCodeSessionNotFound, fmt.Sprintf("Session %s not found", sessionID), map[string]interface{}{"session_id": sessionID})
+	case errors.Is(err, errSessionNotOwned):
+		writeError(w, http.StatusForbidden, ErrCodeSessionForbidden, fmt.Sprintf("Session %s does not belong to the requesting user", sessionID), map[string]interface{}{"session_id": sessionID})
+	case errors.Is(err, errContextStorageUnavailable):
+		log.Errorf("Failed to verify owner of session %s: %v", sessionID, err)
+		writeError(w, http.StatusBadGateway, ErrCodeContextStoreUnavailable, "Failed to verify session owner", nil)
+	default:
+		log.Errorf("Failed to resolve session %s: %v", sessionID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to resolve session", nil)
+	}
+}
+
+// requestUserID returns the user_id query parameter of r, or the default user.
+func requestUserID(r *http.Request) string {
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		return userID
+	}
+	return defaultUserID
+}
+
+// handleListSessions handles GET /sessions?user_id=..., listing the sessions of a user.
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	opStartTime := time.Now()
+	sessions, err := s.sessionManager.GetUserSessions(userID)
+	s.writeOperationToCsv(opStartTime, "sessionManager.GetUserSessions", time.Since(opStartTime), "", "ServerMode", "", -1, -1, -1, -1, -1, fmt.Sprintf("UserID: %s", userID))
+	if err != nil {
+		log.Errorf("Failed to list sessions for user '%s': %v", userID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to list sessions", nil)
+		return
+	}
+	if sessions == nil {
+		sessions = []SessionManager.SessionInfo{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "sessions": sessions})
+}
+
+// handleGetSession handles GET /sessions/{id}, returning the session's metadata and its current context and turn.
+// The optional "mode" query parameter selects which context shape to read; without it the newer of both is returned.
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sessionID := r.PathValue("id")
+	if err := s.authorizeSession(ctx, sessionID, requestUserID(r), 0); err != nil {
+		writeSessionError(w, sessionID, err)
+		return
+	}
+	info, err := s.sessionManager.GetSession(sessionID)
+	if err != nil {
+		log.Errorf("Failed to get session %s: %v", sessionID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to get session", nil)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "raw" && mode != "tokenized" {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidMode, fmt.Sprintf("Invalid mode: %s. Use 'raw' or 'tokenized'", mode), nil)
+		return
+	}
+	limit := defaultSessionMessagesLimit
+	if l, errLimit := strconv.Atoi(r.URL.Query().Get("limit")); errLimit == nil && l > 0 {
+		limit = l
+	}
+
+	details := SessionDetails{Session: info}
+	if mode == "" || mode == "raw" {
+		opStartTime := time.Now()
+		rawMessages, turn, _, errCtx := s.contextStorage.GetRawSessionContext(ctx, sessionID)
+		s.writeOperationToCsv(opStartTime, "contextStorage.GetRawSessionContext", time.Since(opStartTime), "raw", "ServerMode", sessionID, -1, -1, len(rawMessages), turn, -1, "Session API")
+		if errCtx != nil && !s.contextStorage.IsNotFoundError(errCtx) {
+			log.Errorf("Failed to get raw context of session %s: %v", sessionID, errCtx)
+			writeError(w, http.StatusBadGateway, ErrCodeContextStoreUnavailable, "Failed to read session context", nil)
+			return
+		}
+		if errCtx == nil {
+			details.Mode, details.Turn, details.Context, details.ContextLength = "raw", turn, rawMessages, len(rawMessages)
+		}
+	}
+	if mode == "" || mode == "tokenized" {
+		opStartTime := time.Now()
+		tokens, turn, meta, errCtx := s.contextStorage.GetTokenizedSessionContext(ctx, sessionID)
+		s.writeOperationToCsv(opStartTime, "contextStorage.GetTokenizedSessionContext", time.Since(opStartTime), "tokenized", "ServerMode", sessionID, -1, -1, len(tokens), turn, -1, "Session API")
+		if errCtx != nil && !s.contextStorage.IsNotFoundError(errCtx) {
+			log.Errorf("Failed to get tokenized context of session %s: %v", sessionID, errCtx)
+			writeError(w, http.StatusBadGateway, ErrCodeContextStoreUnavailable, "Failed to read session context", nil)
+			return
+		}
+		// Raw and tokenized contexts are stored under separate keys. After a mode switch FReD keeps the context of
+		// the previous mode, so without a mode the one of the newer turn is the session's current context.
+		if errCtx == nil && (details.Mode == "" || turn > details.Turn) {
+			details.Mode, details.Turn, details.Context, details.ContextLength = "tokenized", turn, tokens, len(tokens)
+			details.Fingerprint = meta.Fingerprint
+		}
+	}
+
+	messages, err := s.sessionManager.GetSessionMessages(sessionID, limit)
+	if err != nil {
+		log.Errorf("Failed to get messages of session %s: %v", sessionID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to get session messages", nil)
+		return
+	}
+	if messages == nil {
+		messages = []SessionManager.MessageInfo{}
+	}
+	details.Messages = messages
+	details.QueueDepth, details.Locked = s.sessionLocks.QueueDepth(sessionID)
+	writeJSON(w, http.StatusOK, details)
+}
+
+// handleDeleteSession handles DELETE /sessions/{id}, removing the session from the database and its contexts of all models
+// from the context storage. The storage leaves a tombstone, other nodes drop the session once it is replicated to them,
+// see authorizeSession.
+func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sessionID := r.PathValue("id")
+	if err := s.authorizeSession(ctx, sessionID, requestUserID(r), 0); err != nil {
+		writeSessionError(w, sessionID, err)
+		return
+	}
+
+	// Wait for a running completion/async update of this session, otherwise it could write the context again after the delete.
+	sessionLock := s.acquireSessionLock(w, r, sessionID)
+	if sessionLock == nil {
+		return
+	}
+	defer sessionLock.Unlock()
+
+	delCtxStartTime := time.Now()
+	if err := s.contextStorage.DeleteSessionContext(ctx, sessionID); err != nil {
+		log.Errorf("Failed to delete context of session %s: %v", sessionID, err)
+		writeError(w, http.StatusBadGateway, ErrCodeContextStoreUnavailable, "Failed to delete session context", nil)
+		return
+	}
+	s.writeOperationToCsv(delCtxStartTime, "contextStorage.DeleteSessionContext", time.Since(delCtxStartTime), "", "ServerMode", sessionID, -1, -1, -1, -1, -1, "Session API")
+
+	delSessStartTime := time.Now()
+	if err := s.sessionManager.DeleteSession(sessionID); err != nil {
+		log.Errorf("Failed to delete session %s: %v", sessionID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to delete session", nil)
+		return
+	}
+	s.writeOperationToCsv(delSessStartTime, "sessionManager.DeleteSession", time.Since(delSessStartTime), "", "ServerMode", sessionID, -1, -1, -1, -1, -1, "Session API")
+	log.Infof("Deleted session %s and its context", sessionID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"session_id": sessionID, "deleted": true})
+}
+
+// handleExtendSession handles POST /sessions/{id}/extend, pushing the session's expiry by the requested number of days.
+func (s *Server) handleExtendSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sessionID := r.PathValue("id")
+
+	extendReq := ExtendSessionRequest{Days: sessionDurationDays}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&extendReq); err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err), nil)
+			return
+		}
+	}
+	if extendReq.Days < 1 {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid number of days. Must be >= 1.", nil)
+		return
+	}
+	if err := s.authorizeSession(ctx, sessionID, requestUserID(r), 0); err != nil {
+		writeSessionError(w, sessionID, err)
+		return
+	}
+
+	opStartTime := time.Now()
+	info, err := s.sessionManager.ExtendSession(sessionID, extendReq.Days)
+	s.writeOperationToCsv(opStartTime, "sessionManager.ExtendSession", time.Since(opStartTime), "", "ServerMode", sessionID, -1, -1, -1, -1, -1, fmt.Sprintf("Days: %d", extendReq.Days))
+	if errors.Is(err, SessionManager.ErrSessionNotFound) {
+		writeError(w, http.StatusNotFound, ErrCodeSessionNotFound, fmt.Sprintf("Session %s not found", sessionID), map[string]interface{}{"session_id": sessionID})
+		return
+	} else if err != nil {
+		log.Errorf("Failed to extend session %s: %v", sessionID, err)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to extend session", nil)
+		return
+	}
+	log.Infof("Extended session %s by %d days, now expires at %s", sessionID, extendReq.Days, info.ExpiresAt)
+	writeJSON(w, http.StatusOK, info)
+}
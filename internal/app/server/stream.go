@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// writeSSEEvent writes a single server-sent event carrying the JSON encoding of payload and flushes it.
+func writeSSEEvent(w http.ResponseWriter, flusher http.Flusher, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// handleStreamingCompletion relays llama.cpp's streamed chunks to the client as server-sent events.
+// The assistant text is collected while relaying and the context is only persisted once llama.cpp sent its final chunk
+// with stop set; a stream that breaks off earlier leaves the turn unchanged, so the client can retry it.
+// It takes over the session lock from handleCompletion and makes sure it is released.
+func (s *Server) handleStreamingCompletion(
+	ctx context.Context,
+	w http.ResponseWriter,
+	clientReq CompletionRequest,
+	effectiveUserID string,
+	requestSize int64,
+	llamaReq map[string]interface{},
+	finalPrompt string,
+	tokenizedContext []int,
+	rawMessages []ContextStorage.RawMessage,
+	sessionLock *sessionLockHandle,
+) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Errorf("Streaming not supported by the response writer for session %s", clientReq.SessionID)
+		writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Streaming is not supported", nil)
+		sessionLock.Unlock()
+		log.Warnf("Lock released for session %s due to unsupported streaming", clientReq.SessionID)
+		return
+	}
+
+	log.Infof("Sending streaming completion request to Llama service for session %s", clientReq.SessionID)
+	var assistantBuilder strings.Builder
+	var firstChunkDelay time.Duration
+	var generated replyTokens
+	chunksRelayed := 0
+	headersSent := false
+	stopped := false
+	llamaCallStartTime := time.Now()
+	_, err := s.llamaService.CompletionStream(ctx, llamaReq, func(chunk map[string]interface{}) error {
+		if !headersSent {
+			firstChunkDelay = time.Since(llamaCallStartTime)
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.WriteHeader(http.StatusOK)
+			headersSent = true
+		}
+		if content, ok := chunk["content"].(string); ok {
+			assistantBuilder.WriteString(content)
+		}
+		if clientReq.Mode == "tokenized" {
+			generated.add(chunk, &clientReq)
+		}
+
+		chunk["session_id"] = clientReq.SessionID // every chunk carries the session, so new sessions learn their id early
+		if stop, _ := chunk["stop"].(bool); stop {
+			stopped = true
+			chunk["user_id"] = effectiveUserID
+			chunk["mode"] = clientReq.Mode
+			chunk["request_size"] = requestSize
+			if clientReq.Retries > 0 {
+				chunk["retries"] = clientReq.Retries
+			}
+		}
+
+		if errWrite := writeSSEEvent(w, flusher, chunk); errWrite != nil {
+			// The client went away, abort generation instead of producing tokens nobody reads.
+			return fmt.Errorf("failed to relay chunk to client: %w", errWrite)
+		}
+		chunksRelayed++
+		return nil
+	})
+	llamaCallDuration := time.Since(llamaCallStartTime)
+	log.Debugf("s.llamaService.CompletionStream call for session %s took %s (first chunk after %s, %d chunks)", clientReq.SessionID, llamaCallDuration, firstChunkDelay, chunksRelayed)
+	s.writeOperationToCsv(llamaCallStartTime, "llamaService.CompletionStream", llamaCallDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, len(finalPrompt), len(tokenizedContext), clientReq.Turn, clientReq.Retries, fmt.Sprintf("FirstChunkMs: %d, Chunks: %d", firstChunkDelay.Milliseconds(), chunksRelayed))
+
+	if err != nil {
+		log.Errorf("Llama streaming completion error for session %s after %d chunks: %v", clientReq.SessionID, chunksRelayed, err)
+		if !headersSent {
+			writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
+		} else {
+			// Headers are already sent, report the failure in-band. The context is not updated with a partial answer.
+			if errWrite := writeSSEEvent(w, flusher, map[string]interface{}{
+				"error":      newAPIError(http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil),
+				"session_id": clientReq.SessionID,
+			}); errWrite != nil {
+				log.Debugf("Could not report stream error to client for session %s: %v", clientReq.SessionID, errWrite)
+			}
+		}
+		sessionLock.Unlock()
+		log.Warnf("Lock released for session %s due to llama streaming error", clientReq.SessionID)
+		return
+	}
+	if chunksRelayed == 0 {
+		log.Errorf("Llama streaming completion for session %s ended without any chunk", clientReq.SessionID)
+		writeError(w, http.StatusBadGateway, ErrCodeLLMUnavailable, "Error processing completion request", nil)
+		sessionLock.Unlock()
+		log.Warnf("Lock released for session %s due to empty llama stream", clientReq.SessionID)
+		return
+	}
+	if !stopped {
+		// E.g. llama.cpp disconnected or timed out, the reply is truncated and must not become the session's next turn.
+		log.Errorf("Llama streaming completion for session %s ended after %d chunks without a final chunk, turn %d is not stored", clientReq.SessionID, chunksRelayed, clientReq.Turn)
+		if errWrite := writeSSEEvent(w, flusher, map[string]interface{}{
+			"error":      newAPIError(http.StatusBadGateway, ErrCodeLLMUnavailable, "The completion ended before it was finished", nil),
+			"session_id": clientReq.SessionID,
+		}); errWrite != nil {
+			log.Debugf("Could not report truncated stream to client for session %s: %v", clientReq.SessionID, errWrite)
+		}
+		sessionLock.Unlock()
+		log.Warnf("Lock released for session %s due to truncated llama stream", clientReq.SessionID)
+		return
+	}
+	log.Infof("Finished relaying %d chunks from Llama service for session %s", chunksRelayed, clientReq.SessionID)
+
+	// --- Persist the full assistant message now that the stream is complete ---
+	if clientReq.Mode == "client-side" {
+		sessionLock.Unlock()
+		log.Infof("Lock released for session %s (client-side mode)", clientReq.SessionID)
+		return
+	}
+	if clientReq.Mode == "tokenized" {
+		clientReq.GeneratedTokens = generated.result()
+	}
+	written := s.startAsyncUpdate(clientReq, assistantBuilder.String(), tokenizedContext, rawMessages, sessionLock)
+	if token, ok := awaitConsistencyToken(ctx, written); ok {
+		// An event after the final chunk, sent once the turn is written.
+		if errWrite := writeSSEEvent(w, flusher, map[string]interface{}{
+			"session_id":        clientReq.SessionID,
+			"consistency_token": token,
+		}); errWrite != nil {
+			log.Debugf("Could not send the consistency token to the client of session %s: %v", clientReq.SessionID, errWrite)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	ChatTemplate "llm-context-management/internal/pkg/chat_template"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	Llama "llm-context-management/internal/pkg/llama_wrapper"
+)
+
+// TokenizedBackend selects how the stored tokens of tokenized mode are passed to LLaMa.cpp.
+type TokenizedBackend string
+
+const (
+	// TokenizedBackendContext sends the tokens in the "context" field, which needs the llama.cpp-fastencode fork.
+	// The fork applies the chat template to the prompt itself.
+	TokenizedBackendContext TokenizedBackend = "context"
+	// TokenizedBackendPromptArray sends the tokens followed by the templated new turn as a mixed prompt array,
+	// which works with upstream llama.cpp.
+	TokenizedBackendPromptArray TokenizedBackend = "prompt_array"
+)
+
+// SetTokenizedBackend selects how tokenized contexts are sent to LLaMa.cpp. Call it before Start.
+func (s *Server) SetTokenizedBackend(backend TokenizedBackend) error {
+	if backend != TokenizedBackendContext && backend != TokenizedBackendPromptArray {
+		return fmt.Errorf("unknown tokenized backend %q", backend)
+	}
+	s.tokenizedBackend = backend
+	return nil
+}
+
+// setTokenizedPrompt puts the context tokens and the messages of the new turn into llamaReq, according to the
+// tokenized backend. It returns the prompt text, for logging.
+func (s *Server) setTokenizedPrompt(
+	llamaReq map[string]interface{},
+	clientReq *CompletionRequest,
+	chatTemplate *ChatTemplate.Template,
+	contextTokens []int,
+	newMessages []ContextStorage.RawMessage,
+) string {
+	llamaReq["return_tokens"] = true // The generated token IDs are stored instead of re-tokenizing the reply
+	if s.tokenizedBackend == TokenizedBackendPromptArray {
+		// Stored tokens, the new turn and the assistant header, so the reply follows the format of the stored interactions.
+		text := chatTemplate.Render(newMessages) + chatTemplate.GenerationPrompt
+		llamaReq["prompt"] = Llama.MixedPrompt(contextTokens, text)
+		return text
+	}
+	llamaReq["prompt"] = clientReq.Prompt // the template is added by LLama.cpp internally
+	if len(contextTokens) > 0 {
+		llamaReq["context"] = contextTokens // This key is added internally, not accepted from client
+	}
+	return clientReq.Prompt
+}
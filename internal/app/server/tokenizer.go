@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+	Tokenizer "llm-context-management/internal/pkg/tokenizer"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const tokenizerVerifyRetry = 30 * time.Second // Wait before verifying again when LLaMa.cpp's /tokenize was unavailable
+
+const (
+	tokenizerUnverified int32 = iota
+	tokenizerVerified
+	tokenizerRejected
+)
+
+// sampleConversation is rendered with the chat template, so the verification covers its special tokens.
+var sampleConversation = []ContextStorage.RawMessage{
+	{Role: "system", Content: "You are a helpful assistant."},
+	{Role: "user", Content: "What's the capital of France?"},
+	{Role: "assistant", Content: "The capital of France is Paris."},
+	{Role: "user", Content: "And of Germany?\n"},
+}
+
+// SetTokenizer sets an in-process tokenizer to use instead of LLaMa.cpp's /tokenize. It is only used after its
+// output matched /tokenize on verification samples, the server falls back to HTTP until then or if it didn't.
+// Call it before Start.
+func (s *Server) SetTokenizer(tokenizer Tokenizer.Tokenizer) {
+	s.nativeTokenizer = tokenizer
+	s.nativeTokenizerState.Store(tokenizerUnverified)
+}
+
+// tokenize tokenizes text with the native tokenizer once verified, with LLaMa.cpp's /tokenize otherwise.
+func (s *Server) tokenize(ctx context.Context, text string) ([]int, error) {
+	if s.useNativeTokenizer(ctx) {
+		return s.nativeTokenizer.Tokenize(ctx, text)
+	}
+	return s.llamaService.Tokenize(ctx, text)
+}
+
+// tokenizeOp names the tokenizer in use for the operations CSV.
+func (s *Server) tokenizeOp() string {
+	if s.nativeTokenizer != nil && s.nativeTokenizerState.Load() == tokenizerVerified {
+		return "nativeTokenizer.Tokenize"
+	}
+	return "llamaService.Tokenize"
+}
+
+// useNativeTokenizer reports whether the native tokenizer is verified, verifying it if due. Requests arriving
+// during a verification use HTTP instead of waiting.
+func (s *Server) useNativeTokenizer(ctx context.Context) bool {
+	if s.nativeTokenizer == nil {
+		return false
+	}
+	if state := s.nativeTokenizerState.Load(); state != tokenizerUnverified {
+		return state == tokenizerVerified
+	}
+	if !s.nativeTokenizerMu.TryLock() {
+		return false
+	}
+	defer s.nativeTokenizerMu.Unlock()
+	if state := s.nativeTokenizerState.Load(); state != tokenizerUnverified {
+		return state == tokenizerVerified
+	}
+	if time.Since(s.nativeTokenizerTry) < tokenizerVerifyRetry {
+		return false
+	}
+	s.nativeTokenizerTry = time.Now()
+
+	chatTemplate := s.templateFor(ctx, "")
+	samples := append(slices.Clone(Tokenizer.Samples), chatTemplate.Render(sampleConversation)+chatTemplate.GenerationPrompt)
+	opStartTime := time.Now()
+	err := Tokenizer.Verify(ctx, s.nativeTokenizer, s.llamaService, samples)
+	opDuration := time.Since(opStartTime)
+	details := fmt.Sprintf("Samples: %d", len(samples))
+	if err != nil {
+		details = fmt.Sprintf("Error: %v", err)
+	}
+	s.writeOperationToCsv(opStartTime, "nativeTokenizer.Verify", opDuration, "", "ServerMode", "", -1, -1, -1, -1, -1, details)
+	switch {
+	case err == nil:
+		log.Infof("Native tokenizer matches LLaMa.cpp's /tokenize on %d samples (took %s), using it from now on", len(samples), opDuration)
+		s.nativeTokenizerState.Store(tokenizerVerified)
+		return true
+	case errors.Is(err, Tokenizer.ErrMismatch):
+		log.Warnf("Native tokenizer doesn't match LLaMa.cpp's /tokenize, falling back to HTTP: %v", err)
+		s.nativeTokenizerState.Store(tokenizerRejected)
+	default:
+		log.Warnf("Could not verify the native tokenizer, using HTTP and retrying in %s: %v", tokenizerVerifyRetry, err)
+	}
+	return false
+}
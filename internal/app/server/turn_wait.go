@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TurnWaitPolicy controls how long a request waits for the previous turn of its session to show up in the context storage.
+// A client roaming between edge nodes can be faster than the replication of its previous turn, so the stored context
+// is re-read with exponential backoff until it reaches the expected turn or the deadline passes.
+type TurnWaitPolicy struct {
+	InitialDelay time.Duration // Delay before the first re-read
+	MaxDelay     time.Duration // Upper bound of a single delay
+	Multiplier   float64       // Growth factor of the delay after each re-read
+	Deadline     time.Duration // Total time to wait for the turn, measured from the first read
+	// Total time to wait for the context of a session unknown to this node when the request's turn does not show that
+	// the session has a stored context, i.e. on turn 1. Deadline applies from turn 2 on.
+	UnknownSessionDeadline time.Duration
+}
+
+// DefaultTurnWaitPolicy covers replication lags of a few seconds on WAN links between edge nodes.
+var DefaultTurnWaitPolicy = TurnWaitPolicy{
+	InitialDelay: 10 * time.Millisecond,
+	MaxDelay:     500 * time.Millisecond,
+	Multiplier:   2,
+	Deadline:     3 * time.Second,
+
+	UnknownSessionDeadline: 250 * time.Millisecond,
+}
+
+// SetTurnWaitPolicy replaces the policy for waiting on replicated turns. Call it before Start.
+func (s *Server) SetTurnWaitPolicy(policy TurnWaitPolicy) {
+	s.turnWait = policy
+}
+
+// turnMismatchError is returned when the client's turn does not follow the stored turn within the turn wait deadline.
+type turnMismatchError struct {
+	ClientTurn int
+	ServerTurn int
+}
+
+func (e *turnMismatchError) Error() string {
+	return fmt.Sprintf("Turn mismatch. Expected turn %d, but got %d.", e.ServerTurn+1, e.ClientTurn)
+}
+
+// waitForTurn calls load until the returned stored turn is the one preceding clientReq.Turn, following s.turnWait.
+// load returns the stored turn and the context length (for the CSV log) and is responsible for its own logging.
+// The number of re-reads is recorded in clientReq.Retries. A stored turn that is already at or past the client's turn
+// cannot be fixed by waiting, so it fails immediately.
+func (s *Server) waitForTurn(ctx context.Context, clientReq *CompletionRequest, operation string, load func() (int, int)) (int, error) {
+	waitStartTime := time.Now()
+	deadline := waitStartTime.Add(s.turnWait.Deadline)
+	delay := s.turnWait.InitialDelay
+
+	for attempt := 0; ; attempt++ {
+		clientReq.Retries = attempt
+		readStartTime := time.Now()
+		currentTurn, contextLength := load()
+		readDuration := time.Since(readStartTime)
+
+		if clientReq.Turn == currentTurn+1 {
+			log.Infof("Turn validation successful for session %s on attempt %d. Client turn: %d, Server turn: %d", clientReq.SessionID, attempt, clientReq.Turn, currentTurn)
+			s.writeOperationToCsv(readStartTime, operation, readDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, contextLength, currentTurn, attempt, fmt.Sprintf("TurnWaitMs: %d", time.Since(waitStartTime).Milliseconds()))
+			return currentTurn, nil
+		}
+
+		remaining := time.Until(deadline)
+		if currentTurn >= clientReq.Turn || remaining <= 0 {
+			log.Errorf("Turn mismatch for session %s after %d attempts (%s). Client turn: %d, Server turn: %d", clientReq.SessionID, attempt+1, time.Since(waitStartTime), clientReq.Turn, currentTurn)
+			s.writeOperationToCsv(readStartTime, operation, readDuration, clientReq.Mode, "ServerMode", clientReq.SessionID, -1, -1, contextLength, currentTurn, attempt, "Final attempt failed turn validation")
+			return currentTurn, &turnMismatchError{ClientTurn: clientReq.Turn, ServerTurn: currentTurn}
+		}
+
+		if delay > remaining {
+			delay = remaining
+		}
+		log.Warnf("Turn mismatch for session %s on attempt %d. Client turn: %d, Server turn: %d. Retrying in %s...", clientReq.SessionID, attempt, clientReq.Turn, currentTurn, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			log.Warnf("Stopped waiting for turn %d of session %s: %v", clientReq.Turn, clientReq.SessionID, ctx.Err())
+			return currentTurn, ctx.Err()
+		}
+		delay = time.Duration(float64(delay) * s.turnWait.Multiplier)
+		if delay > s.turnWait.MaxDelay {
+			delay = s.turnWait.MaxDelay
+		}
+	}
+}
+
+// writeTurnError responds to a failed context load: 409 with the expected and stored turn for a turn mismatch,
+// 409 with both fingerprints for a context of another model, 409 for a failed mode conversion, 409 with the versions
+// of a concurrently updated context, 503 otherwise.
+func writeTurnError(w http.ResponseWriter, sessionID string, err error) {
+	var conversion *modeConversionError
+	if errors.As(err, &conversion) {
+		writeError(w, http.StatusConflict, ErrCodeModeConversionFailed, conversion.Error(), map[string]interface{}{
+			"session_id": sessionID,
+			"from_mode":  conversion.From,
+			"to_mode":    conversion.To,
+		})
+		return
+	}
+	var modelMismatch *modelMismatchError
+	if errors.As(err, &modelMismatch) {
+		writeError(w, http.StatusConflict, ErrCodeModelMismatch, modelMismatch.Error(), map[string]interface{}{
+			"session_id":         sessionID,
+			"stored_fingerprint": modelMismatch.Stored,
+			"served_fingerprint": modelMismatch.Served,
+		})
+		return
+	}
+	var conflict *contextConflictError
+	if errors.As(err, &conflict) {
+		writeError(w, http.StatusConflict, ErrCodeContextConflict, conflict.Error(), conflictDetails(sessionID, conflict))
+		return
+	}
+	var mismatch *turnMismatchError
+	if !errors.As(err, &mismatch) {
+		writeError(w, http.StatusServiceUnavailable, ErrCodeRequestCanceled, "Request canceled while waiting for the session's turn", nil)
+		return
+	}
+	writeError(w, http.StatusConflict, ErrCodeTurnConflict, mismatch.Error(), map[string]interface{}{
+		"session_id":    sessionID,
+		"expected_turn": mismatch.ServerTurn + 1,
+		"server_turn":   mismatch.ServerTurn,
+		"client_turn":   mismatch.ClientTurn,
+	})
+}
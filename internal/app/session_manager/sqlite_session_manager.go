@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -14,6 +15,31 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrSessionNotFound is returned when a session does not exist in the database.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrUserNotFound is returned when a user does not exist in the database.
+var ErrUserNotFound = errors.New("user not found")
+
+// UserProfile is stored as the metadata of a user. It configures the assistant for all sessions of the user.
+type UserProfile struct {
+	SystemPrompt     string                 `json:"system_prompt,omitempty"`
+	Persona          string                 `json:"persona,omitempty"`           // Description of the assistant's persona, e.g. "Ava, the support assistant of ACME"
+	GenerationParams map[string]interface{} `json:"generation_params,omitempty"` // Defaults for LLaMa.cpp parameters a request does not set, e.g. temperature
+}
+
+// SystemMessage returns the content of the system message starting the user's sessions, empty if there is none.
+func (p *UserProfile) SystemMessage() string {
+	var parts []string
+	if p.SystemPrompt != "" {
+		parts = append(parts, p.SystemPrompt)
+	}
+	if p.Persona != "" {
+		parts = append(parts, "Persona: "+p.Persona)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
 type SQLiteSessionManager struct {
 	dbPath string
 }
@@ -127,6 +153,60 @@ func (mgr *SQLiteSessionManager) CreateUser(userID string, metadata map[string]i
 	return userID, nil
 }
 
+// GetUserProfile returns the profile stored in the user's metadata, or ErrUserNotFound.
+// A user without a profile has an empty one.
+func (mgr *SQLiteSessionManager) GetUserProfile(userID string) (*UserProfile, error) {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("GetUserProfile for userID '%s' took %v", userID, time.Since(startTime))
+	}()
+	db, err := mgr.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var metadata sql.NullString
+	err = db.QueryRow("SELECT metadata FROM users WHERE user_id = ?", userID).Scan(&metadata)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	profile := &UserProfile{}
+	if metadata.String != "" {
+		if err := json.Unmarshal([]byte(metadata.String), profile); err != nil {
+			return nil, fmt.Errorf("invalid metadata of user '%s': %w", userID, err)
+		}
+	}
+	return profile, nil
+}
+
+// SetUserProfile replaces the profile in the user's metadata, creating the user if it does not exist.
+func (mgr *SQLiteSessionManager) SetUserProfile(userID string, profile UserProfile) error {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("SetUserProfile for userID '%s' took %v", userID, time.Since(startTime))
+	}()
+	db, err := mgr.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	metaBytes, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = db.Exec(
+		`INSERT INTO users (user_id, created_at, last_active, metadata) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET metadata = excluded.metadata, last_active = excluded.last_active`,
+		userID, now, now, string(metaBytes),
+	)
+	return err
+}
+
 func (mgr *SQLiteSessionManager) CreateSession(userID string, sessionDurationDays int) (string, error) {
 	startTime := time.Now()
 	var sessionID string // Declare sessionID here to use in defer
@@ -167,8 +247,35 @@ func (mgr *SQLiteSessionManager) CreateSession(userID string, sessionDurationDay
 	return sessionID, nil
 }
 
+// AdoptSession registers a session created on another node, keeping its ID and owner.
+// It is a no-op if the session is already known.
+func (mgr *SQLiteSessionManager) AdoptSession(sessionID string, userID string, sessionDurationDays int) error {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("AdoptSession for userID '%s', sessionID '%s' took %v", userID, sessionID, time.Since(startTime))
+	}()
+	if _, err := mgr.CreateUser(userID, nil); err != nil { // INSERT OR IGNORE, keeps an existing user
+		return err
+	}
+
+	db, err := mgr.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	expiresAt := now + int64(sessionDurationDays*24*60*60)
+	_, err = db.Exec(
+		"INSERT OR IGNORE INTO sessions (session_id, user_id, created_at, last_active, expires_at) VALUES (?, ?, ?, ?, ?)",
+		sessionID, userID, now, now, expiresAt,
+	)
+	return err
+}
+
 type SessionInfo struct {
 	SessionID  string `json:"session_id"`
+	UserID     string `json:"user_id,omitempty"`
 	CreatedAt  string `json:"created_at"`
 	LastActive string `json:"last_active"`
 	ExpiresAt  string `json:"expires_at"`
@@ -203,6 +310,7 @@ func (mgr *SQLiteSessionManager) GetUserSessions(userID string) ([]SessionInfo,
 		}
 		sessions = append(sessions, SessionInfo{
 			SessionID:  sid,
+			UserID:     userID,
 			CreatedAt:  time.Unix(created, 0).Format(time.RFC3339),
 			LastActive: time.Unix(last, 0).Format(time.RFC3339),
 			ExpiresAt:  time.Unix(expires, 0).Format(time.RFC3339),
@@ -211,6 +319,69 @@ func (mgr *SQLiteSessionManager) GetUserSessions(userID string) ([]SessionInfo,
 	return sessions, nil
 }
 
+// GetSession returns the metadata of a single session, or ErrSessionNotFound.
+func (mgr *SQLiteSessionManager) GetSession(sessionID string) (*SessionInfo, error) {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("GetSession for sessionID '%s' took %v", sessionID, time.Since(startTime))
+	}()
+	db, err := mgr.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var userID sql.NullString
+	var created, last, expires int64
+	err = db.QueryRow(
+		"SELECT user_id, created_at, last_active, expires_at FROM sessions WHERE session_id = ?",
+		sessionID,
+	).Scan(&userID, &created, &last, &expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &SessionInfo{
+		SessionID:  sessionID,
+		UserID:     userID.String,
+		CreatedAt:  time.Unix(created, 0).Format(time.RFC3339),
+		LastActive: time.Unix(last, 0).Format(time.RFC3339),
+		ExpiresAt:  time.Unix(expires, 0).Format(time.RFC3339),
+	}, nil
+}
+
+// ExtendSession pushes the expiry of a session by the given number of days.
+// An already expired session is extended starting from now.
+func (mgr *SQLiteSessionManager) ExtendSession(sessionID string, days int) (*SessionInfo, error) {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("ExtendSession for sessionID '%s' by %d days took %v", sessionID, days, time.Since(startTime))
+	}()
+	db, err := mgr.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	result, err := db.Exec(
+		"UPDATE sessions SET expires_at = MAX(expires_at, ?) + ?, last_active = ? WHERE session_id = ?",
+		now, int64(days*24*60*60), now, sessionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return mgr.GetSession(sessionID)
+}
+
 func (mgr *SQLiteSessionManager) AddMessage(sessionID, role, content string, tokens interface{}, model *string) (string, error) {
 	startTime := time.Now()
 	var messageID string // Declare messageID here to use in defer
@@ -0,0 +1,357 @@
+package chat_template
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+)
+
+// DefaultTemplateName is used when neither the model name nor the LLM service identify a template.
+const DefaultTemplateName = "chatml"
+
+// Template describes how a model's chat format renders messages into prompt text.
+// It is data only, so custom templates can be loaded from JSON files.
+type Template struct {
+	Name string `json:"name"`
+	// MessageFormat renders one message, "{role}" and "{content}" are replaced.
+	MessageFormat string `json:"message_format"`
+	// RoleFormats overrides MessageFormat for specific roles (e.g. Mistral's [INST] for "user").
+	RoleFormats map[string]string `json:"role_formats,omitempty"`
+	// RoleNames renames roles in the rendered text (e.g. Gemma's "model" for "assistant").
+	RoleNames map[string]string `json:"role_names,omitempty"`
+	// GenerationPrompt opens the assistant's reply.
+	GenerationPrompt string `json:"generation_prompt,omitempty"`
+	// MergeSystem prepends system messages to the next user message, for formats without a system role.
+	MergeSystem bool `json:"merge_system,omitempty"`
+	// ModelPatterns are case-insensitive substrings of model names using this template.
+	ModelPatterns []string `json:"model_patterns,omitempty"`
+	// Marker is a string identifying this format in a model's Jinja chat template, as reported by llama.cpp's /props.
+	Marker string `json:"marker,omitempty"`
+}
+
+// Built-in templates, the rendered text matches the models' official chat templates without the BOS token,
+// which llama.cpp adds itself.
+var (
+	ChatML = &Template{
+		Name:             "chatml",
+		MessageFormat:    "<|im_start|>{role}\n{content}<|im_end|>\n",
+		GenerationPrompt: "<|im_start|>assistant\n",
+		ModelPatterns:    []string{"qwen", "chatml", "yi-", "hermes"},
+		Marker:           "<|im_start|>",
+	}
+	Llama3 = &Template{
+		Name:             "llama3",
+		MessageFormat:    "<|start_header_id|>{role}<|end_header_id|>\n\n{content}<|eot_id|>",
+		GenerationPrompt: "<|start_header_id|>assistant<|end_header_id|>\n\n",
+		ModelPatterns:    []string{"llama-3", "llama3"},
+		Marker:           "<|start_header_id|>",
+	}
+	Mistral = &Template{
+		Name:          "mistral",
+		MessageFormat: "{content}</s>",
+		RoleFormats:   map[string]string{"user": "[INST] {content} [/INST]"},
+		MergeSystem:   true,
+		ModelPatterns: []string{"mistral", "mixtral"},
+		Marker:        "[INST]",
+	}
+	Gemma = &Template{
+		Name:             "gemma",
+		MessageFormat:    "<start_of_turn>{role}\n{content}<end_of_turn>\n",
+		RoleNames:        map[string]string{"assistant": "model"},
+		GenerationPrompt: "<start_of_turn>model\n",
+		MergeSystem:      true,
+		ModelPatterns:    []string{"gemma"},
+		Marker:           "<start_of_turn>",
+	}
+	Phi = &Template{
+		Name:             "phi",
+		MessageFormat:    "<|{role}|>\n{content}<|end|>\n",
+		GenerationPrompt: "<|assistant|>\n",
+		ModelPatterns:    []string{"phi-3", "phi3", "phi-4", "phi4"},
+		Marker:           "<|end|>",
+	}
+)
+
+// Render renders messages as prompt text, without a generation prompt.
+func (t *Template) Render(messages []ContextStorage.RawMessage) string {
+	var builder strings.Builder
+	pendingSystem := ""
+	for _, msg := range messages {
+		content := msg.Content
+		if t.MergeSystem {
+			if msg.Role == "system" {
+				pendingSystem += content + "\n\n"
+				continue
+			}
+			if msg.Role == "user" && pendingSystem != "" {
+				content = pendingSystem + content
+				pendingSystem = ""
+			}
+		}
+		builder.WriteString(t.renderMessage(msg.Role, content))
+	}
+	if pendingSystem != "" { // a trailing system message without a following user message
+		builder.WriteString(t.renderMessage("user", strings.TrimSuffix(pendingSystem, "\n\n")))
+	}
+	return builder.String()
+}
+
+func (t *Template) renderMessage(role string, content string) string {
+	format := t.MessageFormat
+	if roleFormat, ok := t.RoleFormats[role]; ok {
+		format = roleFormat
+	}
+	if name, ok := t.RoleNames[role]; ok {
+		role = name
+	}
+	return strings.NewReplacer("{role}", role, "{content}", content).Replace(format)
+}
+
+func (t *Template) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("chat template without a name")
+	}
+	if !strings.Contains(t.MessageFormat, "{content}") {
+		return fmt.Errorf("chat template %q: message_format must contain {content}", t.Name)
+	}
+	for role, format := range t.RoleFormats {
+		if !strings.Contains(format, "{content}") {
+			return fmt.Errorf("chat template %q: role format of %q must contain {content}", t.Name, role)
+		}
+	}
+	return nil
+}
+
+// Registry holds the known templates and selects one for a model.
+type Registry struct {
+	mu        sync.RWMutex
+	templates []*Template // custom templates are put in front, so they take precedence over built-ins
+}
+
+// NewRegistry creates a registry with the built-in templates.
+func NewRegistry() *Registry {
+	return &Registry{templates: []*Template{ChatML, Llama3, Mistral, Gemma, Phi}}
+}
+
+// Register adds a template. A template with the same name replaces the existing one.
+func (r *Registry) Register(t *Template) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	templates := []*Template{t}
+	for _, existing := range r.templates {
+		if existing.Name != t.Name {
+			templates = append(templates, existing)
+		}
+	}
+	r.templates = templates
+	log.Infof("Registered chat template '%s'", t.Name)
+	return nil
+}
+
+// LoadFile registers the templates of a JSON file, holding either a single template or an array of templates.
+func (r *Registry) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read chat templates from %s: %w", path, err)
+	}
+	var templates []*Template
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &templates)
+	} else {
+		var t Template
+		err = json.Unmarshal(data, &t)
+		templates = []*Template{&t}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse chat templates from %s: %w", path, err)
+	}
+	for _, t := range templates {
+		if err := r.Register(t); err != nil {
+			return fmt.Errorf("invalid chat template in %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Get returns the template with the given name.
+func (r *Registry) Get(name string) (*Template, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, t := range r.templates {
+		if strings.EqualFold(t.Name, name) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// ForModel selects the template by a model name, either a template name or a name containing one of the ModelPatterns.
+func (r *Registry) ForModel(model string) (*Template, bool) {
+	if model == "" {
+		return nil, false
+	}
+	if t, ok := r.Get(model); ok {
+		return t, true
+	}
+	lowerModel := strings.ToLower(model)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, t := range r.templates {
+		for _, pattern := range t.ModelPatterns {
+			if strings.Contains(lowerModel, strings.ToLower(pattern)) {
+				return t, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// ForProps selects the template from llama.cpp's /props response, by the markers in its "chat_template"
+// or, failing that, by the loaded model's path.
+func (r *Registry) ForProps(props map[string]interface{}) (*Template, bool) {
+	if jinja, _ := props["chat_template"].(string); jinja != "" {
+		r.mu.RLock()
+		for _, t := range r.templates {
+			if t.Marker != "" && strings.Contains(jinja, t.Marker) {
+				r.mu.RUnlock()
+				return t, true
+			}
+		}
+		r.mu.RUnlock()
+	}
+	if modelPath, _ := props["model_path"].(string); modelPath != "" {
+		return r.ForModel(modelPath)
+	}
+	return nil, false
+}
+
+// ForRendered selects the template that rendered text, e.g. a detokenized context, by its Marker.
+func (r *Registry) ForRendered(text string) (*Template, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, t := range r.templates {
+		if t.Marker != "" && strings.Contains(text, t.Marker) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// Default returns the fallback template.
+func (r *Registry) Default() *Template {
+	if t, ok := r.Get(DefaultTemplateName); ok {
+		return t
+	}
+	return ChatML
+}
+
+// TurnMarker returns the text that starts every user message, without trailing whitespace, e.g. "<|im_start|>user".
+// It marks the turn boundaries in a tokenized context.
+func (t *Template) TurnMarker() string {
+	return t.MessageMarker("user")
+}
+
+// MessageMarker returns the text that starts every message of role, without trailing whitespace.
+// It is empty if the format has no text before the content, e.g. for Mistral's assistant messages.
+func (t *Template) MessageMarker(role string) string {
+	rendered := t.renderMessage(role, "{content}")
+	return strings.TrimRightFunc(rendered[:strings.Index(rendered, "{content}")], unicode.IsSpace)
+}
+
+// MessageSuffix returns the text that ends every message of role, e.g. "<|im_end|>\n".
+func (t *Template) MessageSuffix(role string) string {
+	rendered := t.renderMessage(role, "{content}")
+	return rendered[strings.Index(rendered, "{content}")+len("{content}"):]
+}
+
+// Parse splits text rendered by Render back into messages. System messages that MergeSystem put into a user
+// message stay part of it, see ParseContext. Text that doesn't follow the template, e.g. a cut-off message, is an error.
+func (t *Template) Parse(text string) ([]ContextStorage.RawMessage, error) {
+	type rolePattern struct {
+		role, prefix, suffix string
+	}
+	roles := []string{"user", "assistant"}
+	if !t.MergeSystem {
+		roles = append(roles, "system")
+	}
+	for role := range t.RoleFormats {
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	var patterns []rolePattern
+	for _, role := range roles {
+		rendered := t.renderMessage(role, "{content}")
+		i := strings.Index(rendered, "{content}")
+		patterns = append(patterns, rolePattern{role: role, prefix: rendered[:i], suffix: rendered[i+len("{content}"):]})
+	}
+	// Longer prefixes first, so that a role without one (e.g. Mistral's assistant) is tried last.
+	sort.SliceStable(patterns, func(i, j int) bool { return len(patterns[i].prefix) > len(patterns[j].prefix) })
+
+	var messages []ContextStorage.RawMessage
+	for len(text) > 0 {
+		matched := false
+		for _, p := range patterns {
+			if !strings.HasPrefix(text, p.prefix) {
+				continue
+			}
+			rest := text[len(p.prefix):]
+			end := len(rest) // without a suffix the content runs to the end
+			if p.suffix != "" {
+				if end = strings.Index(rest, p.suffix); end < 0 {
+					continue
+				}
+			}
+			messages = append(messages, ContextStorage.RawMessage{Role: p.role, Content: rest[:end]})
+			text = rest[min(end+len(p.suffix), len(rest)):]
+			matched = true
+			break
+		}
+		if !matched {
+			excerpt := text
+			if len(excerpt) > 40 {
+				excerpt = excerpt[:40] + "..."
+			}
+			return nil, fmt.Errorf("chat template %q: no message starts at %q", t.Name, excerpt)
+		}
+	}
+	return messages, nil
+}
+
+// RenderContext renders the messages starting a stored context. Unlike Render, MergeSystem templates render the
+// leading system messages as a user message of their own, so the system prompt is not mixed into the first turn.
+// It returns the text and the number of leading messages Parse returns for the system prompt, for ParseContext.
+func (t *Template) RenderContext(messages []ContextStorage.RawMessage) (string, int) {
+	system := 0
+	for system < len(messages) && messages[system].Role == "system" {
+		system++
+	}
+	if !t.MergeSystem || system == 0 {
+		return t.Render(messages), system
+	}
+	return t.Render(messages[:system]) + t.Render(messages[system:]), 1
+}
+
+// ParseContext is Parse for text rendered by RenderContext, it restores the role of the systemMessages leading
+// messages, which MergeSystem templates render as user messages.
+func (t *Template) ParseContext(text string, systemMessages int) ([]ContextStorage.RawMessage, error) {
+	messages, err := t.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < systemMessages && i < len(messages); i++ {
+		messages[i].Role = "system"
+	}
+	return messages, nil
+}
@@ -0,0 +1,228 @@
+package chat_template
+
+import (
+	"reflect"
+	"testing"
+
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+)
+
+func TestRenderParseRoundTrip(t *testing.T) {
+	conversation := []ContextStorage.RawMessage{
+		{Role: "user", Content: "Hi, who are you?"},
+		{Role: "assistant", Content: "An assistant.\nHow can I help?"},
+		{Role: "user", Content: "Tell me a joke"},
+		{Role: "assistant", Content: "No."},
+	}
+	withSystem := append([]ContextStorage.RawMessage{{Role: "system", Content: "Be brief."}}, conversation...)
+	merged := append([]ContextStorage.RawMessage{{Role: "user", Content: "Be brief.\n\nHi, who are you?"}}, conversation[1:]...)
+
+	tests := []struct {
+		template *Template
+		messages []ContextStorage.RawMessage
+		want     []ContextStorage.RawMessage // Parse result, the input if nil
+	}{
+		{template: ChatML, messages: conversation},
+		{template: ChatML, messages: withSystem},
+		{template: Llama3, messages: withSystem},
+		{template: Phi, messages: withSystem},
+		{template: Gemma, messages: conversation},
+		{template: Gemma, messages: withSystem, want: merged},
+		{template: Mistral, messages: conversation},
+		{template: Mistral, messages: withSystem, want: merged},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if want == nil {
+			want = tt.messages
+		}
+		t.Run(tt.template.Name, func(t *testing.T) {
+			rendered := tt.template.Render(tt.messages)
+			parsed, err := tt.template.Parse(rendered)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", rendered, err)
+			}
+			if !reflect.DeepEqual(parsed, want) {
+				t.Errorf("Parse(Render(messages)) = %q, want %q", parsed, want)
+			}
+		})
+	}
+}
+
+func TestRenderParseContext(t *testing.T) {
+	conversation := []ContextStorage.RawMessage{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+	}
+	withSystem := append([]ContextStorage.RawMessage{{Role: "system", Content: "Be brief."}}, conversation...)
+	twoSystem := append([]ContextStorage.RawMessage{{Role: "system", Content: "Be brief."}, {Role: "system", Content: "Be kind."}}, conversation...)
+	joinedSystem := append([]ContextStorage.RawMessage{{Role: "system", Content: "Be brief.\n\nBe kind."}}, conversation...)
+
+	tests := []struct {
+		name         string
+		template     *Template
+		messages     []ContextStorage.RawMessage
+		wantText     string
+		wantSystem   int
+		wantMessages []ContextStorage.RawMessage // ParseContext result, the input if nil
+	}{
+		{
+			name:       "chatml",
+			template:   ChatML,
+			messages:   twoSystem,
+			wantText:   "<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>system\nBe kind.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\nHello<|im_end|>\n",
+			wantSystem: 2,
+		},
+		{
+			name:       "gemma system apart",
+			template:   Gemma,
+			messages:   withSystem,
+			wantText:   "<start_of_turn>user\nBe brief.<end_of_turn>\n<start_of_turn>user\nHi<end_of_turn>\n<start_of_turn>model\nHello<end_of_turn>\n",
+			wantSystem: 1,
+		},
+		{
+			name:         "mistral system messages joined",
+			template:     Mistral,
+			messages:     twoSystem,
+			wantText:     "[INST] Be brief.\n\nBe kind. [/INST][INST] Hi [/INST]Hello</s>",
+			wantSystem:   1,
+			wantMessages: joinedSystem,
+		},
+		{
+			name:     "gemma without system",
+			template: Gemma,
+			messages: conversation,
+			wantText: "<start_of_turn>user\nHi<end_of_turn>\n<start_of_turn>model\nHello<end_of_turn>\n",
+		},
+	}
+	for _, tt := range tests {
+		want := tt.wantMessages
+		if want == nil {
+			want = tt.messages
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			text, system := tt.template.RenderContext(tt.messages)
+			if text != tt.wantText || system != tt.wantSystem {
+				t.Fatalf("RenderContext = %q, %d; want %q, %d", text, system, tt.wantText, tt.wantSystem)
+			}
+			parsed, err := tt.template.ParseContext(text, system)
+			if err != nil {
+				t.Fatalf("ParseContext(%q): %v", text, err)
+			}
+			if !reflect.DeepEqual(parsed, want) {
+				t.Errorf("ParseContext(RenderContext(messages)) = %q, want %q", parsed, want)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		template *Template
+		messages []ContextStorage.RawMessage
+		want     string
+	}{
+		{
+			template: ChatML,
+			messages: []ContextStorage.RawMessage{{Role: "system", Content: "S"}, {Role: "user", Content: "U"}},
+			want:     "<|im_start|>system\nS<|im_end|>\n<|im_start|>user\nU<|im_end|>\n",
+		},
+		{
+			template: Gemma,
+			messages: []ContextStorage.RawMessage{{Role: "user", Content: "U"}, {Role: "assistant", Content: "A"}},
+			want:     "<start_of_turn>user\nU<end_of_turn>\n<start_of_turn>model\nA<end_of_turn>\n",
+		},
+		{
+			template: Mistral,
+			messages: []ContextStorage.RawMessage{{Role: "system", Content: "S"}, {Role: "user", Content: "U"}, {Role: "assistant", Content: "A"}},
+			want:     "[INST] S\n\nU [/INST]A</s>",
+		},
+		{
+			template: Gemma, // A system message without a following user message is rendered as one
+			messages: []ContextStorage.RawMessage{{Role: "system", Content: "S"}},
+			want:     "<start_of_turn>user\nS<end_of_turn>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template.Name, func(t *testing.T) {
+			if got := tt.template.Render(tt.messages); got != tt.want {
+				t.Errorf("Render = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRejectsForeignText(t *testing.T) {
+	tests := []struct {
+		template *Template
+		text     string
+	}{
+		{template: ChatML, text: "plain text"},
+		{template: ChatML, text: "<|im_start|>user\ncut off"},
+		{template: Llama3, text: "<|im_start|>user\nU<|im_end|>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template.Name, func(t *testing.T) {
+			if messages, err := tt.template.Parse(tt.text); err == nil {
+				t.Errorf("Parse(%q) = %q, want an error", tt.text, messages)
+			}
+		})
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	tests := []struct {
+		template   *Template
+		role       string
+		wantMarker string
+		wantSuffix string
+	}{
+		{template: ChatML, role: "user", wantMarker: "<|im_start|>user", wantSuffix: "<|im_end|>\n"},
+		{template: Llama3, role: "assistant", wantMarker: "<|start_header_id|>assistant<|end_header_id|>", wantSuffix: "<|eot_id|>"},
+		{template: Gemma, role: "assistant", wantMarker: "<start_of_turn>model", wantSuffix: "<end_of_turn>\n"},
+		{template: Mistral, role: "user", wantMarker: "[INST]", wantSuffix: " [/INST]"},
+		{template: Mistral, role: "assistant", wantMarker: "", wantSuffix: "</s>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template.Name+"/"+tt.role, func(t *testing.T) {
+			if got := tt.template.MessageMarker(tt.role); got != tt.wantMarker {
+				t.Errorf("MessageMarker = %q, want %q", got, tt.wantMarker)
+			}
+			if got := tt.template.MessageSuffix(tt.role); got != tt.wantSuffix {
+				t.Errorf("MessageSuffix = %q, want %q", got, tt.wantSuffix)
+			}
+		})
+	}
+}
+
+func TestRegistrySelection(t *testing.T) {
+	registry := NewRegistry()
+	custom := &Template{Name: "custom", MessageFormat: "<{role}>{content}</{role}>", ModelPatterns: []string{"qwen-custom"}}
+	if err := registry.Register(custom); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := registry.Register(&Template{Name: "broken", MessageFormat: "{role}"}); err == nil {
+		t.Error("Register accepted a template without {content}")
+	}
+
+	tests := []struct {
+		model string
+		want  string // Empty if no template matches
+	}{
+		{model: "Qwen2.5-7B-Instruct", want: "chatml"},
+		{model: "qwen-custom-7b", want: "custom"}, // Custom templates take precedence
+		{model: "Meta-Llama-3.1-8B", want: "llama3"},
+		{model: "gemma-2-9b-it.Q4_K_M.gguf", want: "gemma"},
+		{model: "MISTRAL", want: "mistral"},
+		{model: "unknown-model", want: ""},
+		{model: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			got, ok := registry.ForModel(tt.model)
+			if ok != (tt.want != "") || (ok && got.Name != tt.want) {
+				t.Errorf("ForModel = %v, %v; want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package context_storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CachingContextStorage is a write-through cache in front of another ContextStorage. It keeps the contexts this node
+// read or wrote recently, so the next turn of a session served by the same node skips the backend's read.
+//
+// A cached context is only returned to a read that expects its turn, see WithExpectedTurn. If the cached turn is
+// another one, e.g. because the client continued the session on another node, the entry is dropped and the backend
+// read. Reads without an expected turn always go to the backend. The versions recorded with an entry are restored on a
+// hit, so updates are still checked for concurrent writes; an entry older than a consistency token is not used.
+// IsSessionDeleted always asks the backend, and drops the entries of a session deleted on another node.
+type CachingContextStorage struct {
+	backend  ContextStorage
+	maxBytes int           // Upper bound of the estimated size of all entries
+	ttl      time.Duration // Age after which an entry is dropped, 0 keeps entries until evicted
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // Of *cacheEntry, by cacheKey
+	lru     *list.List               // Most recently used first
+	bytes   int
+}
+
+// cacheEntry is a cached context, either tokens or messages depending on its mode.
+type cacheEntry struct {
+	key      string
+	tokens   []int
+	messages []RawMessage
+	turn     int
+	meta     SessionMetadata
+	versions map[string][]VersionVector // Versions recorded by the backend when the entry was read or written
+	size     int
+	expires  time.Time
+}
+
+// NewCachingContextStorage caches the contexts of backend, up to about maxBytes and for at most ttl each.
+func NewCachingContextStorage(backend ContextStorage, maxBytes int, ttl time.Duration) *CachingContextStorage {
+	return &CachingContextStorage{
+		backend:  backend,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+type expectedTurnKey struct{}
+
+// WithExpectedTurn returns a context for reads that need the session's context at turn, e.g. the previous turn of a
+// request. A CachingContextStorage only answers them from its cache if it holds that turn.
+func WithExpectedTurn(ctx context.Context, turn int) context.Context {
+	return context.WithValue(ctx, expectedTurnKey{}, turn)
+}
+
+func cacheKey(mode string, sessionID string) string {
+	return mode + "/" + sessionID
+}
+
+// GetTokenizedSessionContext implements ContextStorage.
+func (c *CachingContextStorage) GetTokenizedSessionContext(ctx context.Context, sessionID string) ([]int, int, SessionMetadata, error) {
+	key := cacheKey(ModeTokenized, sessionID)
+	if entry, ok := c.lookup(ctx, key); ok {
+		return slices.Clone(entry.tokens), entry.turn, entry.meta, nil
+	}
+	recorded := &Versions{}
+	tokens, turn, meta, err := c.backend.GetTokenizedSessionContext(WithVersions(ctx, recorded), sessionID)
+	versionsFrom(ctx).merge(recorded)
+	if err != nil || tokens == nil {
+		c.remove(key)
+		return tokens, turn, meta, err
+	}
+	c.store(&cacheEntry{key: key, tokens: slices.Clone(tokens), turn: turn, meta: meta, versions: recorded.snapshot(), size: 8 * len(tokens)})
+	return tokens, turn, meta, nil
+}
+
+// UpdateSessionContext implements ContextStorage, the context is cached once the backend stored it.
+func (c *CachingContextStorage) UpdateSessionContext(ctx context.Context, sessionID string, newFullTokenizedContext []int, newTurn int, meta SessionMetadata) error {
+	key := cacheKey(ModeTokenized, sessionID)
+	recorded := versionsFrom(ctx).clone()
+	err := c.backend.UpdateSessionContext(WithVersions(ctx, recorded), sessionID, newFullTokenizedContext, newTurn, meta)
+	versionsFrom(ctx).merge(recorded)
+	if err != nil {
+		c.remove(key)
+		return err
+	}
+	c.store(&cacheEntry{key: key, tokens: slices.Clone(newFullTokenizedContext), turn: newTurn, meta: meta, versions: recorded.snapshot(), size: 8 * len(newFullTokenizedContext)})
+	return nil
+}
+
+// GetRawSessionContext implements ContextStorage.
+func (c *CachingContextStorage) GetRawSessionContext(ctx context.Context, sessionID string) ([]RawMessage, int, SessionMetadata, error) {
+	key := cacheKey(ModeRaw, sessionID)
+	if entry, ok := c.lookup(ctx, key); ok {
+		return slices.Clone(entry.messages), entry.turn, entry.meta, nil
+	}
+	recorded := &Versions{}
+	messages, turn, meta, err := c.backend.GetRawSessionContext(WithVersions(ctx, recorded), sessionID)
+	versionsFrom(ctx).merge(recorded)
+	if err != nil || messages == nil {
+		c.remove(key)
+		return messages, turn, meta, err
+	}
+	c.store(&cacheEntry{key: key, messages: slices.Clone(messages), turn: turn, meta: meta, versions: recorded.snapshot(), size: messagesSize(messages)})
+	return messages, turn, meta, nil
+}
+
+// UpdateRawSessionContext implements ContextStorage, the context is cached once the backend stored it.
+func (c *CachingContextStorage) UpdateRawSessionContext(ctx context.Context, sessionID string, newMessages []RawMessage, newTurn int, meta SessionMetadata) error {
+	key := cacheKey(ModeRaw, sessionID)
+	recorded := versionsFrom(ctx).clone()
+	err := c.backend.UpdateRawSessionContext(WithVersions(ctx, recorded), sessionID, newMessages, newTurn, meta)
+	versionsFrom(ctx).merge(recorded)
+	if err != nil {
+		c.remove(key)
+		return err
+	}
+	c.store(&cacheEntry{key: key, messages: slices.Clone(newMessages), turn: newTurn, meta: meta, versions: recorded.snapshot(), size: messagesSize(newMessages)})
+	return nil
+}
+
+// GetSessionMetadata implements ContextStorage, it always reads the backend.
+func (c *CachingContextStorage) GetSessionMetadata(ctx context.Context, sessionID string) (SessionMetadata, error) {
+	return c.backend.GetSessionMetadata(ctx, sessionID)
+}
+
+// DeleteSessionContext implements ContextStorage.
+func (c *CachingContextStorage) DeleteSessionContext(ctx context.Context, sessionID string) error {
+	c.remove(cacheKey(ModeTokenized, sessionID))
+	c.remove(cacheKey(ModeRaw, sessionID))
+	return c.backend.DeleteSessionContext(ctx, sessionID)
+}
+
+// IsSessionDeleted implements ContextStorage.
+func (c *CachingContextStorage) IsSessionDeleted(ctx context.Context, sessionID string) (bool, error) {
+	deleted, err := c.backend.IsSessionDeleted(ctx, sessionID)
+	if deleted {
+		c.remove(cacheKey(ModeTokenized, sessionID))
+		c.remove(cacheKey(ModeRaw, sessionID))
+	}
+	return deleted, err
+}
+
+// IsNotFoundError implements ContextStorage.
+func (c *CachingContextStorage) IsNotFoundError(err error) bool {
+	return c.backend.IsNotFoundError(err)
+}
+
+// ResolveConflict implements ConflictResolver if the backend does.
+func (c *CachingContextStorage) ResolveConflict(ctx context.Context, sessionID string, mode string) (ConflictBranch, error) {
+	c.remove(cacheKey(mode, sessionID))
+	resolver, ok := c.backend.(ConflictResolver)
+	if !ok {
+		return ConflictBranch{}, fmt.Errorf("the context storage cannot resolve conflicts")
+	}
+	return resolver.ResolveConflict(ctx, sessionID, mode)
+}
+
+// lookup returns the entry of key if it can answer a read with ctx. An entry of another turn than the expected one is
+// outdated, at least on this node, and dropped.
+func (c *CachingContextStorage) lookup(ctx context.Context, key string) (*cacheEntry, bool) {
+	expectedTurn, ok := ctx.Value(expectedTurnKey{}).(int)
+	if !ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.removeElement(element)
+		return nil, false
+	}
+	if entry.turn != expectedTurn {
+		log.Debugf("Context cache: %s holds turn %d, expected %d, dropping it", key, entry.turn, expectedTurn)
+		c.removeElement(element)
+		return nil, false
+	}
+	for versionKey, versions := range entry.versions {
+		for _, required := range requiredVersions(ctx, versionKey) {
+			if !slices.ContainsFunc(versions, func(v VersionVector) bool { return v.dominates(required) }) {
+				log.Debugf("Context cache: %s is older than the client's consistency token, dropping it", key)
+				c.removeElement(element)
+				return nil, false
+			}
+		}
+	}
+	c.lru.MoveToFront(element)
+	versionsFrom(ctx).merge(&Versions{keys: entry.versions})
+	log.Debugf("Context cache: hit for %s at turn %d", key, entry.turn)
+	return entry, true
+}
+
+// store replaces the entry of its key and evicts the least recently used entries beyond maxBytes.
+func (c *CachingContextStorage) store(entry *cacheEntry) {
+	entry.size += len(entry.key) + 64 // Rough overhead of the entry and its list element
+	if entry.size > c.maxBytes {
+		c.remove(entry.key)
+		return
+	}
+	entry.expires = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.removeElement(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *CachingContextStorage) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// removeElement drops an entry, c.mu must be held.
+func (c *CachingContextStorage) removeElement(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+// messagesSize estimates the memory used by messages.
+func messagesSize(messages []RawMessage) int {
+	size := 0
+	for _, message := range messages {
+		size += len(message.Role) + len(message.Content) + 32
+	}
+	return size
+}
@@ -0,0 +1,333 @@
+package context_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeStorage is an in-memory ContextStorage that counts reads and, like FReD, records a new version for every write.
+// Versions are recorded under the cacheKey of a context.
+type fakeStorage struct {
+	tokens     map[string][]int
+	messages   map[string][]RawMessage
+	turns      map[string]int
+	versions   map[string]VersionVector
+	deleted    map[string]bool // Sessions with a tombstone
+	reads      int
+	failWrites bool
+}
+
+var errFakeWrite = errors.New("write failed")
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		tokens:   make(map[string][]int),
+		messages: make(map[string][]RawMessage),
+		turns:    make(map[string]int),
+		versions: make(map[string]VersionVector),
+		deleted:  make(map[string]bool),
+	}
+}
+
+func (f *fakeStorage) read(ctx context.Context, key string) (int, error) {
+	f.reads++
+	version, ok := f.versions[key]
+	if !ok {
+		return 0, ErrFredNotFound
+	}
+	versionsFrom(ctx).set(key, []VersionVector{version})
+	return f.turns[key], nil
+}
+
+func (f *fakeStorage) write(ctx context.Context, key string, turn int) error {
+	if f.failWrites {
+		return errFakeWrite
+	}
+	f.turns[key] = turn
+	f.versions[key] = VersionVector{"node1": f.versions[key]["node1"] + 1}
+	versionsFrom(ctx).set(key, []VersionVector{f.versions[key]})
+	return nil
+}
+
+func (f *fakeStorage) GetTokenizedSessionContext(ctx context.Context, sessionID string) ([]int, int, SessionMetadata, error) {
+	key := cacheKey(ModeTokenized, sessionID)
+	turn, err := f.read(ctx, key)
+	if err != nil {
+		return nil, 0, SessionMetadata{}, err
+	}
+	return f.tokens[key], turn, SessionMetadata{}, nil
+}
+
+func (f *fakeStorage) UpdateSessionContext(ctx context.Context, sessionID string, newFullTokenizedContext []int, newTurn int, _ SessionMetadata) error {
+	key := cacheKey(ModeTokenized, sessionID)
+	if err := f.write(ctx, key, newTurn); err != nil {
+		return err
+	}
+	f.tokens[key] = newFullTokenizedContext
+	return nil
+}
+
+func (f *fakeStorage) GetRawSessionContext(ctx context.Context, sessionID string) ([]RawMessage, int, SessionMetadata, error) {
+	key := cacheKey(ModeRaw, sessionID)
+	turn, err := f.read(ctx, key)
+	if err != nil {
+		return nil, 0, SessionMetadata{}, err
+	}
+	return f.messages[key], turn, SessionMetadata{}, nil
+}
+
+func (f *fakeStorage) UpdateRawSessionContext(ctx context.Context, sessionID string, newMessages []RawMessage, newTurn int, _ SessionMetadata) error {
+	key := cacheKey(ModeRaw, sessionID)
+	if err := f.write(ctx, key, newTurn); err != nil {
+		return err
+	}
+	f.messages[key] = newMessages
+	return nil
+}
+
+func (f *fakeStorage) GetSessionMetadata(context.Context, string) (SessionMetadata, error) {
+	return SessionMetadata{}, nil
+}
+
+func (f *fakeStorage) DeleteSessionContext(_ context.Context, sessionID string) error {
+	for _, mode := range []string{ModeTokenized, ModeRaw} {
+		key := cacheKey(mode, sessionID)
+		delete(f.tokens, key)
+		delete(f.messages, key)
+		delete(f.turns, key)
+		delete(f.versions, key)
+	}
+	f.deleted[sessionID] = true
+	return nil
+}
+
+func (f *fakeStorage) IsSessionDeleted(_ context.Context, sessionID string) (bool, error) {
+	return f.deleted[sessionID], nil
+}
+
+func (f *fakeStorage) IsNotFoundError(err error) bool {
+	return errors.Is(err, ErrFredNotFound)
+}
+
+// writeContext stores a context of turn in storage, of 10 tokens or 2 messages depending on mode.
+func writeContext(ctx context.Context, storage ContextStorage, mode string, sessionID string, turn int) error {
+	if mode == ModeRaw {
+		messages := []RawMessage{{Role: "user", Content: "Hello"}, {Role: "assistant", Content: "Hi"}}
+		return storage.UpdateRawSessionContext(ctx, sessionID, messages, turn, SessionMetadata{})
+	}
+	return storage.UpdateSessionContext(ctx, sessionID, make([]int, 10), turn, SessionMetadata{})
+}
+
+// readContext reads the turn of the context of sessionID in mode.
+func readContext(ctx context.Context, storage ContextStorage, mode string, sessionID string) (int, error) {
+	if mode == ModeRaw {
+		_, turn, _, err := storage.GetRawSessionContext(ctx, sessionID)
+		return turn, err
+	}
+	_, turn, _, err := storage.GetTokenizedSessionContext(ctx, sessionID)
+	return turn, err
+}
+
+func TestCachingContextStorageRead(t *testing.T) {
+	expectTurn := func(turn int) func(context.Context) context.Context {
+		return func(ctx context.Context) context.Context { return WithExpectedTurn(ctx, turn) }
+	}
+	requireVersion := func(counter uint64) func(context.Context) context.Context {
+		return func(ctx context.Context) context.Context {
+			token := ConsistencyToken{SessionID: "s1", Turn: 2, Versions: map[string][]VersionVector{
+				cacheKey(ModeTokenized, "s1"): {{"node1": counter}},
+				cacheKey(ModeRaw, "s1"):       {{"node1": counter}},
+			}}
+			return WithExpectedTurn(WithConsistencyToken(ctx, token), 2)
+		}
+	}
+
+	// Every case caches turn 2 of session s1 by writing it through the cache, then applies change and reads with readCtx.
+	tests := []struct {
+		name         string
+		maxBytes     int
+		ttl          time.Duration
+		change       func(ctx context.Context, c *CachingContextStorage, backend *fakeStorage, mode string) error
+		readCtx      func(context.Context) context.Context
+		wantBackend  bool // Whether the read goes to the backend
+		wantTurn     int
+		wantNotFound bool
+	}{
+		{name: "hit", readCtx: expectTurn(2), wantTurn: 2},
+		{name: "no expected turn", readCtx: func(ctx context.Context) context.Context { return ctx }, wantBackend: true, wantTurn: 2},
+		{
+			name: "turn written on another node",
+			change: func(ctx context.Context, _ *CachingContextStorage, backend *fakeStorage, mode string) error {
+				return writeContext(ctx, backend, mode, "s1", 3)
+			},
+			readCtx: expectTurn(3), wantBackend: true, wantTurn: 3,
+		},
+		{name: "older expected turn", readCtx: expectTurn(1), wantBackend: true, wantTurn: 2},
+		{name: "expired", ttl: time.Nanosecond, readCtx: expectTurn(2), wantBackend: true, wantTurn: 2},
+		{name: "larger than the cache", maxBytes: 64, readCtx: expectTurn(2), wantBackend: true, wantTurn: 2},
+		{
+			name: "updated",
+			change: func(ctx context.Context, c *CachingContextStorage, _ *fakeStorage, mode string) error {
+				return writeContext(ctx, c, mode, "s1", 3)
+			},
+			readCtx: expectTurn(3), wantTurn: 3,
+		},
+		{
+			name: "failed update",
+			change: func(ctx context.Context, c *CachingContextStorage, backend *fakeStorage, mode string) error {
+				backend.failWrites = true
+				if err := writeContext(ctx, c, mode, "s1", 3); !errors.Is(err, errFakeWrite) {
+					return fmt.Errorf("update error = %v, want %v", err, errFakeWrite)
+				}
+				return nil
+			},
+			readCtx: expectTurn(2), wantBackend: true, wantTurn: 2,
+		},
+		{
+			name: "deleted",
+			change: func(ctx context.Context, c *CachingContextStorage, _ *fakeStorage, _ string) error {
+				return c.DeleteSessionContext(ctx, "s1")
+			},
+			readCtx: expectTurn(2), wantBackend: true, wantNotFound: true,
+		},
+		{
+			name: "deleted on another node",
+			change: func(ctx context.Context, c *CachingContextStorage, backend *fakeStorage, _ string) error {
+				if err := backend.DeleteSessionContext(ctx, "s1"); err != nil {
+					return err
+				}
+				if deleted, err := c.IsSessionDeleted(ctx, "s1"); !deleted || err != nil {
+					return fmt.Errorf("IsSessionDeleted = %v, %v; want true", deleted, err)
+				}
+				return nil
+			},
+			readCtx: expectTurn(2), wantBackend: true, wantNotFound: true,
+		},
+		{name: "consistency token satisfied", readCtx: requireVersion(1), wantTurn: 2},
+		{name: "consistency token newer", readCtx: requireVersion(2), wantBackend: true, wantTurn: 2},
+	}
+	for _, mode := range []string{ModeTokenized, ModeRaw} {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				maxBytes := tt.maxBytes
+				if maxBytes == 0 {
+					maxBytes = 1 << 20
+				}
+				backend := newFakeStorage()
+				cache := NewCachingContextStorage(backend, maxBytes, tt.ttl)
+				if err := writeContext(ctx, cache, mode, "s1", 2); err != nil {
+					t.Fatalf("writeContext: %v", err)
+				}
+				if tt.change != nil {
+					if err := tt.change(ctx, cache, backend, mode); err != nil {
+						t.Fatalf("change: %v", err)
+					}
+				}
+				readsBefore := backend.reads
+				turn, err := readContext(tt.readCtx(ctx), cache, mode, "s1")
+				if tt.wantNotFound {
+					if !cache.IsNotFoundError(err) {
+						t.Errorf("read error = %v, want not found", err)
+					}
+				} else if err != nil || turn != tt.wantTurn {
+					t.Errorf("read = turn %d, %v; want turn %d", turn, err, tt.wantTurn)
+				}
+				if gotBackend := backend.reads > readsBefore; gotBackend != tt.wantBackend {
+					t.Errorf("backend read = %v, want %v", gotBackend, tt.wantBackend)
+				}
+			})
+		}
+	}
+}
+
+func TestCachingContextStorageEviction(t *testing.T) {
+	// Each entry of 10 tokens takes 8*10 bytes plus its overhead, three do not fit.
+	entrySize := 8*10 + len(cacheKey(ModeTokenized, "s1")) + 64
+	tests := []struct {
+		name       string
+		touch      string // Session read after writing s1 and s2, before s3
+		wantCached []string
+	}{
+		{name: "least recently written", wantCached: []string{"s2", "s3"}},
+		{name: "least recently read", touch: "s1", wantCached: []string{"s1", "s3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := NewCachingContextStorage(newFakeStorage(), 2*entrySize+entrySize/2, 0)
+			for _, sessionID := range []string{"s1", "s2"} {
+				if err := writeContext(ctx, cache, ModeTokenized, sessionID, 1); err != nil {
+					t.Fatalf("writeContext(%s): %v", sessionID, err)
+				}
+			}
+			if tt.touch != "" {
+				if _, err := readContext(WithExpectedTurn(ctx, 1), cache, ModeTokenized, tt.touch); err != nil {
+					t.Fatalf("readContext(%s): %v", tt.touch, err)
+				}
+			}
+			if err := writeContext(ctx, cache, ModeTokenized, "s3", 1); err != nil {
+				t.Fatalf("writeContext(s3): %v", err)
+			}
+
+			var cached []string
+			for _, sessionID := range []string{"s1", "s2", "s3"} {
+				if _, ok := cache.entries[cacheKey(ModeTokenized, sessionID)]; ok {
+					cached = append(cached, sessionID)
+				}
+			}
+			if !reflect.DeepEqual(cached, tt.wantCached) {
+				t.Errorf("cached = %v, want %v", cached, tt.wantCached)
+			}
+			if cache.bytes != len(tt.wantCached)*entrySize {
+				t.Errorf("bytes = %d, want %d", cache.bytes, len(tt.wantCached)*entrySize)
+			}
+		})
+	}
+}
+
+func TestCachingContextStorageVersions(t *testing.T) {
+	for _, mode := range []string{ModeTokenized, ModeRaw} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			key := cacheKey(mode, "s1")
+			backend := newFakeStorage()
+			cache := NewCachingContextStorage(backend, 1<<20, 0)
+			if err := writeContext(ctx, backend, mode, "s1", 1); err != nil {
+				t.Fatalf("writeContext: %v", err)
+			}
+
+			// The versions read are recorded in the caller's Versions and passed on to the backend's update.
+			read := &Versions{}
+			if _, err := readContext(WithVersions(ctx, read), cache, mode, "s1"); err != nil {
+				t.Fatalf("readContext: %v", err)
+			}
+			if want := []VersionVector{{"node1": 1}}; !reflect.DeepEqual(read.get(key), want) {
+				t.Errorf("versions read = %v, want %v", read.get(key), want)
+			}
+			if err := writeContext(WithVersions(ctx, read), cache, mode, "s1", 2); err != nil {
+				t.Fatalf("writeContext: %v", err)
+			}
+			if want := []VersionVector{{"node1": 2}}; !reflect.DeepEqual(read.get(key), want) {
+				t.Errorf("versions after the update = %v, want %v", read.get(key), want)
+			}
+
+			// A hit restores the versions of the write.
+			hit := &Versions{}
+			readsBefore := backend.reads
+			if _, err := readContext(WithVersions(WithExpectedTurn(ctx, 2), hit), cache, mode, "s1"); err != nil {
+				t.Fatalf("readContext: %v", err)
+			}
+			if backend.reads != readsBefore {
+				t.Errorf("the read went to the backend")
+			}
+			if want := []VersionVector{{"node1": 2}}; !reflect.DeepEqual(hit.get(key), want) {
+				t.Errorf("versions of the hit = %v, want %v", hit.get(key), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package context_storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	fredClient "llm-context-management/internal/pkg/fredclient"
+)
+
+// ErrStaleReplica is returned when the local replica has not received a version required by a ConsistencyToken yet.
+// Like a context of an earlier turn, the read should be repeated.
+var ErrStaleReplica = errors.New("the replica has not caught up with the client's session yet")
+
+// ConsistencyToken gives a client read-your-writes across nodes. It holds the versions FReD acknowledged for the
+// contexts written by a turn. A node reading the session with the token only accepts contexts at least as new, so the
+// read includes the client's last write, wherever it happened.
+type ConsistencyToken struct {
+	SessionID string                     `json:"s"`
+	Turn      int                        `json:"t"`           // Turn the token was issued for
+	Versions  map[string][]VersionVector `json:"v,omitempty"` // Required versions per key
+}
+
+// NewConsistencyToken returns the token of the session's turn, requiring the versions recorded in versions. Pass the
+// Versions of the turn's update once it succeeded; the storage replaced the versions read with the written ones.
+func NewConsistencyToken(sessionID string, turn int, versions *Versions) ConsistencyToken {
+	return ConsistencyToken{SessionID: sessionID, Turn: turn, Versions: versions.snapshot()}
+}
+
+// Encode returns the token as an opaque, URL safe string.
+func (t ConsistencyToken) Encode() string {
+	data, _ := json.Marshal(t) // Maps of strings and integers always marshal
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseConsistencyToken decodes a token returned by Encode.
+func ParseConsistencyToken(token string) (ConsistencyToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ConsistencyToken{}, fmt.Errorf("invalid consistency token: %w", err)
+	}
+	var parsed ConsistencyToken
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return ConsistencyToken{}, fmt.Errorf("invalid consistency token: %w", err)
+	}
+	if parsed.SessionID == "" {
+		return ConsistencyToken{}, errors.New("invalid consistency token: no session")
+	}
+	return parsed, nil
+}
+
+type consistencyTokenKey struct{}
+
+// WithConsistencyToken returns a context that makes the storage's reads require the versions of token. Reads of a
+// replica that has not received them fail with ErrStaleReplica.
+func WithConsistencyToken(ctx context.Context, token ConsistencyToken) context.Context {
+	return context.WithValue(ctx, consistencyTokenKey{}, token)
+}
+
+// requiredVersions returns the versions of key required by the ConsistencyToken of ctx, if any.
+func requiredVersions(ctx context.Context, key string) []VersionVector {
+	token, _ := ctx.Value(consistencyTokenKey{}).(ConsistencyToken)
+	return token.Versions[key]
+}
+
+// dominates reports whether v includes all updates of other.
+func (v VersionVector) dominates(other VersionVector) bool {
+	for node, counter := range other {
+		if v[node] < counter {
+			return false
+		}
+	}
+	return true
+}
+
+// checkReplica verifies that the items read from key include the versions required by ctx. FReD receives them with
+// the read too, this also covers replicas that return older values regardless.
+func checkReplica(ctx context.Context, key string, items []*fredClient.Item) error {
+	for _, required := range requiredVersions(ctx, key) {
+		found := false
+		for _, item := range items {
+			if fromFredVersion(item.GetVersion()).dominates(required) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %s has no version including %s", ErrStaleReplica, key, required)
+		}
+	}
+	return nil
+}
@@ -1,21 +1,59 @@
 package context_storage
 
+import "context"
+
 // RawMessage defines the structure for a single message in raw context.
 type RawMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 
+// SessionMetadata holds session attributes that are stored, and replicated, together with the context.
+// It is embedded in the stored payloads, so its fields appear next to the context and turn.
+type SessionMetadata struct {
+	Owner string `json:"owner,omitempty"` // UserID owning the session, lets any node verify ownership
+
+	// The request_id and assistant reply of the turn that produced this context, if the client sent a request_id.
+	// A client retrying that turn (e.g. after a dropped connection) gets the reply again instead of a turn mismatch.
+	LastRequestID string `json:"last_request_id,omitempty"`
+	LastReply     string `json:"last_reply,omitempty"`
+
+	// Fingerprint identifies the tokenizer of a tokenized context, see tokenizer.Fingerprint.
+	// Token IDs are only meaningful to models with the same fingerprint. It is empty for raw contexts.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// SystemMessages is the number of leading messages of a tokenized context that are the system prompt, see
+	// chat_template.Template.RenderContext. Templates without a system role render it as a user message.
+	SystemMessages int `json:"system_messages,omitempty"`
+}
+
 // ContextStorage defines the interface for session context persistence.
+// All operations honor the cancellation and deadline of ctx.
 type ContextStorage interface {
-	GetTokenizedSessionContext(sessionID string) ([]int, int, error)
-	UpdateSessionContext(sessionID string, newFullTokenizedContext []int, newTurn int) error
+	// GetTokenizedSessionContext returns the tokens and turn, and the metadata stored with them.
+	GetTokenizedSessionContext(ctx context.Context, sessionID string) ([]int, int, SessionMetadata, error)
+	UpdateSessionContext(ctx context.Context, sessionID string, newFullTokenizedContext []int, newTurn int, meta SessionMetadata) error
+
+	// GetRawSessionContext returns the messages and turn, and the metadata stored with them.
+	GetRawSessionContext(ctx context.Context, sessionID string) ([]RawMessage, int, SessionMetadata, error)
+	UpdateRawSessionContext(ctx context.Context, sessionID string, newMessages []RawMessage, newTurn int, meta SessionMetadata) error
 
-	GetRawSessionContext(sessionID string) ([]RawMessage, int, error)
-	UpdateRawSessionContext(sessionID string, newMessages []RawMessage, newTurn int) error
+	// GetSessionMetadata returns the metadata stored with the session's context, regardless of its mode.
+	GetSessionMetadata(ctx context.Context, sessionID string) (SessionMetadata, error)
 
-	DeleteSessionContext(sessionID string) error
+	// DeleteSessionContext deletes the session's contexts of all modes and model namespaces. It leaves a tombstone,
+	// so that nodes still knowing the session learn that it was deleted, see IsSessionDeleted.
+	DeleteSessionContext(ctx context.Context, sessionID string) error
+	// IsSessionDeleted reports whether the session was deleted, on this or, once replicated, on another node.
+	IsSessionDeleted(ctx context.Context, sessionID string) (bool, error)
 	// IsNotFoundError checks if an error signifies that a context was not found (e.g., cache miss).
 	// This helps differentiate between "not found" and other errors.
 	IsNotFoundError(err error) bool
 }
+
+// ConflictResolver is implemented by storages that detect concurrent updates of a context, see ConflictError.
+type ConflictResolver interface {
+	// ResolveConflict replaces the concurrent versions of the session's context in mode by one of them and returns it.
+	// The choice is deterministic, so nodes resolving the same conflict keep the same version.
+	ResolveConflict(ctx context.Context, sessionID string, mode string) (ConflictBranch, error)
+}
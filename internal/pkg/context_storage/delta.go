@@ -0,0 +1,230 @@
+package context_storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrIncompleteContext is returned when chunks listed by a manifest are missing, usually because they have not
+// replicated to this node yet. Like a context of an earlier turn, the read should be repeated.
+var ErrIncompleteContext = errors.New("context chunks are missing")
+
+// deltaManifest is stored at a context's key instead of the context when it is stored as deltas. Each write
+// appends the new tokens or messages as a chunk under its own key, so only they are replicated.
+type deltaManifest struct {
+	Chunks []int  `json:"chunks"` // IDs of the chunk keys, in order; random, so that concurrent writers don't collide
+	Length int    `json:"length"` // Number of tokens or messages in all chunks
+	Hash   string `json:"hash"`   // Hash of all tokens or messages, to detect if a write changed earlier turns
+	Turn   int    `json:"turn"`
+	SessionMetadata
+}
+
+// decodeManifest decodes data if it is a manifest, ok is false for a context stored as a whole.
+func decodeManifest(data []byte, mode string) (manifest deltaManifest, ok bool, err error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return deltaManifest{}, false, err
+	}
+	if envelope.Version != payloadVersionManifest {
+		return deltaManifest{}, false, nil
+	}
+	if err := decodeEnvelope(data, mode, &manifest); err != nil {
+		return deltaManifest{}, false, err
+	}
+	return manifest, true, nil
+}
+
+// deltaKind stores the elements of a context, tokens or messages, in chunks.
+type deltaKind[T any] struct {
+	mode   string
+	hash   func([]T) string
+	encode func([]T) ([]byte, int, error) // A chunk and the size of its elements
+	decode func([]byte) ([]T, error)
+}
+
+// tokenDelta stores tokens in chunks encoded with codec, see TokenData.
+func tokenDelta(codec TokenCodec) deltaKind[int] {
+	return deltaKind[int]{
+		mode: ModeTokenized,
+		hash: func(tokens []int) string {
+			hash := sha256.New()
+			buf := make([]byte, 0, 4*len(tokens))
+			for _, token := range tokens {
+				buf = binary.LittleEndian.AppendUint32(buf, uint32(token))
+			}
+			hash.Write(buf)
+			return hex.EncodeToString(hash.Sum(nil))
+		},
+		encode: func(tokens []int) ([]byte, int, error) {
+			tokenData, version, size, err := newTokenData(codec, tokens)
+			if err != nil {
+				return nil, 0, err
+			}
+			data, err := encodeEnvelope(version, ModeTokenized, tokenData)
+			return data, size, err
+		},
+		decode: func(data []byte) ([]int, error) {
+			var tokenData TokenData
+			if err := decodeEnvelope(data, ModeTokenized, &tokenData); err != nil {
+				return nil, err
+			}
+			return tokenData.tokens()
+		},
+	}
+}
+
+// messageChunk is the payload of a chunk of a raw context.
+type messageChunk struct {
+	Messages []RawMessage `json:"messages"`
+}
+
+// messageDelta stores messages in chunks.
+var messageDelta = deltaKind[RawMessage]{
+	mode: ModeRaw,
+	hash: func(messages []RawMessage) string {
+		hash := sha256.New()
+		for _, message := range messages {
+			fmt.Fprintf(hash, "%d:%s%d:%s", len(message.Role), message.Role, len(message.Content), message.Content)
+		}
+		return hex.EncodeToString(hash.Sum(nil))
+	},
+	encode: func(messages []RawMessage) ([]byte, int, error) {
+		data, err := encodeEnvelope(payloadVersionJSON, ModeRaw, messageChunk{Messages: messages})
+		return data, len(data), err
+	},
+	decode: func(data []byte) ([]RawMessage, error) {
+		var chunk messageChunk
+		err := decodeEnvelope(data, ModeRaw, &chunk)
+		return chunk.Messages, err
+	},
+}
+
+// writeDelta stores elements as the context of the session in kind's mode. If the stored context is a prefix of
+// elements, only the new elements are written as a chunk. Otherwise, e.g. after a compaction changed earlier turns,
+// or once the context has f.DeltaChunks chunks, the whole context is merged into a single new chunk.
+// The chunk is written before the manifest; the replaced chunks of a merge are deleted after it, the chunk if the
+// manifest could not be written.
+func writeDelta[T any](ctx context.Context, f *FReDContextStorage, kind deltaKind[T], sessionID string, elements []T, turn int, meta SessionMetadata) (PayloadStats, error) {
+	key := f.Keys.Key(kind.mode, sessionID)
+	var manifest deltaManifest
+	current, err := f.readKey(ctx, key)
+	if err != nil && err != ErrFredNotFound {
+		return PayloadStats{}, fmt.Errorf("failed to read the manifest from FReD: %w", err)
+	}
+	if err == nil {
+		stored, ok, errManifest := decodeManifest([]byte(current), kind.mode)
+		if errManifest != nil {
+			log.Warnf("FReD: Replacing the unreadable %s context of session %s: %v", kind.mode, sessionID, errManifest)
+		} else if ok {
+			manifest = stored
+		}
+	}
+
+	appending := len(manifest.Chunks) > 0 && len(manifest.Chunks) < f.DeltaChunks &&
+		manifest.Length <= len(elements) && kind.hash(elements[:manifest.Length]) == manifest.Hash
+	chunk := elements
+	if appending {
+		chunk = elements[manifest.Length:]
+	}
+	chunkData, elementBytes, err := kind.encode(chunk)
+	if err != nil {
+		return PayloadStats{}, fmt.Errorf("failed to encode chunk: %w", err)
+	}
+	chunkID := newChunkID(manifest.Chunks)
+	if err := f.writeKey(ctx, f.Keys.ChunkKey(kind.mode, sessionID, chunkID), chunkData); err != nil {
+		return PayloadStats{}, err
+	}
+
+	next := deltaManifest{
+		Chunks:          []int{chunkID},
+		Length:          len(elements),
+		Hash:            kind.hash(elements),
+		Turn:            turn,
+		SessionMetadata: meta,
+	}
+	if appending {
+		next.Chunks = append(manifest.Chunks, chunkID)
+	}
+	manifestData, err := encodeEnvelope(payloadVersionManifest, kind.mode, next)
+	if err != nil {
+		return PayloadStats{}, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if err := f.writeKey(ctx, key, manifestData); err != nil {
+		// The chunk is not listed by any manifest, e.g. since the context changed concurrently
+		if errDelete := f.deleteKey(ctx, f.Keys.ChunkKey(kind.mode, sessionID, chunkID)); errDelete != nil {
+			log.Warnf("FReD: Failed to delete unused chunk %d of session %s: %v", chunkID, sessionID, errDelete)
+		}
+		return PayloadStats{}, err
+	}
+
+	if !appending {
+		if len(manifest.Chunks) > 0 {
+			log.Infof("FReD: Merged %d chunks of the %s context of session %s into chunk %d", len(manifest.Chunks), kind.mode, sessionID, chunkID)
+		}
+		for _, id := range manifest.Chunks {
+			if err := f.deleteKey(ctx, f.Keys.ChunkKey(kind.mode, sessionID, id)); err != nil {
+				log.Warnf("FReD: Failed to delete merged chunk %d of session %s: %v", id, sessionID, err)
+			}
+		}
+	}
+	return PayloadStats{TokenBytes: elementBytes, PayloadBytes: len(chunkData) + len(manifestData), Chunks: len(next.Chunks)}, nil
+}
+
+// newChunkID returns a random chunk ID that is not in use.
+func newChunkID(used []int) int {
+	for {
+		id := rand.IntN(math.MaxInt32)
+		if !slices.Contains(used, id) {
+			return id
+		}
+	}
+}
+
+// readDelta reads the chunks of manifest in parallel and puts the context back together.
+func readDelta[T any](ctx context.Context, f *FReDContextStorage, kind deltaKind[T], sessionID string, manifest deltaManifest) ([]T, error) {
+	startTime := time.Now()
+	parts := make([][]T, len(manifest.Chunks))
+	errs := make([]error, len(manifest.Chunks))
+	var wg sync.WaitGroup
+	for i, id := range manifest.Chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := f.readKey(ctx, f.Keys.ChunkKey(kind.mode, sessionID, id))
+			if err == ErrFredNotFound {
+				errs[i] = fmt.Errorf("%w: chunk %d of session %s", ErrIncompleteContext, id, sessionID)
+				return
+			} else if err != nil {
+				errs[i] = fmt.Errorf("failed to read chunk %d from FReD: %w", id, err)
+				return
+			}
+			parts[i], errs[i] = kind.decode([]byte(data))
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	elements := slices.Concat(parts...)
+	if len(elements) != manifest.Length {
+		return nil, fmt.Errorf("%w: %d of %d elements in the chunks of session %s", ErrIncompleteContext, len(elements), manifest.Length, sessionID)
+	}
+	if elements == nil {
+		elements = []T{}
+	}
+	log.Debugf("FReD: Read %d chunks of the %s context of session %s in %s", len(manifest.Chunks), kind.mode, sessionID, time.Since(startTime))
+	return elements, nil
+}
@@ -3,7 +3,7 @@ package context_storage
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings" // Added for strings.Contains
@@ -23,6 +23,9 @@ const (
 	userID              = "context-manager"
 	expiry              = 0    // 0 = no expiry time for FReD keygroup upon creation
 	mutable             = true // Keygroups are mutable by default
+
+	// defaultFredRequestTimeout bounds a single read/update/delete, in addition to the caller's context.
+	defaultFredRequestTimeout = 10 * time.Second
 )
 
 // ErrFredNotFound is returned when a key is not found in FReD.
@@ -30,20 +33,26 @@ var ErrFredNotFound = fmt.Errorf("key not found in FReD")
 
 // FredContextData is the structure stored as JSON in FReD for tokenized context.
 type FredContextData struct {
-	Context []int `json:"context"`
-	Turn    int   `json:"turn"`
+	TokenData
+	Turn int `json:"turn"`
+	SessionMetadata
 }
 
 // RawFredContextData is the structure stored as JSON in FReD for raw context.
 type RawFredContextData struct {
 	Messages []RawMessage `json:"messages"`
 	Turn     int          `json:"turn"`
+	SessionMetadata
 }
 
 // FReDContextStorage implements the ContextStorage interface using FReD.
 type FReDContextStorage struct {
-	client   fredClient.ClientClient
-	keygroup string
+	client         fredClient.ClientClient
+	keygroup       string
+	RequestTimeout time.Duration // Deadline of a single FReD call, 0 disables it
+	Keys           KeySchema     // Key layout, its Namespace separates the tokenized contexts of models
+	TokenCodec     TokenCodec    // Encoding of written tokens, nil for a JSON array; reads detect the codec
+	DeltaChunks    int           // If > 0, each write only stores the new turn as a chunk, merging them at this many; reads detect chunks
 }
 
 // NewFReDContextStorage creates a new FReDContextStorage.
@@ -86,8 +95,9 @@ func NewFReDContextStorage(addr string, keygroup string, createKeygroupIfNotExis
 	}
 
 	fs := &FReDContextStorage{
-		client:   grpcClient,
-		keygroup: storageKeygroup,
+		client:         grpcClient,
+		keygroup:       storageKeygroup,
+		RequestTimeout: defaultFredRequestTimeout,
 	}
 
 	if createKeygroupIfNotExist {
@@ -280,128 +290,172 @@ func (f *FReDContextStorage) initializeKeygroup(grpcClient fredClient.ClientClie
 	return nil
 }
 
-// GetTokenizedSessionContext retrieves the tokenized session context and turn from FReD.
-func (f *FReDContextStorage) GetTokenizedSessionContext(sessionID string) ([]int, int, error) {
+// GetTokenizedSessionContext retrieves the tokenized session context, turn and metadata from FReD.
+func (f *FReDContextStorage) GetTokenizedSessionContext(ctx context.Context, sessionID string) ([]int, int, SessionMetadata, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("FReD: GetTokenizedSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	log.Infof("FReD: Attempting to retrieve tokenized context for session ID: %s from keygroup: %s", sessionID, f.keygroup)
+	key := f.Keys.Key(ModeTokenized, sessionID)
+	log.Infof("FReD: Attempting to retrieve tokenized context for session ID: %s from keygroup: %s, key: %s", sessionID, f.keygroup, key)
 
 	readReq := &fredClient.ReadRequest{
 		Keygroup: f.keygroup,
-		Id:       sessionID,
+		Id:       key,
+		Versions: toFredVersions(requiredVersions(ctx, key)),
 	}
 
 	fredReadStartTime := time.Now()
-	// For a client-side timeout, use context.WithTimeout here.
-	// Example: ctx, cancel := context.WithTimeout(context.Background(), time.Duration(defaultFredReadTimeout)*time.Millisecond)
-	// defer cancel()
-	// readResp, err := f.client.Read(ctx, readReq)
-	readResp, err := f.client.Read(context.Background(), readReq)
-	log.Debugf("FReD: Read for key %s in keygroup %s took %s", sessionID, f.keygroup, time.Since(fredReadStartTime))
+	rpcCtx, cancel := f.withRequestTimeout(ctx)
+	defer cancel()
+	readResp, err := f.client.Read(rpcCtx, readReq)
+	log.Debugf("FReD: Read for key %s in keygroup %s took %s", key, f.keygroup, time.Since(fredReadStartTime))
 
 	if err != nil {
 		s, ok := status.FromError(err)
+		if len(readReq.Versions) > 0 && ok && s.Code() == codes.NotFound {
+			log.Warnf("FReD: Replica has not caught up with session ID %s yet: %v", sessionID, err)
+			return nil, 0, SessionMetadata{}, fmt.Errorf("%w: %v", ErrStaleReplica, err)
+		}
 		if ok && s.Code() == codes.NotFound {
 			log.Warnf("FReD: Cache miss (NotFound) for session ID: %s in keygroup: %s.", sessionID, f.keygroup)
-			return nil, 0, ErrFredNotFound
+			return nil, 0, SessionMetadata{}, ErrFredNotFound
 		}
-		log.Errorf("FReD: Failed to read from keygroup '%s', id '%s': %v", f.keygroup, sessionID, err)
-		return nil, 0, fmt.Errorf("failed to read from FReD: %w", err)
+		log.Errorf("FReD: Failed to read from keygroup '%s', id '%s': %v", f.keygroup, key, err)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to read from FReD: %w", err)
 	}
 
 	if readResp == nil || len(readResp.Data) == 0 {
 		log.Warnf("FReD: Cache miss for session ID: '%s' in keygroup: '%s'. No data items returned.", sessionID, f.keygroup)
-		return nil, 0, ErrFredNotFound // Or []int{}, nil if empty is not an error but a valid "not found" state for tokens
+		return nil, 0, SessionMetadata{}, ErrFredNotFound // Or []int{}, nil if empty is not an error but a valid "not found" state for tokens
 	}
 
-	if len(readResp.Data) > 1 {
-		log.Warnf("FReD: Expected 1 item for session ID '%s', but got %d. Using the first one.", sessionID, len(readResp.Data))
+	if errStale := checkReplica(ctx, key, readResp.Data); errStale != nil {
+		log.Warnf("FReD: Stale read for session ID %s: %v", sessionID, errStale)
+		return nil, 0, SessionMetadata{}, errStale
+	}
+	if errConflict := recordItems(ctx, key, readResp.Data); errConflict != nil {
+		log.Warnf("FReD: Conflict for session ID %s: %v", sessionID, errConflict)
+		return nil, 0, SessionMetadata{}, errConflict
 	}
 
 	jsonData := readResp.Data[0].Val
 	if jsonData == "" {
 		log.Warnf("FReD: Cache hit for session ID: %s, but data is empty. Returning empty context and turn 0.", sessionID)
-		return []int{}, 0, nil
+		return []int{}, 0, SessionMetadata{}, nil
 	}
 
 	log.Infof("FReD: Cache hit for session ID: %s in keygroup: %s", sessionID, f.keygroup)
+	if manifest, ok, errManifest := decodeManifest([]byte(jsonData), ModeTokenized); errManifest == nil && ok {
+		tokens, errChunks := readDelta(ctx, f, tokenDelta(f.TokenCodec), sessionID, manifest)
+		if errChunks != nil {
+			log.Warnf("FReD: Failed to read the chunks of session ID %s: %v", sessionID, errChunks)
+			return nil, 0, SessionMetadata{}, errChunks
+		}
+		return tokens, manifest.Turn, manifest.SessionMetadata, nil
+	}
 	unmarshalStartTime := time.Now()
 	var data FredContextData
-	errUnmarshal := json.Unmarshal([]byte(jsonData), &data)
+	errUnmarshal := decodeEnvelope([]byte(jsonData), ModeTokenized, &data)
 	log.Debugf("FReD: JSON unmarshal for session %s took %s", sessionID, time.Since(unmarshalStartTime))
 	if errUnmarshal != nil {
 		log.Errorf("FReD: Failed to unmarshal cached data for session ID %s: %v. Data: %s", sessionID, errUnmarshal, jsonData)
-		return nil, 0, fmt.Errorf("failed to unmarshal cached data from FReD: %w", errUnmarshal)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to unmarshal cached data from FReD: %w", errUnmarshal)
 	}
-	return data.Context, data.Turn, nil
+	tokens, errDecode := data.tokens()
+	if errDecode != nil {
+		log.Errorf("FReD: Failed to decode cached tokens for session ID %s: %v", sessionID, errDecode)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to decode cached tokens from FReD: %w", errDecode)
+	}
+	return tokens, data.Turn, data.SessionMetadata, nil
 }
 
-// GetRawSessionContext retrieves the raw session context (message history) and turn from FReD.
-func (f *FReDContextStorage) GetRawSessionContext(sessionID string) ([]RawMessage, int, error) {
+// GetRawSessionContext retrieves the raw session context (message history), turn and metadata from FReD.
+func (f *FReDContextStorage) GetRawSessionContext(ctx context.Context, sessionID string) ([]RawMessage, int, SessionMetadata, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("FReD: GetRawSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	log.Infof("FReD: Attempting to retrieve raw context for session ID: %s from keygroup: %s", sessionID, f.keygroup)
+	key := f.Keys.Key(ModeRaw, sessionID)
+	log.Infof("FReD: Attempting to retrieve raw context for session ID: %s from keygroup: %s, key: %s", sessionID, f.keygroup, key)
 
 	readReq := &fredClient.ReadRequest{
 		Keygroup: f.keygroup,
-		Id:       sessionID,
+		Id:       key,
+		Versions: toFredVersions(requiredVersions(ctx, key)),
 	}
 
 	fredReadStartTime := time.Now()
-	readResp, err := f.client.Read(context.Background(), readReq)
-	log.Debugf("FReD: Read for key %s in keygroup %s took %s", sessionID, f.keygroup, time.Since(fredReadStartTime))
+	rpcCtx, cancel := f.withRequestTimeout(ctx)
+	defer cancel()
+	readResp, err := f.client.Read(rpcCtx, readReq)
+	log.Debugf("FReD: Read for key %s in keygroup %s took %s", key, f.keygroup, time.Since(fredReadStartTime))
 
 	if err != nil {
 		s, ok := status.FromError(err)
+		if len(readReq.Versions) > 0 && ok && s.Code() == codes.NotFound {
+			log.Warnf("FReD: Replica has not caught up with raw session ID %s yet: %v", sessionID, err)
+			return nil, 0, SessionMetadata{}, fmt.Errorf("%w: %v", ErrStaleReplica, err)
+		}
 		if ok && s.Code() == codes.NotFound {
 			log.Warnf("FReD: Cache miss (NotFound) for raw session ID: %s in keygroup: %s.", sessionID, f.keygroup)
-			return nil, 0, ErrFredNotFound
+			return nil, 0, SessionMetadata{}, ErrFredNotFound
 		}
-		log.Errorf("FReD: Failed to read from keygroup '%s', id '%s': %v", f.keygroup, sessionID, err)
-		return nil, 0, fmt.Errorf("failed to read from FReD: %w", err)
+		log.Errorf("FReD: Failed to read from keygroup '%s', id '%s': %v", f.keygroup, key, err)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to read from FReD: %w", err)
 	}
 
 	if readResp == nil || len(readResp.Data) == 0 {
 		log.Warnf("FReD: Cache miss for raw session ID: '%s' in keygroup: '%s'. No data items returned.", sessionID, f.keygroup)
-		return nil, 0, ErrFredNotFound
+		return nil, 0, SessionMetadata{}, ErrFredNotFound
 	}
 
-	if len(readResp.Data) > 1 {
-		log.Warnf("FReD: Expected 1 item for session ID '%s', but got %d. Using the first one.", sessionID, len(readResp.Data))
+	if errStale := checkReplica(ctx, key, readResp.Data); errStale != nil {
+		log.Warnf("FReD: Stale read for raw session ID %s: %v", sessionID, errStale)
+		return nil, 0, SessionMetadata{}, errStale
+	}
+	if errConflict := recordItems(ctx, key, readResp.Data); errConflict != nil {
+		log.Warnf("FReD: Conflict for raw session ID %s: %v", sessionID, errConflict)
+		return nil, 0, SessionMetadata{}, errConflict
 	}
 
 	jsonData := readResp.Data[0].Val
 	if jsonData == "" {
 		log.Warnf("FReD: Cache hit for raw session ID: %s, but data is empty. Returning empty context and turn 0.", sessionID)
-		return []RawMessage{}, 0, nil
+		return []RawMessage{}, 0, SessionMetadata{}, nil
 	}
 
 	log.Infof("FReD: Cache hit for raw session ID: %s in keygroup: %s", sessionID, f.keygroup)
+	if manifest, ok, errManifest := decodeManifest([]byte(jsonData), ModeRaw); errManifest == nil && ok {
+		messages, errChunks := readDelta(ctx, f, messageDelta, sessionID, manifest)
+		if errChunks != nil {
+			log.Warnf("FReD: Failed to read the chunks of raw session ID %s: %v", sessionID, errChunks)
+			return nil, 0, SessionMetadata{}, errChunks
+		}
+		return messages, manifest.Turn, manifest.SessionMetadata, nil
+	}
 	unmarshalStartTime := time.Now()
 	var data RawFredContextData
-	errUnmarshal := json.Unmarshal([]byte(jsonData), &data)
+	errUnmarshal := decodeEnvelope([]byte(jsonData), ModeRaw, &data)
 	log.Debugf("FReD: JSON unmarshal for raw session %s took %s", sessionID, time.Since(unmarshalStartTime))
 	if errUnmarshal != nil {
 		log.Errorf("FReD: Failed to unmarshal cached raw data for session ID %s: %v. Data: %s", sessionID, errUnmarshal, jsonData)
-		return nil, 0, fmt.Errorf("failed to unmarshal cached raw data from FReD: %w", errUnmarshal)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to unmarshal cached raw data from FReD: %w", errUnmarshal)
 	}
-	return data.Messages, data.Turn, nil
+	return data.Messages, data.Turn, data.SessionMetadata, nil
 }
 
 // UpdateSessionContext stores the provided tokenized context and new turn in FReD.
-func (f *FReDContextStorage) UpdateSessionContext(sessionID string, newFullTokenizedContext []int, newTurn int) error {
+func (f *FReDContextStorage) UpdateSessionContext(ctx context.Context, sessionID string, newFullTokenizedContext []int, newTurn int, meta SessionMetadata) error {
 	startTime := time.Now()
 	defer func() {
 		log.Infof("FReD: UpdateSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	log.Infof("FReD: Updating tokenized context cache for session ID: %s in keygroup: %s to turn %d", sessionID, f.keygroup, newTurn)
+	key := f.Keys.Key(ModeTokenized, sessionID)
+	log.Infof("FReD: Updating tokenized context cache for session ID: %s in keygroup: %s, key: %s to turn %d", sessionID, f.keygroup, key, newTurn)
 
 	if newFullTokenizedContext == nil {
 		// This case might occur if we intend to clear the cache with an empty list.
@@ -411,34 +465,45 @@ func (f *FReDContextStorage) UpdateSessionContext(sessionID string, newFullToken
 		newFullTokenizedContext = []int{}
 	}
 
-	data := FredContextData{
-		Context: newFullTokenizedContext,
-		Turn:    newTurn,
+	if f.DeltaChunks > 0 {
+		stats, err := writeDelta(ctx, f, tokenDelta(f.TokenCodec), sessionID, newFullTokenizedContext, newTurn, meta)
+		if err != nil {
+			log.Errorf("FReD: Failed to store the tokenized context of session ID %s as a delta: %v", sessionID, err)
+			return err
+		}
+		if f.TokenCodec != nil {
+			stats.Codec = f.TokenCodec.Name()
+		}
+		stats.JSONTokenBytes = jsonTokensSize(newFullTokenizedContext)
+		reportPayload(ctx, stats)
+		log.Infof("FReD: Tokenized context cache successfully updated for session ID: %s (%d chunks)", sessionID, stats.Chunks)
+		return nil
 	}
 
 	marshalStartTime := time.Now()
-	tokenBytes, err := json.Marshal(data)
+	tokenData, version, tokenSize, err := newTokenData(f.TokenCodec, newFullTokenizedContext)
+	if err != nil {
+		log.Errorf("FReD: Failed to encode tokens for session ID %s: %v", sessionID, err)
+		return err
+	}
+	data := FredContextData{
+		TokenData:       tokenData,
+		Turn:            newTurn,
+		SessionMetadata: meta,
+	}
+	tokenBytes, err := encodeEnvelope(version, ModeTokenized, data)
 	log.Debugf("FReD: JSON marshal for new context data (session %s) took %s", sessionID, time.Since(marshalStartTime))
 	if err != nil {
 		log.Errorf("FReD: Failed to marshal data for FReD caching for session ID %s: %v", sessionID, err)
 		return fmt.Errorf("failed to marshal data for FReD: %w", err)
 	}
+	reportPayload(ctx, PayloadStats{Codec: tokenData.Codec, TokenBytes: tokenSize, JSONTokenBytes: jsonTokensSize(newFullTokenizedContext), PayloadBytes: len(tokenBytes)})
 
 	dataToStore := string(tokenBytes)
 	log.Debugf("FReD: Storing data for session %s: %s", sessionID, dataToStore)
 
-	updateReq := &fredClient.UpdateRequest{
-		Keygroup: f.keygroup,
-		Id:       sessionID,
-		Data:     dataToStore,
-	}
-
-	fredUpdateOpStartTime := time.Now()
-	_, err = f.client.Update(context.Background(), updateReq)
-	log.Debugf("FReD: Update operation for key %s in keygroup %s took %s", sessionID, f.keygroup, time.Since(fredUpdateOpStartTime))
-	if err != nil {
-		log.Errorf("FReD: Failed to update key %s in keygroup %s: %v", sessionID, f.keygroup, err)
-		return fmt.Errorf("failed to update FReD: %w", err)
+	if err := f.writeKey(ctx, key, []byte(dataToStore)); err != nil {
+		return err
 	}
 
 	log.Infof("FReD: Tokenized context cache successfully updated for session ID: %s", sessionID)
@@ -446,86 +511,248 @@ func (f *FReDContextStorage) UpdateSessionContext(sessionID string, newFullToken
 }
 
 // UpdateRawSessionContext stores the provided raw message history and new turn in FReD.
-func (f *FReDContextStorage) UpdateRawSessionContext(sessionID string, newMessages []RawMessage, newTurn int) error {
+func (f *FReDContextStorage) UpdateRawSessionContext(ctx context.Context, sessionID string, newMessages []RawMessage, newTurn int, meta SessionMetadata) error {
 	startTime := time.Now()
 	defer func() {
 		log.Infof("FReD: UpdateRawSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	log.Infof("FReD: Updating raw context cache for session ID: %s in keygroup: %s to turn %d", sessionID, f.keygroup, newTurn)
+	key := f.Keys.Key(ModeRaw, sessionID)
+	log.Infof("FReD: Updating raw context cache for session ID: %s in keygroup: %s, key: %s to turn %d", sessionID, f.keygroup, key, newTurn)
 
 	if newMessages == nil {
 		log.Warnf("FReD: newMessages is nil for session ID %s. Caching empty message list.", sessionID)
 		newMessages = []RawMessage{}
 	}
 
+	if f.DeltaChunks > 0 {
+		stats, err := writeDelta(ctx, f, messageDelta, sessionID, newMessages, newTurn, meta)
+		if err != nil {
+			log.Errorf("FReD: Failed to store the raw context of session ID %s as a delta: %v", sessionID, err)
+			return err
+		}
+		reportPayload(ctx, PayloadStats{PayloadBytes: stats.PayloadBytes, Chunks: stats.Chunks})
+		log.Infof("FReD: Raw context cache successfully updated for session ID: %s (%d chunks)", sessionID, stats.Chunks)
+		return nil
+	}
+
 	data := RawFredContextData{
-		Messages: newMessages,
-		Turn:     newTurn,
+		Messages:        newMessages,
+		Turn:            newTurn,
+		SessionMetadata: meta,
 	}
 
 	marshalStartTime := time.Now()
-	rawBytes, err := json.Marshal(data)
+	rawBytes, err := encodeEnvelope(payloadVersionJSON, ModeRaw, data)
 	log.Debugf("FReD: JSON marshal for new raw context data (session %s) took %s", sessionID, time.Since(marshalStartTime))
 	if err != nil {
 		log.Errorf("FReD: Failed to marshal raw data for FReD caching for session ID %s: %v", sessionID, err)
 		return fmt.Errorf("failed to marshal raw data for FReD: %w", err)
 	}
+	reportPayload(ctx, PayloadStats{PayloadBytes: len(rawBytes)})
 
 	dataToStore := string(rawBytes)
 	log.Debugf("FReD: Storing raw data for session %s: %s", sessionID, dataToStore)
 
-	updateReq := &fredClient.UpdateRequest{
-		Keygroup: f.keygroup,
-		Id:       sessionID,
-		Data:     dataToStore,
-	}
-
-	fredUpdateOpStartTime := time.Now()
-	_, err = f.client.Update(context.Background(), updateReq)
-	log.Debugf("FReD: Update operation for key %s in keygroup %s took %s", sessionID, f.keygroup, time.Since(fredUpdateOpStartTime))
-	if err != nil {
-		log.Errorf("FReD: Failed to update key %s in keygroup %s: %v", sessionID, f.keygroup, err)
-		return fmt.Errorf("failed to update FReD: %w", err)
+	if err := f.writeKey(ctx, key, []byte(dataToStore)); err != nil {
+		return err
 	}
 
 	log.Infof("FReD: Raw context cache successfully updated for session ID: %s", sessionID)
 	return nil
 }
 
-// DeleteSessionContext removes the session context from FReD.
-func (f *FReDContextStorage) DeleteSessionContext(sessionID string) error {
+// GetSessionMetadata retrieves the metadata stored next to the session's context in FReD.
+// Raw and tokenized contexts are stored under separate keys; if a session switched modes and both exist, the
+// metadata of the newer turn is returned.
+func (f *FReDContextStorage) GetSessionMetadata(ctx context.Context, sessionID string) (SessionMetadata, error) {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("FReD: GetSessionMetadata for session %s took %s", sessionID, time.Since(startTime))
+	}()
+
+	found := false
+	var newest metadataPayload
+	for _, mode := range []string{ModeTokenized, ModeRaw} {
+		key := f.Keys.Key(mode, sessionID)
+		readReq := &fredClient.ReadRequest{
+			Keygroup: f.keygroup,
+			Id:       key,
+		}
+		rpcCtx, cancel := f.withRequestTimeout(ctx)
+		readResp, err := f.client.Read(rpcCtx, readReq)
+		cancel()
+		if err != nil {
+			s, ok := status.FromError(err)
+			if ok && s.Code() == codes.NotFound {
+				continue
+			}
+			log.Errorf("FReD: Failed to read from keygroup '%s', id '%s': %v", f.keygroup, key, err)
+			return SessionMetadata{}, fmt.Errorf("failed to read from FReD: %w", err)
+		}
+		// Concurrent versions of the context share the session's owner, the newest turn's metadata is used
+		for _, item := range readResp.GetData() {
+			if item.Val == "" {
+				continue
+			}
+			var data metadataPayload
+			if errUnmarshal := decodeEnvelope([]byte(item.Val), mode, &data); errUnmarshal != nil {
+				log.Errorf("FReD: Failed to unmarshal metadata for session ID %s: %v", sessionID, errUnmarshal)
+				return SessionMetadata{}, fmt.Errorf("failed to unmarshal metadata from FReD: %w", errUnmarshal)
+			}
+			if !found || data.Turn > newest.Turn {
+				newest = data
+			}
+			found = true
+		}
+	}
+	if !found {
+		log.Warnf("FReD: No metadata (NotFound) for session ID: %s in keygroup: %s.", sessionID, f.keygroup)
+		return SessionMetadata{}, ErrFredNotFound
+	}
+	return newest.SessionMetadata, nil
+}
+
+// DeleteSessionContext removes the session's contexts from FReD: the raw one and the tokenized ones of every model
+// namespace, with their chunks. These are found by listing the keys of the keygroup. A tombstone is stored first; it
+// replicates like the contexts, so other nodes refuse the session even before the deletes reach them.
+func (f *FReDContextStorage) DeleteSessionContext(ctx context.Context, sessionID string) error {
 	startTime := time.Now()
 	defer func() {
 		log.Infof("FReD: DeleteSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	log.Infof("FReD: Attempting to delete tokenized context for session ID: %s from keygroup: %s", sessionID, f.keygroup)
+	log.Infof("FReD: Attempting to delete context for session ID: %s from keygroup: %s", sessionID, f.keygroup)
+
+	tombstone, err := encodeEnvelope(payloadVersionJSON, modeTombstone, tombstonePayload{DeletedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal the tombstone of session %s: %w", sessionID, err)
+	}
+	if err := f.writeKey(ctx, f.Keys.TombstoneKey(sessionID), tombstone); err != nil {
+		return err
+	}
+
+	deleted := 0
+	err = f.forEachKey(ctx, func(id string) error {
+		_, mode, _, keySessionID, ok := ParseKey(id)
+		if !ok || keySessionID != sessionID || mode == modeTombstone {
+			return nil
+		}
+		deleted++
+		return f.deleteKey(ctx, id)
+	})
+	if err != nil {
+		log.Errorf("FReD: Failed to delete the contexts of session ID %s: %v", sessionID, err)
+		return err
+	}
 
+	log.Infof("FReD: Successfully deleted %d keys of session ID %s from FReD", deleted, sessionID)
+	return nil
+}
+
+// IsSessionDeleted implements ContextStorage, it reads the session's tombstone.
+func (f *FReDContextStorage) IsSessionDeleted(ctx context.Context, sessionID string) (bool, error) {
+	_, err := f.readKey(ctx, f.Keys.TombstoneKey(sessionID))
+	var conflict *ConflictError
+	switch {
+	case err == ErrFredNotFound:
+		return false, nil
+	case err == nil || errors.As(err, &conflict): // Tombstones written concurrently by several nodes
+		return true, nil
+	}
+	return false, fmt.Errorf("failed to read the tombstone of session %s: %w", sessionID, err)
+}
+
+// deleteKey deletes a single key, a key that doesn't exist counts as deleted.
+func (f *FReDContextStorage) deleteKey(ctx context.Context, key string) error {
 	deleteReq := &fredClient.DeleteRequest{
 		Keygroup: f.keygroup,
-		Id:       sessionID,
+		Id:       key,
 	}
 
 	fredDeleteOpStartTime := time.Now()
-	_, err := f.client.Delete(context.Background(), deleteReq)
-	log.Debugf("FReD: Delete operation for key %s in keygroup %s took %s", sessionID, f.keygroup, time.Since(fredDeleteOpStartTime))
+	rpcCtx, cancel := f.withRequestTimeout(ctx)
+	defer cancel()
+	_, err := f.client.Delete(rpcCtx, deleteReq)
+	log.Debugf("FReD: Delete operation for key %s in keygroup %s took %s", key, f.keygroup, time.Since(fredDeleteOpStartTime))
 
 	if err != nil {
 		// Check if the error is NotFound, which can be considered a successful deletion if the item didn't exist.
 		s, ok := status.FromError(err)
 		if ok && s.Code() == codes.NotFound {
-			log.Warnf("FReD: Attempted to delete key %s in keygroup %s, but it was not found. Considered deleted.", sessionID, f.keygroup)
-			return nil // Or return ErrFredNotFound if the caller needs to know it wasn't there
+			log.Debugf("FReD: Attempted to delete key %s in keygroup %s, but it was not found. Considered deleted.", key, f.keygroup)
+			return nil
 		}
-		log.Errorf("FReD: Failed to delete key %s in keygroup %s: %v", sessionID, f.keygroup, err)
+		log.Errorf("FReD: Failed to delete key %s in keygroup %s: %v", key, f.keygroup, err)
 		return fmt.Errorf("failed to delete from FReD: %w", err)
 	}
+	return nil
+}
+
+// readKey reads the value of a single key, ErrFredNotFound if it doesn't exist. Unlike the Get methods it does not
+// record the version read, and returns a *ConflictError if the key has concurrent values.
+func (f *FReDContextStorage) readKey(ctx context.Context, key string) (string, error) {
+	rpcCtx, cancel := f.withRequestTimeout(ctx)
+	defer cancel()
+	readResp, err := f.client.Read(rpcCtx, &fredClient.ReadRequest{Keygroup: f.keygroup, Id: key})
+	if err != nil {
+		if s, ok := status.FromError(err); ok && s.Code() == codes.NotFound {
+			return "", ErrFredNotFound
+		}
+		return "", err
+	}
+	if readResp == nil || len(readResp.Data) == 0 || readResp.Data[0].Val == "" {
+		return "", ErrFredNotFound
+	}
+	if len(readResp.Data) > 1 {
+		return "", newConflictError(key, readResp.Data)
+	}
+	return readResp.Data[0].Val, nil
+}
 
-	log.Infof("FReD: Successfully deleted tokenized context from FReD for session ID: %s", sessionID)
+// writeKey sets the value of a single key. If ctx has Versions, the versions of key recorded there are passed to
+// FReD, so the new value replaces the values that were read, and the key is read back: FReD keeps a value written
+// concurrently, i.e. without knowledge of the new one, next to it. Several values are returned as a *ConflictError;
+// the new value is stored regardless. Values that reach the replica later show up as a conflict on the next read.
+func (f *FReDContextStorage) writeKey(ctx context.Context, key string, value []byte) error {
+	versions := versionsFrom(ctx)
+	fredUpdateOpStartTime := time.Now()
+	rpcCtx, cancel := f.withRequestTimeout(ctx)
+	defer cancel()
+	updateResp, err := f.client.Update(rpcCtx, &fredClient.UpdateRequest{Keygroup: f.keygroup, Id: key, Data: string(value), Versions: toFredVersions(versions.get(key))})
+	log.Debugf("FReD: Update operation for key %s in keygroup %s took %s", key, f.keygroup, time.Since(fredUpdateOpStartTime))
+	if err != nil {
+		log.Errorf("FReD: Failed to update key %s in keygroup %s: %v", key, f.keygroup, err)
+		return fmt.Errorf("failed to update FReD: %w", err)
+	}
+	if versions == nil {
+		return nil
+	}
+	if updateResp.GetVersion() != nil {
+		versions.set(key, []VersionVector{fromFredVersion(updateResp.GetVersion())})
+	}
+	readResp, err := f.client.Read(rpcCtx, &fredClient.ReadRequest{Keygroup: f.keygroup, Id: key})
+	if err != nil {
+		// The update was acknowledged, a conflict is still found by the next read
+		log.Warnf("FReD: Failed to read back key %s after updating it: %v", key, err)
+		return nil
+	}
+	if len(readResp.GetData()) > 1 {
+		conflict := newConflictError(key, readResp.GetData())
+		log.Warnf("FReD: %v", conflict)
+		return conflict
+	}
 	return nil
 }
 
+// withRequestTimeout derives the context of a single FReD call from ctx, applying RequestTimeout.
+func (f *FReDContextStorage) withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, f.RequestTimeout)
+}
+
 // IsNotFoundError checks if the error signifies that a context was not found in FReD.
 func (f *FReDContextStorage) IsNotFoundError(err error) bool {
 	return err == ErrFredNotFound
@@ -0,0 +1,50 @@
+package context_storage
+
+import (
+	"context"
+	"testing"
+
+	fredClient "llm-context-management/internal/pkg/fredclient"
+)
+
+func TestFReDDeleteSessionContext(t *testing.T) {
+	ctx := context.Background()
+	items := make(map[string][]*fredClient.Item)
+	storage := &FReDContextStorage{client: &fakeFred{node: "node1", items: items}, keygroup: "test", Keys: KeySchema{Namespace: "model-a"}}
+	other := &FReDContextStorage{client: &fakeFred{node: "node2", items: items}, keygroup: "test", Keys: KeySchema{Namespace: "model-b"}}
+
+	messages := []RawMessage{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}}
+	for _, s := range []*FReDContextStorage{storage, other} {
+		for _, sessionID := range []string{"s1", "s2"} {
+			if err := s.UpdateSessionContext(ctx, sessionID, make([]int, 10), 1, SessionMetadata{}); err != nil {
+				t.Fatalf("UpdateSessionContext: %v", err)
+			}
+		}
+	}
+	if err := storage.UpdateRawSessionContext(ctx, "s1", messages, 1, SessionMetadata{}); err != nil {
+		t.Fatalf("UpdateRawSessionContext: %v", err)
+	}
+	items["v1-tokd-0-model-b-s1"] = []*fredClient.Item{{Id: "v1-tokd-0-model-b-s1", Val: "chunk"}}
+
+	if err := storage.DeleteSessionContext(ctx, "s1"); err != nil {
+		t.Fatalf("DeleteSessionContext: %v", err)
+	}
+	for id := range items {
+		if _, mode, _, sessionID, _ := ParseKey(id); sessionID == "s1" && mode != modeTombstone {
+			t.Errorf("key %s of the deleted session is left", id)
+		}
+	}
+	if _, _, _, err := other.GetTokenizedSessionContext(ctx, "s2"); err != nil {
+		t.Errorf("the context of another session: %v", err)
+	}
+
+	// Every node sharing the keygroup learns of the deletion.
+	for _, s := range []*FReDContextStorage{storage, other} {
+		if deleted, err := s.IsSessionDeleted(ctx, "s1"); !deleted || err != nil {
+			t.Errorf("IsSessionDeleted(s1) on %s = %v, %v; want true", s.Keys.namespace(), deleted, err)
+		}
+		if deleted, err := s.IsSessionDeleted(ctx, "s2"); deleted || err != nil {
+			t.Errorf("IsSessionDeleted(s2) on %s = %v, %v; want false", s.Keys.namespace(), deleted, err)
+		}
+	}
+}
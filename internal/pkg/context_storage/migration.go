@@ -0,0 +1,187 @@
+package context_storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	fredClient "llm-context-management/internal/pkg/fredclient"
+)
+
+// keysPageSize is the number of keys listed per request, see forEachKey and the Redis SCANs.
+const keysPageSize = 100
+
+// MigrationStats counts the entries visited by a migration.
+type MigrationStats struct {
+	Migrated   int // Legacy entries rewritten to the key schema (or that would be, on a dry run)
+	Superseded int // Legacy entries dropped since their session already has a context under the key schema
+	Skipped    int // Entries already in the key schema
+	Failed     int // Entries that could not be migrated, see the log
+}
+
+func (m MigrationStats) String() string {
+	return fmt.Sprintf("migrated: %d, superseded: %d, skipped: %d, failed: %d", m.Migrated, m.Superseded, m.Skipped, m.Failed)
+}
+
+// MigrateLegacyKeys rewrites the contexts stored before the key schema, under the bare session ID, to the schema's
+// keys and envelope, and deletes the legacy entries. Legacy tokenized contexts are moved to the namespace of f.Keys,
+// a legacy entry whose session already has a context under the schema is dropped. Nothing is written on a dry run.
+// It can be repeated, e.g. after a failure, and is meant to run while no node is using the legacy layout.
+func (f *FReDContextStorage) MigrateLegacyKeys(ctx context.Context, dryRun bool) (MigrationStats, error) {
+	var stats MigrationStats
+	err := f.forEachKey(ctx, func(id string) error {
+		f.migrateKey(ctx, id, dryRun, &stats)
+		return nil
+	})
+	return stats, err
+}
+
+// forEachKey calls fn with every key of the keygroup, listed in pages of keysPageSize, until fn fails.
+func (f *FReDContextStorage) forEachKey(ctx context.Context, fn func(id string) error) error {
+	start := ""
+	for {
+		rpcCtx, cancel := f.withRequestTimeout(ctx)
+		resp, err := f.client.Keys(rpcCtx, &fredClient.KeysRequest{Keygroup: f.keygroup, Id: start, Count: keysPageSize})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to list the keys of keygroup '%s' from '%s': %w", f.keygroup, start, err)
+		}
+		keys := resp.GetKeys()
+		if start != "" && len(keys) > 0 && keys[0].GetId() == start {
+			keys = keys[1:] // A page starts with the last key of the previous one
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(key.GetId()); err != nil {
+				return err
+			}
+		}
+		start = keys[len(keys)-1].GetId()
+	}
+}
+
+// migrateKey migrates a single entry of the keygroup, see MigrateLegacyKeys.
+func (f *FReDContextStorage) migrateKey(ctx context.Context, id string, dryRun bool, stats *MigrationStats) {
+	if _, _, _, _, ok := ParseKey(id); ok {
+		stats.Skipped++
+		return
+	}
+	value, err := f.readKey(ctx, id)
+	if err != nil {
+		log.Errorf("FReD migration: Failed to read legacy key %s: %v", id, err)
+		stats.Failed++
+		return
+	}
+	wrapped, mode, err := legacyEnvelope([]byte(value))
+	if err != nil {
+		log.Errorf("FReD migration: Key %s holds no legacy context: %v", id, err)
+		stats.Failed++
+		return
+	}
+	newKey := f.Keys.Key(mode, id)
+	_, err = f.readKey(ctx, newKey)
+	superseded := err == nil
+	if err != nil && err != ErrFredNotFound {
+		log.Errorf("FReD migration: Failed to read key %s: %v", newKey, err)
+		stats.Failed++
+		return
+	}
+
+	switch {
+	case dryRun:
+		log.Infof("FReD migration: Would move %s context %s to %s (superseded: %t)", mode, id, newKey, superseded)
+	case superseded:
+		log.Infof("FReD migration: Session %s already has a %s context under %s, dropping the legacy entry", id, mode, newKey)
+	default:
+		if err := f.writeKey(ctx, newKey, wrapped); err != nil {
+			log.Errorf("FReD migration: Failed to write key %s: %v", newKey, err)
+			stats.Failed++
+			return
+		}
+		log.Infof("FReD migration: Moved %s context %s to %s", mode, id, newKey)
+	}
+	if !dryRun {
+		if err := f.deleteKey(ctx, id); err != nil {
+			log.Errorf("FReD migration: Failed to delete legacy key %s: %v", id, err)
+			stats.Failed++
+			return
+		}
+	}
+	if superseded {
+		stats.Superseded++
+	} else {
+		stats.Migrated++
+	}
+}
+
+// Legacy Redis key prefixes, before the key schema.
+const (
+	legacyRedisTokenizedPrefix = "ctx_"
+	legacyRedisRawPrefix       = "raw_ctx_"
+)
+
+// MigrateLegacyKeys rewrites the contexts stored under the legacy "ctx_" and "raw_ctx_" keys to the key schema,
+// like FReDContextStorage.MigrateLegacyKeys. The new key is only set if it doesn't exist yet.
+func (r *RedisContextStorage) MigrateLegacyKeys(ctx context.Context, dryRun bool) (MigrationStats, error) {
+	var stats MigrationStats
+	for _, prefix := range []string{legacyRedisTokenizedPrefix, legacyRedisRawPrefix} {
+		iter := r.client.Scan(ctx, 0, prefix+"*", keysPageSize).Iterator()
+		for iter.Next(ctx) {
+			r.migrateKey(ctx, iter.Val(), strings.TrimPrefix(iter.Val(), prefix), dryRun, &stats)
+		}
+		if err := iter.Err(); err != nil {
+			return stats, fmt.Errorf("failed to scan the keys with prefix %s: %w", prefix, err)
+		}
+	}
+	return stats, nil
+}
+
+// migrateKey migrates a single legacy key of sessionID, see MigrateLegacyKeys.
+func (r *RedisContextStorage) migrateKey(ctx context.Context, key string, sessionID string, dryRun bool, stats *MigrationStats) {
+	value, err := r.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return // Deleted since the scan
+	} else if err != nil {
+		log.Errorf("Redis migration: Failed to read legacy key %s: %v", key, err)
+		stats.Failed++
+		return
+	}
+	wrapped, mode, err := legacyEnvelope([]byte(value))
+	if err != nil {
+		log.Errorf("Redis migration: Key %s holds no legacy context: %v", key, err)
+		stats.Failed++
+		return
+	}
+	newKey := r.Keys.Key(mode, sessionID)
+	if dryRun {
+		log.Infof("Redis migration: Would move %s context %s to %s", mode, key, newKey)
+		stats.Migrated++
+		return
+	}
+
+	var set *redis.BoolCmd
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		set = pipe.SetNX(ctx, newKey, wrapped, 0)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Redis migration: Failed to move %s to %s: %v", key, newKey, err)
+		stats.Failed++
+		return
+	}
+	if set.Val() {
+		log.Infof("Redis migration: Moved %s context %s to %s", mode, key, newKey)
+		stats.Migrated++
+	} else {
+		log.Infof("Redis migration: Session %s already has a %s context under %s, dropped the legacy entry", sessionID, mode, newKey)
+		stats.Superseded++
+	}
+}
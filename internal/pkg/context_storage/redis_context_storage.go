@@ -2,7 +2,6 @@ package context_storage
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"time"
 
@@ -12,18 +11,22 @@ import (
 
 // RedisContextData is the structure stored as JSON in Redis.
 type RedisContextData struct {
-	Context []int `json:"context"`
-	Turn    int   `json:"turn"`
+	TokenData
+	Turn int `json:"turn"`
+	SessionMetadata
 }
 
 // RawRedisContextData is the structure stored as JSON in Redis for raw context.
 type RawRedisContextData struct {
 	Messages []RawMessage `json:"messages"`
 	Turn     int          `json:"turn"`
+	SessionMetadata
 }
 
 type RedisContextStorage struct {
-	client *redis.Client
+	client     *redis.Client
+	Keys       KeySchema  // Key layout, its Namespace separates the tokenized contexts of models
+	TokenCodec TokenCodec // Encoding of written tokens, nil for a JSON array; reads detect the codec
 }
 
 func NewRedisContextStorage(addr, password string, db int) *RedisContextStorage {
@@ -35,14 +38,13 @@ func NewRedisContextStorage(addr, password string, db int) *RedisContextStorage
 	return &RedisContextStorage{client: client}
 }
 
-func (r *RedisContextStorage) GetTokenizedSessionContext(sessionID string) ([]int, int, error) {
+func (r *RedisContextStorage) GetTokenizedSessionContext(ctx context.Context, sessionID string) ([]int, int, SessionMetadata, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("Redis: GetTokenizedSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	ctx := context.Background()
-	cacheKey := "ctx_" + sessionID
+	cacheKey := r.Keys.Key(ModeTokenized, sessionID)
 	log.Infof("Redis: Attempting to retrieve tokenized context for session ID: %s from cache key: %s", sessionID, cacheKey)
 
 	redisStartTime := time.Now()
@@ -51,37 +53,41 @@ func (r *RedisContextStorage) GetTokenizedSessionContext(sessionID string) ([]in
 
 	if err == redis.Nil {
 		log.Warnf("Redis: Cache miss for session ID: %s.", sessionID)
-		return nil, 0, redis.Nil
+		return nil, 0, SessionMetadata{}, redis.Nil
 	} else if err != nil {
 		log.Errorf("Redis: Error checking Redis cache for session ID %s: %v", sessionID, err)
-		return nil, 0, fmt.Errorf("failed to check cache: %w", err)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to check cache: %w", err)
 	}
 
 	if cachedJSON == "" {
 		log.Warnf("Redis: Cache hit for session ID: %s, but data is empty. Returning empty context and turn 0.", sessionID)
-		return []int{}, 0, nil
+		return []int{}, 0, SessionMetadata{}, nil
 	}
 
 	log.Infof("Redis: Cache hit for session ID: %s", sessionID)
 	unmarshalStartTime := time.Now()
 	var data RedisContextData
-	err = json.Unmarshal([]byte(cachedJSON), &data)
+	err = decodeEnvelope([]byte(cachedJSON), ModeTokenized, &data)
 	log.Debugf("Redis: JSON unmarshal for session %s took %s", sessionID, time.Since(unmarshalStartTime))
 	if err != nil {
 		log.Errorf("Redis: Failed to unmarshal cached data for session ID %s: %v. Data: %s", sessionID, err, cachedJSON)
-		return nil, 0, fmt.Errorf("failed to unmarshal cached data from Redis: %w", err)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to unmarshal cached data from Redis: %w", err)
 	}
-	return data.Context, data.Turn, nil
+	tokens, err := data.tokens()
+	if err != nil {
+		log.Errorf("Redis: Failed to decode cached tokens for session ID %s: %v", sessionID, err)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to decode cached tokens from Redis: %w", err)
+	}
+	return tokens, data.Turn, data.SessionMetadata, nil
 }
 
-func (r *RedisContextStorage) GetRawSessionContext(sessionID string) ([]RawMessage, int, error) {
+func (r *RedisContextStorage) GetRawSessionContext(ctx context.Context, sessionID string) ([]RawMessage, int, SessionMetadata, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("Redis: GetRawSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	ctx := context.Background()
-	cacheKey := "raw_ctx_" + sessionID
+	cacheKey := r.Keys.Key(ModeRaw, sessionID)
 	log.Infof("Redis: Attempting to retrieve raw context for session ID: %s from cache key: %s", sessionID, cacheKey)
 
 	redisStartTime := time.Now()
@@ -90,37 +96,36 @@ func (r *RedisContextStorage) GetRawSessionContext(sessionID string) ([]RawMessa
 
 	if err == redis.Nil {
 		log.Warnf("Redis: Cache miss for raw session ID: %s.", sessionID)
-		return nil, 0, redis.Nil
+		return nil, 0, SessionMetadata{}, redis.Nil
 	} else if err != nil {
 		log.Errorf("Redis: Error checking Redis cache for raw session ID %s: %v", sessionID, err)
-		return nil, 0, fmt.Errorf("failed to check raw cache: %w", err)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to check raw cache: %w", err)
 	}
 
 	if cachedJSON == "" {
 		log.Warnf("Redis: Cache hit for raw session ID: %s, but data is empty. Returning empty context and turn 0.", sessionID)
-		return []RawMessage{}, 0, nil
+		return []RawMessage{}, 0, SessionMetadata{}, nil
 	}
 
 	log.Infof("Redis: Cache hit for raw session ID: %s", sessionID)
 	unmarshalStartTime := time.Now()
 	var data RawRedisContextData
-	err = json.Unmarshal([]byte(cachedJSON), &data)
+	err = decodeEnvelope([]byte(cachedJSON), ModeRaw, &data)
 	log.Debugf("Redis: JSON unmarshal for raw session %s took %s", sessionID, time.Since(unmarshalStartTime))
 	if err != nil {
 		log.Errorf("Redis: Failed to unmarshal cached raw data for session ID %s: %v. Data: %s", sessionID, err, cachedJSON)
-		return nil, 0, fmt.Errorf("failed to unmarshal cached raw data from Redis: %w", err)
+		return nil, 0, SessionMetadata{}, fmt.Errorf("failed to unmarshal cached raw data from Redis: %w", err)
 	}
-	return data.Messages, data.Turn, nil
+	return data.Messages, data.Turn, data.SessionMetadata, nil
 }
 
-func (r *RedisContextStorage) UpdateSessionContext(sessionID string, newFullTokenizedContext []int, newTurn int) error {
+func (r *RedisContextStorage) UpdateSessionContext(ctx context.Context, sessionID string, newFullTokenizedContext []int, newTurn int, meta SessionMetadata) error {
 	startTime := time.Now()
 	defer func() {
 		log.Infof("Redis: UpdateSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	ctx := context.Background()
-	cacheKey := "ctx_" + sessionID
+	cacheKey := r.Keys.Key(ModeTokenized, sessionID)
 	log.Infof("Redis: Updating tokenized context cache for session ID: %s to turn %d using cache key: %s", sessionID, newTurn, cacheKey)
 
 	if newFullTokenizedContext == nil {
@@ -128,21 +133,27 @@ func (r *RedisContextStorage) UpdateSessionContext(sessionID string, newFullToke
 		newFullTokenizedContext = []int{}
 	}
 
+	marshalStartTime := time.Now()
+	tokenData, version, tokenSize, err := newTokenData(r.TokenCodec, newFullTokenizedContext)
+	if err != nil {
+		log.Errorf("Redis: Failed to encode tokens for session ID %s: %v", sessionID, err)
+		return err
+	}
 	data := RedisContextData{
-		Context: newFullTokenizedContext,
-		Turn:    newTurn,
+		TokenData:       tokenData,
+		Turn:            newTurn,
+		SessionMetadata: meta,
 	}
-
-	marshalStartTime := time.Now()
-	dataBytes, err := json.Marshal(data)
+	dataBytes, err := encodeEnvelope(version, ModeTokenized, data)
 	log.Debugf("Redis: JSON marshal for new context data (session %s) took %s", sessionID, time.Since(marshalStartTime))
 	if err != nil {
 		log.Errorf("Redis: Failed to marshal data for caching for session ID %s: %v", sessionID, err)
 		return fmt.Errorf("failed to marshal data for Redis: %w", err)
 	}
+	reportPayload(ctx, PayloadStats{Codec: tokenData.Codec, TokenBytes: tokenSize, JSONTokenBytes: jsonTokensSize(newFullTokenizedContext), PayloadBytes: len(dataBytes)})
 
 	redisSetStartTime := time.Now()
-	err = r.client.Set(ctx, cacheKey, dataBytes, 0).Err()
+	err = r.setReplacing(ctx, cacheKey, dataBytes, r.Keys.Key(ModeRaw, sessionID))
 	log.Debugf("Redis: SET for %s took %s", cacheKey, time.Since(redisSetStartTime))
 	if err != nil {
 		log.Errorf("Redis: Failed to update tokenized context in Redis for session ID %s: %v", sessionID, err)
@@ -153,14 +164,13 @@ func (r *RedisContextStorage) UpdateSessionContext(sessionID string, newFullToke
 	return nil
 }
 
-func (r *RedisContextStorage) UpdateRawSessionContext(sessionID string, newMessages []RawMessage, newTurn int) error {
+func (r *RedisContextStorage) UpdateRawSessionContext(ctx context.Context, sessionID string, newMessages []RawMessage, newTurn int, meta SessionMetadata) error {
 	startTime := time.Now()
 	defer func() {
 		log.Infof("Redis: UpdateRawSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	ctx := context.Background()
-	cacheKey := "raw_ctx_" + sessionID
+	cacheKey := r.Keys.Key(ModeRaw, sessionID)
 	log.Infof("Redis: Updating raw context cache for session ID: %s to turn %d using cache key: %s", sessionID, newTurn, cacheKey)
 
 	if newMessages == nil {
@@ -169,20 +179,22 @@ func (r *RedisContextStorage) UpdateRawSessionContext(sessionID string, newMessa
 	}
 
 	data := RawRedisContextData{
-		Messages: newMessages,
-		Turn:     newTurn,
+		Messages:        newMessages,
+		Turn:            newTurn,
+		SessionMetadata: meta,
 	}
 
 	marshalStartTime := time.Now()
-	dataBytes, err := json.Marshal(data)
+	dataBytes, err := encodeEnvelope(payloadVersionJSON, ModeRaw, data)
 	log.Debugf("Redis: JSON marshal for new raw context data (session %s) took %s", sessionID, time.Since(marshalStartTime))
 	if err != nil {
 		log.Errorf("Redis: Failed to marshal raw data for caching for session ID %s: %v", sessionID, err)
 		return fmt.Errorf("failed to marshal raw data for Redis: %w", err)
 	}
+	reportPayload(ctx, PayloadStats{PayloadBytes: len(dataBytes)})
 
 	redisSetStartTime := time.Now()
-	err = r.client.Set(ctx, cacheKey, dataBytes, 0).Err()
+	err = r.setReplacing(ctx, cacheKey, dataBytes, r.Keys.Key(ModeTokenized, sessionID))
 	log.Debugf("Redis: SET for %s took %s", cacheKey, time.Since(redisSetStartTime))
 	if err != nil {
 		log.Errorf("Redis: Failed to update raw context in Redis for session ID %s: %v", sessionID, err)
@@ -193,19 +205,74 @@ func (r *RedisContextStorage) UpdateRawSessionContext(sessionID string, newMessa
 	return nil
 }
 
-func (r *RedisContextStorage) DeleteSessionContext(sessionID string) error {
+// setReplacing sets key and deletes the session's context of the other mode in one transaction, so that a session
+// that switched modes only has its current context stored.
+func (r *RedisContextStorage) setReplacing(ctx context.Context, key string, value []byte, otherModeKey string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, value, 0)
+		pipe.Del(ctx, otherModeKey)
+		return nil
+	})
+	return err
+}
+
+// GetSessionMetadata retrieves the metadata stored with the session's tokenized or raw context.
+func (r *RedisContextStorage) GetSessionMetadata(ctx context.Context, sessionID string) (SessionMetadata, error) {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("Redis: GetSessionMetadata for session %s took %s", sessionID, time.Since(startTime))
+	}()
+
+	for _, mode := range []string{ModeTokenized, ModeRaw} {
+		cacheKey := r.Keys.Key(mode, sessionID)
+		cachedJSON, err := r.client.Get(ctx, cacheKey).Result()
+		if err == redis.Nil || (err == nil && cachedJSON == "") {
+			continue
+		} else if err != nil {
+			log.Errorf("Redis: Error reading metadata for session ID %s from %s: %v", sessionID, cacheKey, err)
+			return SessionMetadata{}, fmt.Errorf("failed to check cache: %w", err)
+		}
+
+		var data metadataPayload
+		if err := decodeEnvelope([]byte(cachedJSON), mode, &data); err != nil {
+			log.Errorf("Redis: Failed to unmarshal metadata for session ID %s: %v", sessionID, err)
+			return SessionMetadata{}, fmt.Errorf("failed to unmarshal metadata from Redis: %w", err)
+		}
+		return data.SessionMetadata, nil
+	}
+	log.Warnf("Redis: No metadata for session ID: %s.", sessionID)
+	return SessionMetadata{}, redis.Nil
+}
+
+// DeleteSessionContext deletes the session's raw context and the tokenized ones of every model namespace, found with
+// a SCAN, and sets its tombstone.
+func (r *RedisContextStorage) DeleteSessionContext(ctx context.Context, sessionID string) error {
 	startTime := time.Now()
 	defer func() {
 		log.Infof("Redis: DeleteSessionContext for session %s took %s", sessionID, time.Since(startTime))
 	}()
 
-	ctx := context.Background()
-	tokenCacheKey := "ctx_" + sessionID
-	rawCacheKey := "raw_ctx_" + sessionID
-	log.Infof("Redis: Attempting to delete context for session ID: %s from cache keys: %s, %s", sessionID, tokenCacheKey, rawCacheKey)
+	keys := []string{r.Keys.Key(ModeRaw, sessionID)}
+	iter := r.client.Scan(ctx, 0, fmt.Sprintf("v%d-tok-*-%s", SchemaVersion, sessionID), keysPageSize).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		log.Errorf("Redis: Failed to find the tokenized contexts of session ID %s: %v", sessionID, err)
+		return fmt.Errorf("failed to scan the keys of session %s: %w", sessionID, err)
+	}
+	log.Infof("Redis: Attempting to delete context for session ID: %s from cache keys: %v", sessionID, keys)
 
+	tombstone, err := encodeEnvelope(payloadVersionJSON, modeTombstone, tombstonePayload{DeletedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal the tombstone of session %s: %w", sessionID, err)
+	}
 	redisDelStartTime := time.Now()
-	err := r.client.Del(ctx, tokenCacheKey, rawCacheKey).Err()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.Keys.TombstoneKey(sessionID), tombstone, 0)
+		pipe.Del(ctx, keys...)
+		return nil
+	})
 	log.Debugf("Redis: DEL for session %s took %s", sessionID, time.Since(redisDelStartTime))
 	if err != nil {
 		log.Errorf("Redis: Failed to delete context from Redis for session ID %s: %v", sessionID, err)
@@ -216,6 +283,15 @@ func (r *RedisContextStorage) DeleteSessionContext(sessionID string) error {
 	return nil
 }
 
+// IsSessionDeleted implements ContextStorage, it checks for the session's tombstone.
+func (r *RedisContextStorage) IsSessionDeleted(ctx context.Context, sessionID string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.Keys.TombstoneKey(sessionID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check the tombstone of session %s: %w", sessionID, err)
+	}
+	return n > 0, nil
+}
+
 // IsNotFoundError checks if the error is redis.Nil, indicating a cache miss.
 func (r *RedisContextStorage) IsNotFoundError(err error) bool {
 	return err == redis.Nil
@@ -0,0 +1,173 @@
+package context_storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the key layout, see KeySchema.
+const SchemaVersion = 1
+
+// Payload versions, stored in the envelope. Payloads of a version newer than maxPayloadVersion are refused instead
+// of being misread, so nodes can be upgraded one by one.
+const (
+	payloadVersionJSON     = 1 // Contexts as JSON, tokens as an int array
+	payloadVersionEncoded  = 2 // Tokens encoded with a TokenCodec, see TokenData
+	payloadVersionManifest = 3 // A manifest of chunks instead of the context, see deltaManifest
+	maxPayloadVersion      = payloadVersionManifest
+)
+
+// Context modes, as used in keys and envelopes.
+const (
+	ModeRaw       = "raw"
+	ModeTokenized = "tokenized"
+)
+
+// modeTombstone is the mode of the tombstone of a deleted session, see KeySchema.TombstoneKey.
+const modeTombstone = "deleted"
+
+// DefaultNamespace is the model namespace of tokenized contexts if none is configured.
+const DefaultNamespace = "default"
+
+// KeySchema is the key layout shared by all backends:
+//
+//	v<version>-raw-<sessionID>
+//	v<version>-tok-<namespace>-<sessionID>
+//	v<version>-rawd-<chunk>-<sessionID>
+//	v<version>-tokd-<chunk>-<namespace>-<sessionID>
+//	v<version>-del-<sessionID>
+//
+// Raw contexts do not depend on the model, tokenized ones are kept per model namespace, e.g. one per tokenizer.
+// Nodes sharing a namespace read each other's tokenized contexts. The chunk keys hold the turns of contexts
+// stored as deltas, see FReDContextStorage.DeltaChunks. The last key marks a deleted session.
+type KeySchema struct {
+	Namespace string // Model namespace of tokenized contexts, DefaultNamespace if empty
+}
+
+// Key returns the key of the session's context in mode.
+func (k KeySchema) Key(mode string, sessionID string) string {
+	if mode == ModeRaw {
+		return fmt.Sprintf("v%d-raw-%s", SchemaVersion, sessionID)
+	}
+	return fmt.Sprintf("v%d-tok-%s-%s", SchemaVersion, k.namespace(), sessionID)
+}
+
+// ChunkKey returns the key of chunk id of the session's context in mode.
+func (k KeySchema) ChunkKey(mode string, sessionID string, id int) string {
+	if mode == ModeRaw {
+		return fmt.Sprintf("v%d-rawd-%d-%s", SchemaVersion, id, sessionID)
+	}
+	return fmt.Sprintf("v%d-tokd-%d-%s-%s", SchemaVersion, id, k.namespace(), sessionID)
+}
+
+// TombstoneKey returns the key marking the session as deleted, see ContextStorage.IsSessionDeleted.
+func (k KeySchema) TombstoneKey(sessionID string) string {
+	return fmt.Sprintf("v%d-del-%s", SchemaVersion, sessionID)
+}
+
+func (k KeySchema) namespace() string {
+	if k.Namespace == "" {
+		return DefaultNamespace
+	}
+	return sanitizeNamespace(k.Namespace)
+}
+
+// sanitizeNamespace keeps letters, digits and "-" of a namespace, e.g. a model name, so keys stay valid FReD IDs.
+func sanitizeNamespace(namespace string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return -1
+	}, namespace)
+}
+
+// ParseKey splits a key of the schema, including chunk and tombstone keys, into its parts. ok is false for keys of
+// other layouts, e.g. legacy keys.
+func ParseKey(key string) (version int, mode string, namespace string, sessionID string, ok bool) {
+	parts := strings.Split(key, "-")
+	if len(parts) < 3 || !strings.HasPrefix(parts[0], "v") {
+		return 0, "", "", "", false
+	}
+	version, err := strconv.Atoi(parts[0][1:])
+	if err != nil {
+		return 0, "", "", "", false
+	}
+	sessionID = parts[len(parts)-1]
+	switch {
+	case parts[1] == "raw" && len(parts) == 3:
+		return version, ModeRaw, "", sessionID, true
+	case parts[1] == "tok" && len(parts) >= 4:
+		return version, ModeTokenized, strings.Join(parts[2:len(parts)-1], "-"), sessionID, true
+	case parts[1] == "rawd" && len(parts) == 4:
+		return version, ModeRaw, "", sessionID, true
+	case parts[1] == "tokd" && len(parts) >= 5:
+		return version, ModeTokenized, strings.Join(parts[3:len(parts)-1], "-"), sessionID, true
+	case parts[1] == "del" && len(parts) == 3:
+		return version, modeTombstone, "", sessionID, true
+	}
+	return 0, "", "", "", false
+}
+
+// Envelope wraps every stored payload with its payload version and mode.
+type Envelope struct {
+	Version int             `json:"v"`
+	Mode    string          `json:"mode"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// tombstonePayload is stored under the tombstone key of a deleted session.
+type tombstonePayload struct {
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// metadataPayload decodes the turn and metadata of a payload of either mode.
+type metadataPayload struct {
+	Turn int `json:"turn"`
+	SessionMetadata
+}
+
+// encodeEnvelope marshals payload into an envelope of version.
+func encodeEnvelope(version int, mode string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Version: version, Mode: mode, Payload: data})
+}
+
+// decodeEnvelope unmarshals the payload of an envelope written in mode into payload.
+func decodeEnvelope(data []byte, mode string, payload interface{}) error {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	if envelope.Version < 1 || envelope.Version > maxPayloadVersion {
+		return fmt.Errorf("unsupported context payload version %d, this node supports up to %d", envelope.Version, maxPayloadVersion)
+	}
+	if mode != "" && envelope.Mode != mode {
+		return fmt.Errorf("payload of mode %q where %q was expected", envelope.Mode, mode)
+	}
+	return json.Unmarshal(envelope.Payload, payload)
+}
+
+// legacyEnvelope wraps a payload written before the key schema, a bare FredContextData/RawFredContextData or the
+// Redis equivalents, detecting its mode by its fields. It is used by the migrations.
+func legacyEnvelope(data []byte) ([]byte, string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, "", err
+	}
+	if _, ok := fields["v"]; ok {
+		return nil, "", fmt.Errorf("payload is already in an envelope")
+	}
+	mode := ModeTokenized
+	if _, ok := fields["messages"]; ok {
+		mode = ModeRaw
+	}
+	wrapped, err := json.Marshal(Envelope{Version: payloadVersionJSON, Mode: mode, Payload: data})
+	return wrapped, mode, err
+}
@@ -0,0 +1,88 @@
+package context_storage
+
+import "testing"
+
+func TestKeySchemaKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		mode      string
+		chunk     int // -1 for the context key
+		want      string
+	}{
+		{name: "raw", namespace: "qwen", mode: ModeRaw, chunk: -1, want: "v1-raw-abc123"},
+		{name: "tokenized", namespace: "qwen", mode: ModeTokenized, chunk: -1, want: "v1-tok-qwen-abc123"},
+		{name: "default namespace", mode: ModeTokenized, chunk: -1, want: "v1-tok-default-abc123"},
+		{name: "sanitized namespace", namespace: "Qwen2.5-7B_Instruct", mode: ModeTokenized, chunk: -1, want: "v1-tok-Qwen25-7BInstruct-abc123"},
+		{name: "raw chunk", namespace: "qwen", mode: ModeRaw, chunk: 3, want: "v1-rawd-3-abc123"},
+		{name: "tokenized chunk", namespace: "my-model", mode: ModeTokenized, chunk: 0, want: "v1-tokd-0-my-model-abc123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema := KeySchema{Namespace: tt.namespace}
+			var got string
+			if tt.chunk < 0 {
+				got = schema.Key(tt.mode, "abc123")
+			} else {
+				got = schema.ChunkKey(tt.mode, "abc123", tt.chunk)
+			}
+			if got != tt.want {
+				t.Errorf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key           string
+		wantOK        bool
+		wantVersion   int
+		wantMode      string
+		wantNamespace string
+		wantSessionID string
+	}{
+		{key: "v1-raw-abc123", wantOK: true, wantVersion: 1, wantMode: ModeRaw, wantSessionID: "abc123"},
+		{key: "v1-tok-default-abc123", wantOK: true, wantVersion: 1, wantMode: ModeTokenized, wantNamespace: "default", wantSessionID: "abc123"},
+		{key: "v2-tok-my-model-abc123", wantOK: true, wantVersion: 2, wantMode: ModeTokenized, wantNamespace: "my-model", wantSessionID: "abc123"},
+		{key: "v1-rawd-3-abc123", wantOK: true, wantVersion: 1, wantMode: ModeRaw, wantSessionID: "abc123"},
+		{key: "v1-tokd-0-my-model-abc123", wantOK: true, wantVersion: 1, wantMode: ModeTokenized, wantNamespace: "my-model", wantSessionID: "abc123"},
+		{key: "v1-del-abc123", wantOK: true, wantVersion: 1, wantMode: modeTombstone, wantSessionID: "abc123"},
+		{key: "abc123"},             // Legacy tokenized key
+		{key: "raw-abc123"},         // Legacy raw key
+		{key: "vx-raw-abc123"},      // Version is not a number
+		{key: "v1-raw-ns-abc123"},   // Raw keys have no namespace
+		{key: "v1-tok-abc123"},      // Namespace missing
+		{key: "v1-rawd-abc123"},     // Chunk missing
+		{key: "v1-tokd-0-abc123"},   // Namespace missing
+		{key: "v1-other-ns-abc123"}, // Unknown mode
+		{key: "x1-raw-abc123"},      // No version prefix
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			version, mode, namespace, sessionID, ok := ParseKey(tt.key)
+			if ok != tt.wantOK || version != tt.wantVersion || mode != tt.wantMode || namespace != tt.wantNamespace || sessionID != tt.wantSessionID {
+				t.Errorf("ParseKey = %d, %q, %q, %q, %v; want %d, %q, %q, %q, %v", version, mode, namespace, sessionID, ok,
+					tt.wantVersion, tt.wantMode, tt.wantNamespace, tt.wantSessionID, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseKeyRoundTrip(t *testing.T) {
+	for _, schema := range []KeySchema{{}, {Namespace: "llama-3-8b"}} {
+		for _, mode := range []string{ModeRaw, ModeTokenized} {
+			keys := []string{schema.Key(mode, "abc123"), schema.ChunkKey(mode, "abc123", 7)}
+			for _, key := range keys {
+				version, gotMode, namespace, sessionID, ok := ParseKey(key)
+				wantNamespace := ""
+				if mode == ModeTokenized {
+					wantNamespace = schema.namespace()
+				}
+				if !ok || version != SchemaVersion || gotMode != mode || namespace != wantNamespace || sessionID != "abc123" {
+					t.Errorf("ParseKey(%q) = %d, %q, %q, %q, %v", key, version, gotMode, namespace, sessionID, ok)
+				}
+			}
+		}
+	}
+}
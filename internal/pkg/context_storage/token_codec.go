@@ -0,0 +1,298 @@
+package context_storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TokenCodec encodes the tokens of a tokenized context into a compact binary form.
+type TokenCodec interface {
+	// Name identifies the codec in stored payloads, so that readers detect it. See ParseTokenCodec.
+	Name() string
+	Encode(tokens []int) ([]byte, error)
+	Decode(data []byte) ([]int, error)
+}
+
+// Token codec names. A codec name with the deflateSuffix is compressed with deflate after encoding.
+const (
+	TokenCodecJSON   = "json"   // JSON int array, as stored without a codec
+	TokenCodecPacked = "packed" // Fixed width uint16 or uint32 per token, little endian
+	TokenCodecVarint = "varint" // Zig-zag varints of the differences between consecutive tokens
+
+	deflateSuffix = "+deflate"
+)
+
+// maxDecodedTokens bounds the decompression of deflated tokens stored without a count, far above any model's context.
+const maxDecodedTokens = 1 << 24
+
+// ParseTokenCodec returns the codec of name, e.g. "varint+deflate". "json" and "" return nil, meaning the tokens
+// are stored as a JSON array.
+func ParseTokenCodec(name string) (TokenCodec, error) {
+	base, compressed := strings.CutSuffix(name, deflateSuffix)
+	var codec TokenCodec
+	switch base {
+	case "", TokenCodecJSON:
+		if compressed {
+			return nil, fmt.Errorf("token codec %q: JSON tokens cannot be compressed", name)
+		}
+		return nil, nil
+	case TokenCodecPacked:
+		codec = packedCodec{}
+	case TokenCodecVarint:
+		codec = varintCodec{}
+	default:
+		return nil, fmt.Errorf("unknown token codec %q", name)
+	}
+	if compressed {
+		codec = deflateCodec{codec}
+	}
+	return codec, nil
+}
+
+// packedCodec stores each token with 2 bytes if all are below 65536, with 4 bytes otherwise. The first byte is the width.
+type packedCodec struct{}
+
+func (packedCodec) Name() string { return TokenCodecPacked }
+
+func (packedCodec) Encode(tokens []int) ([]byte, error) {
+	width := 2
+	for _, token := range tokens {
+		if token < 0 || token > math.MaxUint32 {
+			return nil, fmt.Errorf("token %d out of range", token)
+		}
+		if token > math.MaxUint16 {
+			width = 4
+		}
+	}
+	data := make([]byte, 1, 1+width*len(tokens))
+	data[0] = byte(width)
+	for _, token := range tokens {
+		if width == 2 {
+			data = binary.LittleEndian.AppendUint16(data, uint16(token))
+		} else {
+			data = binary.LittleEndian.AppendUint32(data, uint32(token))
+		}
+	}
+	return data, nil
+}
+
+func (packedCodec) Decode(data []byte) ([]int, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("packed tokens: missing width")
+	}
+	width, data := int(data[0]), data[1:]
+	if (width != 2 && width != 4) || len(data)%width != 0 {
+		return nil, fmt.Errorf("packed tokens: invalid width %d for %d bytes", width, len(data))
+	}
+	tokens := make([]int, 0, len(data)/width)
+	for i := 0; i < len(data); i += width {
+		if width == 2 {
+			tokens = append(tokens, int(binary.LittleEndian.Uint16(data[i:])))
+		} else {
+			tokens = append(tokens, int(binary.LittleEndian.Uint32(data[i:])))
+		}
+	}
+	return tokens, nil
+}
+
+// varintCodec stores the difference of each token to the previous one as a zig-zag varint. That is 1 to 3 bytes for
+// vocabularies below 2^20 tokens and up to 5 bytes per token for any token below 2^32.
+type varintCodec struct{}
+
+func (varintCodec) Name() string { return TokenCodecVarint }
+
+func (varintCodec) Encode(tokens []int) ([]byte, error) {
+	data := make([]byte, 0, 2*len(tokens))
+	previous := 0
+	for _, token := range tokens {
+		if token < 0 || token > math.MaxUint32 {
+			return nil, fmt.Errorf("token %d out of range", token)
+		}
+		data = binary.AppendVarint(data, int64(token-previous))
+		previous = token
+	}
+	return data, nil
+}
+
+func (varintCodec) Decode(data []byte) ([]int, error) {
+	tokens := make([]int, 0, len(data)/2)
+	previous := 0
+	for len(data) > 0 {
+		delta, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("varint tokens: invalid varint after %d tokens", len(tokens))
+		}
+		previous += int(delta)
+		tokens = append(tokens, previous)
+		data = data[n:]
+	}
+	return tokens, nil
+}
+
+// deflateCodec compresses the output of another codec. It favors speed, since it runs on every context update.
+type deflateCodec struct {
+	TokenCodec
+}
+
+func (c deflateCodec) Name() string { return c.TokenCodec.Name() + deflateSuffix }
+
+func (c deflateCodec) Encode(tokens []int) ([]byte, error) {
+	data, err := c.TokenCodec.Encode(tokens)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decompresses at most the size of maxDecodedTokens tokens, see decodeCount.
+func (c deflateCodec) Decode(data []byte) ([]int, error) {
+	return c.decodeCount(data, maxDecodedTokens)
+}
+
+// decodeCount decodes data holding count tokens. The decompressed data is limited to the largest encoding of count
+// tokens, so a corrupt payload cannot expand without bound.
+func (c deflateCodec) decodeCount(data []byte, count int) ([]int, error) {
+	limit := int64(maxEncodedSize(c.TokenCodec, count))
+	data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("deflated tokens: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("deflated tokens: more than %d bytes for %d tokens", limit, count)
+	}
+	return c.TokenCodec.Decode(data)
+}
+
+// maxEncodedSize is the largest size codec encodes count tokens to.
+func maxEncodedSize(codec TokenCodec, count int) int {
+	if _, ok := codec.(packedCodec); ok {
+		return 1 + 4*count
+	}
+	return binary.MaxVarintLen32 * count // A zig-zag varint of a difference between uint32 tokens has up to 5 bytes
+}
+
+// TokenData holds the tokens of a stored tokenized context, either as a JSON array in Context or encoded with a
+// TokenCodec in Tokens. Readers detect the codec by its name.
+type TokenData struct {
+	Context []int  `json:"context,omitempty"`
+	Codec   string `json:"codec,omitempty"`  // Name of the TokenCodec of Tokens
+	Tokens  string `json:"tokens,omitempty"` // Encoded tokens, base64 since FReD stores strings
+	Count   int    `json:"count,omitempty"`  // Number of encoded tokens, bounds the decompression of deflated ones
+}
+
+// newTokenData encodes tokens with codec, as a JSON array if codec is nil. It returns the payload version of the
+// envelope and the encoded size of the tokens.
+func newTokenData(codec TokenCodec, tokens []int) (TokenData, int, int, error) {
+	if codec == nil {
+		return TokenData{Context: tokens}, payloadVersionJSON, jsonTokensSize(tokens), nil
+	}
+	data, err := codec.Encode(tokens)
+	if err != nil {
+		return TokenData{}, 0, 0, fmt.Errorf("failed to encode tokens with %s: %w", codec.Name(), err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	return TokenData{Codec: codec.Name(), Tokens: encoded, Count: len(tokens)}, payloadVersionEncoded, len(encoded), nil
+}
+
+// tokens decodes the tokens with the codec they were stored with.
+func (d TokenData) tokens() ([]int, error) {
+	if d.Codec == "" {
+		if d.Context == nil {
+			return []int{}, nil
+		}
+		return d.Context, nil
+	}
+	codec, err := ParseTokenCodec(d.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		return nil, fmt.Errorf("token codec %q has no encoded form", d.Codec)
+	}
+	data, err := base64.StdEncoding.DecodeString(d.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s tokens: %w", d.Codec, err)
+	}
+	if d.Count == 0 { // Written before the count was stored, or no tokens
+		return codec.Decode(data)
+	}
+	var tokens []int
+	if deflate, ok := codec.(deflateCodec); ok {
+		tokens, err = deflate.decodeCount(data, d.Count)
+	} else {
+		tokens, err = codec.Decode(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) != d.Count {
+		return nil, fmt.Errorf("%s tokens: decoded %d tokens, %d were stored", d.Codec, len(tokens), d.Count)
+	}
+	return tokens, nil
+}
+
+// jsonTokensSize is the size of tokens as a JSON array, without marshalling them.
+func jsonTokensSize(tokens []int) int {
+	size := 2 + max(len(tokens)-1, 0) // Brackets and commas
+	for _, token := range tokens {
+		size += len(strconv.Itoa(token))
+	}
+	return size
+}
+
+// PayloadStats reports the size of a payload written by an update, see WithPayloadStats.
+type PayloadStats struct {
+	Codec          string // Token codec, empty for JSON tokens and raw contexts
+	TokenBytes     int    // Size of the stored tokens
+	JSONTokenBytes int    // Size of all the context's tokens as a JSON array, as written without codec and deltas
+	PayloadBytes   int    // Size of the whole stored value, the chunk and manifest of a delta
+	Chunks         int    // Chunks of a context stored as deltas after the write, 0 if stored as a whole
+}
+
+func (p PayloadStats) String() string {
+	text := fmt.Sprintf("PayloadBytes: %d", p.PayloadBytes)
+	if p.TokenBytes != 0 || p.JSONTokenBytes != 0 {
+		codec := p.Codec
+		if codec == "" {
+			codec = TokenCodecJSON
+		}
+		text = fmt.Sprintf("Codec: %s, TokenBytes: %d, JSONTokenBytes: %d, %s", codec, p.TokenBytes, p.JSONTokenBytes, text)
+	}
+	if p.Chunks > 0 {
+		text += fmt.Sprintf(", Chunks: %d", p.Chunks)
+	}
+	return text
+}
+
+type payloadStatsKey struct{}
+
+// WithPayloadStats returns a context that makes UpdateSessionContext and UpdateRawSessionContext fill in stats.
+func WithPayloadStats(ctx context.Context, stats *PayloadStats) context.Context {
+	return context.WithValue(ctx, payloadStatsKey{}, stats)
+}
+
+// reportPayload stores stats in the PayloadStats of ctx, if any.
+func reportPayload(ctx context.Context, stats PayloadStats) {
+	if target, ok := ctx.Value(payloadStatsKey{}).(*PayloadStats); ok {
+		*target = stats
+	}
+}
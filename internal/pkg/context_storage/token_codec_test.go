@@ -0,0 +1,176 @@
+package context_storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenCodecRoundTrip(t *testing.T) {
+	tokenSets := map[string][]int{
+		"empty":       {},
+		"small":       {151644, 872, 198, 9707, 151645, 198},
+		"below 65536": {0, 1, 65535, 42, 42, 42},
+		"decreasing":  {100000, 50000, 3, 2, 1, 0},
+		"max token":   {math.MaxUint32, 0, math.MaxUint32},
+	}
+	for _, name := range []string{"packed", "varint", "packed+deflate", "varint+deflate"} {
+		codec, err := ParseTokenCodec(name)
+		if err != nil {
+			t.Fatalf("ParseTokenCodec(%q): %v", name, err)
+		}
+		if codec.Name() != name {
+			t.Errorf("ParseTokenCodec(%q).Name() = %q", name, codec.Name())
+		}
+		for setName, tokens := range tokenSets {
+			t.Run(name+"/"+setName, func(t *testing.T) {
+				data, err := codec.Encode(tokens)
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+				if !strings.HasSuffix(name, deflateSuffix) && len(data) > maxEncodedSize(codec, len(tokens)) {
+					t.Errorf("Encode = %d bytes, more than the maximum of %d", len(data), maxEncodedSize(codec, len(tokens)))
+				}
+				got, err := codec.Decode(data)
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				if !reflect.DeepEqual(got, tokens) {
+					t.Errorf("Decode(Encode(tokens)) = %v, want %v", got, tokens)
+				}
+			})
+		}
+	}
+}
+
+func TestParseTokenCodec(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "", wantNil: true},
+		{name: "json", wantNil: true},
+		{name: "json+deflate", wantErr: true},
+		{name: "packed"},
+		{name: "varint+deflate"},
+		{name: "gzip", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, err := ParseTokenCodec(tt.name)
+			if (err != nil) != tt.wantErr || (err == nil && (codec == nil) != tt.wantNil) {
+				t.Errorf("ParseTokenCodec(%q) = %v, %v", tt.name, codec, err)
+			}
+		})
+	}
+}
+
+func TestTokenCodecEncodeErrors(t *testing.T) {
+	for _, name := range []string{"packed", "varint"} {
+		codec, _ := ParseTokenCodec(name)
+		for _, token := range []int{-1, math.MaxUint32 + 1} {
+			if _, err := codec.Encode([]int{1, token}); err == nil {
+				t.Errorf("%s: Encode accepted token %d", name, token)
+			}
+		}
+	}
+}
+
+func TestTokenCodecDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec string
+		data  []byte
+	}{
+		{name: "packed without width", codec: "packed"},
+		{name: "packed invalid width", codec: "packed", data: []byte{3, 0, 0, 0}},
+		{name: "packed odd length", codec: "packed", data: []byte{2, 0, 0, 0}},
+		{name: "varint truncated", codec: "varint", data: []byte{0x80}},
+		{name: "deflate corrupt", codec: "varint+deflate", data: []byte{0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, _ := ParseTokenCodec(tt.codec)
+			if tokens, err := codec.Decode(tt.data); err == nil {
+				t.Errorf("Decode(%v) = %v, want an error", tt.data, tokens)
+			}
+		})
+	}
+}
+
+func TestTokenData(t *testing.T) {
+	tokens := []int{151644, 872, 198, 9707, 151645, 198}
+	varint, _ := ParseTokenCodec("varint+deflate")
+
+	encoded, _, _, err := newTokenData(varint, tokens)
+	if err != nil {
+		t.Fatalf("newTokenData: %v", err)
+	}
+	plain, _, _, _ := newTokenData(nil, tokens)
+	bomb := deflated(t, make([]byte, 1<<20)) // A megabyte of zero deltas
+	tests := []struct {
+		name    string
+		data    TokenData
+		want    []int
+		wantErr bool
+	}{
+		{name: "json", data: plain, want: tokens},
+		{name: "json empty", data: TokenData{}, want: []int{}},
+		{name: "encoded", data: encoded, want: tokens},
+		{name: "without count", data: TokenData{Codec: encoded.Codec, Tokens: encoded.Tokens}, want: tokens},
+		{name: "count mismatch", data: TokenData{Codec: encoded.Codec, Tokens: encoded.Tokens, Count: 5}, wantErr: true},
+		{name: "deflate beyond count", data: TokenData{Codec: "varint+deflate", Tokens: bomb, Count: 10}, wantErr: true},
+		{name: "unknown codec", data: TokenData{Codec: "zstd", Tokens: encoded.Tokens}, wantErr: true},
+		{name: "json codec", data: TokenData{Codec: "json", Tokens: encoded.Tokens}, wantErr: true},
+		{name: "invalid base64", data: TokenData{Codec: "varint", Tokens: "%%%"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.data.tokens()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tokens() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokens() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Encoded tokens do not carry an empty JSON array
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if strings.Contains(string(data), `"context"`) {
+		t.Errorf("Marshal(encoded) = %s, has a context field", data)
+	}
+}
+
+// deflated returns data compressed with deflate, base64 encoded as in TokenData.
+func deflated(t *testing.T, data []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.BestCompression)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestJSONTokensSize(t *testing.T) {
+	for _, tokens := range [][]int{{}, {0}, {1, 22, 333}, {151644, 872, 198}} {
+		data, _ := json.Marshal(tokens)
+		if got := jsonTokensSize(tokens); got != len(data) {
+			t.Errorf("jsonTokensSize(%v) = %d, want %d", tokens, got, len(data))
+		}
+	}
+}
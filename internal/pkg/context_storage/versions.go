@@ -0,0 +1,277 @@
+package context_storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	fredClient "llm-context-management/internal/pkg/fredclient"
+)
+
+// VersionVector is a FReD version of a key: the number of updates per node that led to the value.
+type VersionVector map[string]uint64
+
+func (v VersionVector) String() string {
+	nodes := make([]string, 0, len(v))
+	for node := range v {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = fmt.Sprintf("%s:%d", node, v[node])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Versions records the versions of the keys read by a request, so that its update passes them back to FReD.
+// FReD then only accepts the update if it follows what was read; a concurrent update of the same turn on another
+// node becomes a conflict instead of silently replacing it. See WithVersions.
+type Versions struct {
+	mu   sync.Mutex
+	keys map[string][]VersionVector
+}
+
+type versionsKey struct{}
+
+// WithVersions returns a context that makes the storage record the versions of the contexts read in versions, and
+// pass them back on updates. Without it, updates are not checked against concurrent ones.
+func WithVersions(ctx context.Context, versions *Versions) context.Context {
+	return context.WithValue(ctx, versionsKey{}, versions)
+}
+
+// versionsFrom returns the Versions of ctx, nil if there are none. The methods of a nil *Versions do nothing.
+func versionsFrom(ctx context.Context) *Versions {
+	versions, _ := ctx.Value(versionsKey{}).(*Versions)
+	return versions
+}
+
+func (v *Versions) set(key string, versions []VersionVector) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys == nil {
+		v.keys = make(map[string][]VersionVector)
+	}
+	v.keys[key] = versions
+}
+
+func (v *Versions) get(key string) []VersionVector {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.keys[key]
+}
+
+// snapshot returns a copy of the recorded versions, nil if there are none.
+func (v *Versions) snapshot() map[string][]VersionVector {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var keys map[string][]VersionVector
+	for key, versions := range v.keys {
+		if len(versions) == 0 {
+			continue
+		}
+		if keys == nil {
+			keys = make(map[string][]VersionVector)
+		}
+		keys[key] = versions
+	}
+	return keys
+}
+
+// clone returns a copy of v, which may be nil.
+func (v *Versions) clone() *Versions {
+	return &Versions{keys: v.snapshot()}
+}
+
+// merge records the versions of other in v, replacing those of the same keys.
+func (v *Versions) merge(other *Versions) {
+	for key, versions := range other.snapshot() {
+		v.set(key, versions)
+	}
+}
+
+func fromFredVersion(version *fredClient.Version) VersionVector {
+	return VersionVector(version.GetVersion())
+}
+
+func toFredVersions(versions []VersionVector) []*fredClient.Version {
+	if len(versions) == 0 {
+		return nil
+	}
+	fredVersions := make([]*fredClient.Version, len(versions))
+	for i, version := range versions {
+		fredVersions[i] = &fredClient.Version{Version: version}
+	}
+	return fredVersions
+}
+
+// ConflictBranch is one of the concurrently written values of a context.
+type ConflictBranch struct {
+	Turn    int
+	Version VersionVector
+	SessionMetadata
+}
+
+// ConflictError is returned when concurrent updates of a session's context were detected: a read, or the read-back
+// after an update, found several values written without knowledge of each other, e.g. the same turn accepted by two
+// edge nodes. Resolve it with ConflictResolver.
+type ConflictError struct {
+	SessionID string
+	Mode      string
+	Branches  []ConflictBranch // The concurrent values
+}
+
+func (e *ConflictError) Error() string {
+	turns := make([]string, len(e.Branches))
+	for i, branch := range e.Branches {
+		turns[i] = fmt.Sprintf("turn %d %s", branch.Turn, branch.Version)
+	}
+	return fmt.Sprintf("the %s context of session %s has %d concurrent versions: %s", e.Mode, e.SessionID, len(e.Branches), strings.Join(turns, ", "))
+}
+
+// recordItems records the versions of the values read from key in the Versions of ctx. If there are several
+// values, FReD kept concurrent updates and a *ConflictError is returned.
+func recordItems(ctx context.Context, key string, items []*fredClient.Item) error {
+	versions := make([]VersionVector, 0, len(items))
+	for _, item := range items {
+		if item.GetVersion() != nil {
+			versions = append(versions, fromFredVersion(item.GetVersion()))
+		}
+	}
+	versionsFrom(ctx).set(key, versions)
+	if len(items) <= 1 {
+		return nil
+	}
+	return newConflictError(key, items)
+}
+
+// newConflictError describes the concurrent values of key.
+func newConflictError(key string, items []*fredClient.Item) *ConflictError {
+	_, mode, _, sessionID, _ := ParseKey(key)
+	conflict := &ConflictError{SessionID: sessionID, Mode: mode}
+	for _, item := range items {
+		var data metadataPayload
+		_ = decodeEnvelope([]byte(item.GetVal()), mode, &data) // A branch that cannot be decoded is listed without turn
+		conflict.Branches = append(conflict.Branches, ConflictBranch{Turn: data.Turn, Version: fromFredVersion(item.GetVersion()), SessionMetadata: data.SessionMetadata})
+	}
+	return conflict
+}
+
+// ResolveConflict implements ConflictResolver. It keeps the version with the highest turn whose chunks, if stored as
+// deltas, are all readable; ties are broken by comparing the values. The kept value is written back with the versions
+// of all concurrent values, which replaces them, and the chunks only used by the discarded versions are deleted.
+func (f *FReDContextStorage) ResolveConflict(ctx context.Context, sessionID string, mode string) (ConflictBranch, error) {
+	key := f.Keys.Key(mode, sessionID)
+	rpcCtx, cancel := f.withRequestTimeout(ctx)
+	readResp, err := f.client.Read(rpcCtx, &fredClient.ReadRequest{Keygroup: f.keygroup, Id: key})
+	cancel()
+	if err != nil {
+		if s, ok := status.FromError(err); ok && s.Code() == codes.NotFound {
+			return ConflictBranch{}, ErrFredNotFound
+		}
+		return ConflictBranch{}, fmt.Errorf("failed to read from FReD: %w", err)
+	}
+	items := readResp.GetData()
+	if len(items) == 0 {
+		return ConflictBranch{}, ErrFredNotFound
+	}
+	conflict := newConflictError(key, items)
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		branchA, branchB := conflict.Branches[order[a]], conflict.Branches[order[b]]
+		if branchA.Turn != branchB.Turn {
+			return branchA.Turn > branchB.Turn
+		}
+		return items[order[a]].GetVal() < items[order[b]].GetVal()
+	})
+	kept := -1
+	for _, i := range order {
+		if f.branchComplete(ctx, mode, sessionID, items[i].GetVal()) {
+			kept = i
+			break
+		}
+	}
+	if kept < 0 {
+		return ConflictBranch{}, fmt.Errorf("none of the %d versions of the %s context of session %s is complete", len(items), mode, sessionID)
+	}
+
+	if len(items) > 1 {
+		resolved := &Versions{}
+		resolved.set(key, conflict.versions())
+		if err := f.writeKey(WithVersions(ctx, resolved), key, []byte(items[kept].GetVal())); err != nil {
+			return ConflictBranch{}, err
+		}
+		versionsFrom(ctx).set(key, resolved.get(key))
+		keptChunks := manifestChunks(mode, items[kept].GetVal())
+		for i, item := range items {
+			if i == kept {
+				continue
+			}
+			for _, id := range manifestChunks(mode, item.GetVal()) {
+				if !slices.Contains(keptChunks, id) {
+					if err := f.deleteKey(ctx, f.Keys.ChunkKey(mode, sessionID, id)); err != nil {
+						log.Warnf("FReD: Failed to delete chunk %d of a discarded version of session %s: %v", id, sessionID, err)
+					}
+				}
+			}
+		}
+		log.Infof("FReD: Resolved %d versions of the %s context of session %s to turn %d", len(items), mode, sessionID, conflict.Branches[kept].Turn)
+	}
+	return conflict.Branches[kept], nil
+}
+
+// versions returns the versions of all branches.
+func (e *ConflictError) versions() []VersionVector {
+	versions := make([]VersionVector, 0, len(e.Branches))
+	for _, branch := range e.Branches {
+		if branch.Version != nil {
+			versions = append(versions, branch.Version)
+		}
+	}
+	return versions
+}
+
+// branchComplete reports whether value is a readable context, including all chunks if it is a manifest.
+func (f *FReDContextStorage) branchComplete(ctx context.Context, mode string, sessionID string, value string) bool {
+	manifest, ok, err := decodeManifest([]byte(value), mode)
+	if err != nil {
+		return false
+	}
+	if !ok {
+		return true
+	}
+	if mode == ModeTokenized {
+		_, err = readDelta(ctx, f, tokenDelta(f.TokenCodec), sessionID, manifest)
+	} else {
+		_, err = readDelta(ctx, f, messageDelta, sessionID, manifest)
+	}
+	return err == nil
+}
+
+// manifestChunks returns the chunk IDs of value, none if it is not a manifest.
+func manifestChunks(mode string, value string) []int {
+	manifest, ok, err := decodeManifest([]byte(value), mode)
+	if err != nil || !ok {
+		return nil
+	}
+	return manifest.Chunks
+}
@@ -0,0 +1,140 @@
+package context_storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	fredClient "llm-context-management/internal/pkg/fredclient"
+)
+
+// fakeFred keeps versioned values like a FReD node: an update replaces the values whose versions it passes and
+// keeps the others next to the new value, counting the update for node. Nodes sharing items are replicas that
+// replicate immediately.
+type fakeFred struct {
+	fredClient.ClientClient
+	node  string
+	items map[string][]*fredClient.Item
+}
+
+func (f *fakeFred) Read(_ context.Context, req *fredClient.ReadRequest, _ ...grpc.CallOption) (*fredClient.ReadResponse, error) {
+	if len(f.items[req.Id]) == 0 {
+		return nil, status.Error(codes.NotFound, "no such key")
+	}
+	return &fredClient.ReadResponse{Data: f.items[req.Id]}, nil
+}
+
+func (f *fakeFred) Update(_ context.Context, req *fredClient.UpdateRequest, _ ...grpc.CallOption) (*fredClient.UpdateResponse, error) {
+	version := VersionVector{}
+	for _, passed := range req.Versions {
+		for node, counter := range passed.GetVersion() {
+			version[node] = max(version[node], counter)
+		}
+	}
+	var kept []*fredClient.Item
+	var counter uint64
+	for _, item := range f.items[req.Id] {
+		if !version.dominates(fromFredVersion(item.GetVersion())) {
+			kept = append(kept, item)
+		}
+		counter = max(counter, item.GetVersion().GetVersion()[f.node])
+	}
+	version[f.node] = max(version[f.node], counter) + 1
+	newVersion := &fredClient.Version{Version: version}
+	f.items[req.Id] = append(kept, &fredClient.Item{Id: req.Id, Val: req.Data, Version: newVersion})
+	return &fredClient.UpdateResponse{Version: newVersion}, nil
+}
+
+func (f *fakeFred) Keys(_ context.Context, req *fredClient.KeysRequest, _ ...grpc.CallOption) (*fredClient.KeysResponse, error) {
+	var ids []string
+	for id, items := range f.items {
+		if id >= req.Id && len(items) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	resp := &fredClient.KeysResponse{}
+	for _, id := range ids[:min(len(ids), int(req.Count))] {
+		resp.Keys = append(resp.Keys, &fredClient.Key{Id: id})
+	}
+	return resp, nil
+}
+
+func (f *fakeFred) Delete(_ context.Context, req *fredClient.DeleteRequest, _ ...grpc.CallOption) (*fredClient.DeleteResponse, error) {
+	if len(f.items[req.Id]) == 0 {
+		return nil, status.Error(codes.NotFound, "no such key")
+	}
+	delete(f.items, req.Id)
+	return &fredClient.DeleteResponse{}, nil
+}
+
+func TestWriteKeyDetectsConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	items := make(map[string][]*fredClient.Item)
+	storage := &FReDContextStorage{client: &fakeFred{node: "node1", items: items}, keygroup: "test"}
+	other := &FReDContextStorage{client: &fakeFred{node: "node2", items: items}, keygroup: "test"}
+	messages := []RawMessage{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}}
+
+	if err := storage.UpdateRawSessionContext(WithVersions(ctx, &Versions{}), "s1", messages, 1, SessionMetadata{}); err != nil {
+		t.Fatalf("first update: %v", err)
+	}
+
+	// Both nodes read turn 1 and store a turn 2.
+	first, second := &Versions{}, &Versions{}
+	if _, _, _, err := storage.GetRawSessionContext(WithVersions(ctx, first), "s1"); err != nil {
+		t.Fatalf("GetRawSessionContext: %v", err)
+	}
+	if _, _, _, err := other.GetRawSessionContext(WithVersions(ctx, second), "s1"); err != nil {
+		t.Fatalf("GetRawSessionContext: %v", err)
+	}
+	if err := storage.UpdateRawSessionContext(WithVersions(ctx, first), "s1", messages, 2, SessionMetadata{LastRequestID: "a"}); err != nil {
+		t.Fatalf("update based on the latest version: %v", err)
+	}
+	err := other.UpdateRawSessionContext(WithVersions(ctx, second), "s1", messages, 2, SessionMetadata{LastRequestID: "b"})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("concurrent update: err = %v, want a *ConflictError", err)
+	}
+	if len(conflict.Branches) != 2 || conflict.SessionID != "s1" || conflict.Mode != ModeRaw {
+		t.Fatalf("conflict = %+v, want 2 branches of the raw context of s1", conflict)
+	}
+
+	// Reads report the conflict until it is resolved.
+	if _, _, _, err := storage.GetRawSessionContext(WithVersions(ctx, &Versions{}), "s1"); !errors.As(err, &conflict) {
+		t.Errorf("read of concurrent values: err = %v, want a *ConflictError", err)
+	}
+	kept, err := storage.ResolveConflict(ctx, "s1", ModeRaw)
+	if err != nil {
+		t.Fatalf("ResolveConflict: %v", err)
+	}
+	if kept.Turn != 2 {
+		t.Errorf("kept turn %d, want 2", kept.Turn)
+	}
+	if _, turn, meta, err := storage.GetRawSessionContext(WithVersions(ctx, &Versions{}), "s1"); err != nil || turn != 2 || meta.LastRequestID != kept.LastRequestID {
+		t.Errorf("read after resolving = turn %d, request %q, %v; want turn 2, request %q", turn, meta.LastRequestID, err, kept.LastRequestID)
+	}
+}
+
+func TestWriteKeyReadBack(t *testing.T) {
+	ctx := context.Background()
+	fred := &fakeFred{node: "node1", items: make(map[string][]*fredClient.Item)}
+	storage := &FReDContextStorage{client: fred, keygroup: "test"}
+	key := storage.Keys.Key(ModeRaw, "s1")
+	fred.items[key] = []*fredClient.Item{
+		{Id: key, Val: "a", Version: &fredClient.Version{Version: map[string]uint64{"node1": 1}}},
+		{Id: key, Val: "b", Version: &fredClient.Version{Version: map[string]uint64{"node2": 1}}},
+	}
+
+	// Without Versions in ctx, updates are not checked and not read back.
+	if err := storage.writeKey(ctx, key, []byte("c")); err != nil {
+		t.Errorf("writeKey: %v", err)
+	}
+	// With them, the values kept next to the new one are a conflict.
+	if err := storage.writeKey(WithVersions(ctx, &Versions{}), key, []byte("d")); !errors.As(err, new(*ConflictError)) {
+		t.Errorf("writeKey with versions: err = %v, want a *ConflictError", err)
+	}
+}
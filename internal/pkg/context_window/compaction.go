@@ -0,0 +1,77 @@
+package context_window
+
+import (
+	"fmt"
+	"strings"
+
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+)
+
+// SummaryHeader starts the content of the system message holding the summary of compacted turns.
+const SummaryHeader = "Summary of the earlier conversation:"
+
+// CompactionPolicy controls when the older turns of a stored context are replaced by a summary.
+type CompactionPolicy struct {
+	ThresholdTokens int // Stored context size that triggers a compaction after a turn, 0 disables compaction
+	KeepTurns       int // Newest turns kept verbatim
+	SummaryTokens   int // Maximum length of the generated summary
+}
+
+// DefaultCompactionPolicy has compaction disabled, it changes the stored contexts and costs a completion.
+var DefaultCompactionPolicy = CompactionPolicy{
+	ThresholdTokens: 0,
+	KeepTurns:       4,
+	SummaryTokens:   256,
+}
+
+// Enabled reports whether contexts are compacted at all.
+func (p CompactionPolicy) Enabled() bool {
+	return p.ThresholdTokens > 0
+}
+
+// SummaryMessage returns the synthetic system message holding summary.
+func SummaryMessage(summary string) ContextStorage.RawMessage {
+	return ContextStorage.RawMessage{Role: "system", Content: SummaryHeader + "\n" + summary}
+}
+
+// SplitSummary separates the summary of an earlier compaction from the system prompt, as split by SplitTurns.
+// It returns the system prompt without the summary and the summary text, empty if there is none.
+func SplitSummary(system []ContextStorage.RawMessage) ([]ContextStorage.RawMessage, string) {
+	prompt := make([]ContextStorage.RawMessage, 0, len(system))
+	summary := ""
+	for _, msg := range system {
+		if text, ok := strings.CutPrefix(msg.Content, SummaryHeader); ok {
+			summary = strings.TrimSpace(text)
+			continue
+		}
+		prompt = append(prompt, msg)
+	}
+	return prompt, summary
+}
+
+// Transcript renders messages as plain "role: content" paragraphs for the summarization prompt.
+func Transcript(messages []ContextStorage.RawMessage) string {
+	var builder strings.Builder
+	for _, msg := range messages {
+		builder.WriteString(fmt.Sprintf("%s: %s\n\n", msg.Role, msg.Content))
+	}
+	return builder.String()
+}
+
+// SummaryRequest returns the messages asking the model to summarize transcript, extending previousSummary if set.
+func SummaryRequest(previousSummary string, transcript string) []ContextStorage.RawMessage {
+	var builder strings.Builder
+	if previousSummary != "" {
+		builder.WriteString("Summary so far:\n")
+		builder.WriteString(previousSummary)
+		builder.WriteString("\n\n")
+	}
+	builder.WriteString("Conversation:\n")
+	builder.WriteString(transcript)
+	return []ContextStorage.RawMessage{
+		{Role: "system", Content: "You summarize conversations between a user and an assistant. " +
+			"Keep all facts, names, numbers, decisions and open questions the assistant needs to continue the conversation. " +
+			"Write a concise summary in the third person and nothing else."},
+		{Role: "user", Content: builder.String()},
+	}
+}
@@ -0,0 +1,185 @@
+package context_window
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+)
+
+// Policy limits the context sent to the LLM. Stored contexts are not changed, only the prompt built from them.
+type Policy struct {
+	MaxTokens     int // Token budget of the prompt plus the generated answer, 0 uses the model's n_ctx
+	ReserveTokens int // Tokens kept free for the answer if the request does not set n_predict/max_tokens
+}
+
+// DefaultPolicy fits the prompt into the model's context and keeps room for a short answer.
+var DefaultPolicy = Policy{
+	MaxTokens:     0,
+	ReserveTokens: 256,
+}
+
+// PromptBudget returns the tokens available for the prompt, given the model's n_ctx (0 if unknown) and the
+// answer length requested by the client (0 if not set). It returns 0 if there is no limit.
+func (p Policy) PromptBudget(nCtx int, nPredict int) int {
+	maxTokens := p.MaxTokens
+	if maxTokens <= 0 || (nCtx > 0 && nCtx < maxTokens) {
+		maxTokens = nCtx
+	}
+	if maxTokens <= 0 {
+		return 0
+	}
+	reserve := p.ReserveTokens
+	if nPredict > 0 {
+		reserve = nPredict
+	}
+	if budget := maxTokens - reserve; budget > 0 {
+		return budget
+	}
+	return 1
+}
+
+// TokenCounter returns the number of tokens of text.
+type TokenCounter func(ctx context.Context, text string) (int, error)
+
+// SplitTurns splits messages into the leading system messages (the system prompt) and the turns,
+// each starting at a user message.
+func SplitTurns(messages []ContextStorage.RawMessage) ([]ContextStorage.RawMessage, [][]ContextStorage.RawMessage) {
+	i := 0
+	for i < len(messages) && messages[i].Role == "system" {
+		i++
+	}
+	system := messages[:i]
+	var turns [][]ContextStorage.RawMessage
+	for start := i; start < len(messages); {
+		end := start + 1
+		for end < len(messages) && messages[end].Role != "user" {
+			end++
+		}
+		turns = append(turns, messages[start:end])
+		start = end
+	}
+	return system, turns
+}
+
+// FitMessages drops the oldest whole turns of history until render(system prompt, remaining turns, newTurn) fits
+// into budget tokens. The system prompt and newTurn are always kept. It returns the kept history and the number of
+// dropped turns; if even the shortest prompt exceeds the budget, all turns are dropped and the caller decides.
+//
+// A prompt is only tokenized if its length in bytes exceeds the budget, since a token is at least one byte. To limit
+// the tokenize calls, the turns to drop are estimated from the bytes per token of the full prompt and then verified:
+// more turns are dropped while the prompt is too long, and the most recently dropped ones added back while it fits.
+func FitMessages(
+	ctx context.Context,
+	history []ContextStorage.RawMessage,
+	newTurn []ContextStorage.RawMessage,
+	budget int,
+	render func([]ContextStorage.RawMessage) string,
+	count TokenCounter,
+) ([]ContextStorage.RawMessage, int, error) {
+	if budget <= 0 {
+		return history, 0, nil
+	}
+	system, turns := SplitTurns(history)
+	build := func(dropped int) ([]ContextStorage.RawMessage, string) {
+		kept := slices.Clone(system)
+		for _, turn := range turns[dropped:] {
+			kept = append(kept, turn...)
+		}
+		return kept, render(append(slices.Clone(kept), newTurn...))
+	}
+
+	fits := func(prompt string) (bool, error) {
+		if len(prompt) <= budget {
+			return true, nil
+		}
+		tokens, err := count(ctx, prompt)
+		if err != nil {
+			return false, fmt.Errorf("failed to count prompt tokens: %w", err)
+		}
+		return tokens <= budget, nil
+	}
+
+	kept, prompt := build(0)
+	if len(prompt) <= budget {
+		return kept, 0, nil
+	}
+	tokens, err := count(ctx, prompt)
+	if err != nil {
+		return history, 0, fmt.Errorf("failed to count prompt tokens: %w", err)
+	}
+	if tokens <= budget {
+		return kept, 0, nil
+	}
+
+	// Estimate the turns to drop, assuming all turns have the same bytes per token as the full prompt.
+	bytesPerToken := float64(len(prompt)) / float64(tokens)
+	excess := float64(tokens - budget)
+	dropped := 0
+	for dropped < len(turns) && excess > 0 {
+		excess -= float64(len(render(turns[dropped]))) / bytesPerToken
+		dropped++
+	}
+	estimate := dropped
+	for ; dropped < len(turns); dropped++ {
+		_, prompt = build(dropped)
+		ok, err := fits(prompt)
+		if err != nil {
+			return history, 0, err
+		}
+		if ok {
+			break
+		}
+	}
+	// The estimate may drop more turns than needed if they have fewer bytes per token than the prompt on average.
+	// Dropping none is known not to fit.
+	if dropped == estimate {
+		for dropped > 1 {
+			_, prompt = build(dropped - 1)
+			ok, err := fits(prompt)
+			if err != nil {
+				return history, 0, err
+			}
+			if !ok {
+				break
+			}
+			dropped--
+		}
+	}
+	kept, _ = build(dropped)
+	return kept, dropped, nil
+}
+
+// TurnBoundaries returns the start index of every turn in tokens, i.e. of every occurrence of marker, the tokens of
+// the text starting a user message.
+func TurnBoundaries(tokens []int, marker []int) []int {
+	var boundaries []int
+	if len(marker) == 0 {
+		return boundaries
+	}
+	for i := 0; i+len(marker) <= len(tokens); i++ {
+		if slices.Equal(tokens[i:i+len(marker)], marker) {
+			boundaries = append(boundaries, i)
+			i += len(marker) - 1
+		}
+	}
+	return boundaries
+}
+
+// FitTokens drops the oldest whole turns of a tokenized context until it has at most budget tokens. The tokens before
+// the first turn, i.e. the system prompt, are always kept. It returns the kept tokens and the number of dropped turns;
+// without turn boundaries nothing can be dropped without cutting a message, so tokens are returned unchanged.
+func FitTokens(tokens []int, boundaries []int, budget int) ([]int, int) {
+	if budget <= 0 || len(tokens) <= budget || len(boundaries) == 0 {
+		return tokens, 0
+	}
+	prefix := tokens[:boundaries[0]]
+	for dropped := 1; dropped < len(boundaries); dropped++ {
+		rest := tokens[boundaries[dropped]:]
+		if len(prefix)+len(rest) <= budget {
+			return append(slices.Clone(prefix), rest...), dropped
+		}
+	}
+	return slices.Clone(prefix), len(boundaries)
+}
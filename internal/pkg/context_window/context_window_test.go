@@ -0,0 +1,218 @@
+package context_window
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	ContextStorage "llm-context-management/internal/pkg/context_storage"
+)
+
+func TestPromptBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		nCtx     int
+		nPredict int
+		want     int
+	}{
+		{name: "unknown context", policy: DefaultPolicy, want: 0},
+		{name: "model context", policy: DefaultPolicy, nCtx: 4096, want: 4096 - 256},
+		{name: "n_predict replaces reserve", policy: DefaultPolicy, nCtx: 4096, nPredict: 96, want: 4000},
+		{name: "smaller policy", policy: Policy{MaxTokens: 1024, ReserveTokens: 24}, nCtx: 4096, want: 1000},
+		{name: "smaller model", policy: Policy{MaxTokens: 8192, ReserveTokens: 96}, nCtx: 4096, want: 4000},
+		{name: "reserve exceeds context", policy: DefaultPolicy, nCtx: 100, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.PromptBudget(tt.nCtx, tt.nPredict); got != tt.want {
+				t.Errorf("PromptBudget(%d, %d) = %d, want %d", tt.nCtx, tt.nPredict, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTurns(t *testing.T) {
+	system := ContextStorage.RawMessage{Role: "system", Content: "S"}
+	user := ContextStorage.RawMessage{Role: "user", Content: "U"}
+	assistant := ContextStorage.RawMessage{Role: "assistant", Content: "A"}
+
+	tests := []struct {
+		name       string
+		messages   []ContextStorage.RawMessage
+		wantSystem []ContextStorage.RawMessage
+		wantTurns  [][]ContextStorage.RawMessage
+	}{
+		{name: "empty", wantSystem: []ContextStorage.RawMessage{}},
+		{name: "system only", messages: []ContextStorage.RawMessage{system, system}, wantSystem: []ContextStorage.RawMessage{system, system}},
+		{
+			name:       "turns",
+			messages:   []ContextStorage.RawMessage{system, user, assistant, user, assistant},
+			wantSystem: []ContextStorage.RawMessage{system},
+			wantTurns:  [][]ContextStorage.RawMessage{{user, assistant}, {user, assistant}},
+		},
+		{
+			name:       "unanswered turn",
+			messages:   []ContextStorage.RawMessage{user, assistant, user},
+			wantSystem: []ContextStorage.RawMessage{},
+			wantTurns:  [][]ContextStorage.RawMessage{{user, assistant}, {user}},
+		},
+		{
+			name:       "leading assistant message",
+			messages:   []ContextStorage.RawMessage{assistant, user, assistant},
+			wantSystem: []ContextStorage.RawMessage{},
+			wantTurns:  [][]ContextStorage.RawMessage{{assistant}, {user, assistant}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			system, turns := SplitTurns(tt.messages)
+			if len(system) != len(tt.wantSystem) || (len(system) > 0 && !reflect.DeepEqual(system, tt.wantSystem)) {
+				t.Errorf("system = %v, want %v", system, tt.wantSystem)
+			}
+			if !reflect.DeepEqual(turns, tt.wantTurns) {
+				t.Errorf("turns = %v, want %v", turns, tt.wantTurns)
+			}
+		})
+	}
+}
+
+func TestFitMessages(t *testing.T) {
+	history := []ContextStorage.RawMessage{
+		{Role: "system", Content: "S"},
+		{Role: "user", Content: "u1"}, {Role: "assistant", Content: "a1"},
+		{Role: "user", Content: "u2"}, {Role: "assistant", Content: "a2"},
+		{Role: "user", Content: "u3"}, {Role: "assistant", Content: "a3"},
+	}
+	newTurn := []ContextStorage.RawMessage{{Role: "user", Content: "u4"}}
+	// Every message renders to 4 bytes and counts as one token per 4 bytes.
+	render := func(messages []ContextStorage.RawMessage) string {
+		var b strings.Builder
+		for _, message := range messages {
+			b.WriteString(message.Role[:1] + ":" + message.Content[:1] + ";")
+		}
+		return b.String()
+	}
+	count := func(_ context.Context, text string) (int, error) {
+		return len(text) / 4, nil
+	}
+
+	tests := []struct {
+		name        string
+		budget      int
+		wantDropped int
+	}{
+		{name: "no limit", budget: 0, wantDropped: 0},
+		{name: "fits by bytes", budget: 32, wantDropped: 0},
+		{name: "fits by tokens", budget: 8, wantDropped: 0},
+		{name: "drop one turn", budget: 6, wantDropped: 1},
+		{name: "drop two turns", budget: 4, wantDropped: 2},
+		{name: "drop all turns", budget: 1, wantDropped: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, dropped, err := FitMessages(context.Background(), history, newTurn, tt.budget, render, count)
+			if err != nil {
+				t.Fatalf("FitMessages: %v", err)
+			}
+			if dropped != tt.wantDropped {
+				t.Errorf("dropped = %d, want %d", dropped, tt.wantDropped)
+			}
+			want := append(history[:1:1], history[1+2*tt.wantDropped:]...)
+			if !reflect.DeepEqual(kept, want) {
+				t.Errorf("kept = %v, want %v", kept, want)
+			}
+		})
+	}
+}
+
+func TestFitMessagesOverestimate(t *testing.T) {
+	history := []ContextStorage.RawMessage{
+		{Role: "system", Content: "S"},
+		{Role: "user", Content: "long"}, {Role: "assistant", Content: "a1"},
+		{Role: "user", Content: "u2"}, {Role: "assistant", Content: "a2"},
+		{Role: "user", Content: "u3"}, {Role: "assistant", Content: "a3"},
+	}
+	newTurn := []ContextStorage.RawMessage{{Role: "user", Content: "u4"}}
+	render := func(messages []ContextStorage.RawMessage) string {
+		var b strings.Builder
+		for _, message := range messages {
+			b.WriteString(message.Role[:1] + ":" + message.Content[:1] + ";")
+		}
+		return b.String()
+	}
+	// A rendered message is one token, the 4 bytes of "u:l;" are 10. The first turn has 11 of the prompt's 17 tokens
+	// in a quarter of its bytes, so estimating by bytes drops all three turns to cut 11 tokens.
+	count := func(_ context.Context, text string) (int, error) {
+		tokens := 0
+		for i := 0; i+4 <= len(text); i += 4 {
+			if text[i+2] == 'l' {
+				tokens += 10
+			} else {
+				tokens++
+			}
+		}
+		return tokens, nil
+	}
+
+	kept, dropped, err := FitMessages(context.Background(), history, newTurn, 6, render, count)
+	if err != nil {
+		t.Fatalf("FitMessages: %v", err)
+	}
+	if want := append(history[:1:1], history[3:]...); dropped != 1 || !reflect.DeepEqual(kept, want) {
+		t.Errorf("FitMessages = %v, %d dropped; want %v, 1 dropped", kept, dropped, want)
+	}
+}
+
+func TestTurnBoundaries(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []int
+		marker []int
+		want   []int
+	}{
+		{name: "no marker", tokens: []int{1, 2, 3}, want: nil},
+		{name: "single token marker", tokens: []int{0, 9, 1, 9, 2}, marker: []int{9}, want: []int{1, 3}},
+		{name: "multi token marker", tokens: []int{7, 8, 1, 7, 8, 2, 7}, marker: []int{7, 8}, want: []int{0, 3}},
+		{name: "overlapping marker", tokens: []int{7, 7, 7, 1}, marker: []int{7, 7}, want: []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TurnBoundaries(tt.tokens, tt.marker); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TurnBoundaries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitTokens(t *testing.T) {
+	// A system prompt of 2 tokens and three turns of 3 tokens each.
+	tokens := []int{100, 101, 9, 1, 1, 9, 2, 2, 9, 3, 3}
+	boundaries := []int{2, 5, 8}
+
+	tests := []struct {
+		name        string
+		tokens      []int
+		boundaries  []int
+		budget      int
+		want        []int
+		wantDropped int
+	}{
+		{name: "no limit", tokens: tokens, boundaries: boundaries, budget: 0, want: tokens},
+		{name: "fits", tokens: tokens, boundaries: boundaries, budget: 11, want: tokens},
+		{name: "drop one turn", tokens: tokens, boundaries: boundaries, budget: 10, want: []int{100, 101, 9, 2, 2, 9, 3, 3}, wantDropped: 1},
+		{name: "drop two turns", tokens: tokens, boundaries: boundaries, budget: 5, want: []int{100, 101, 9, 3, 3}, wantDropped: 2},
+		{name: "keep only the system prompt", tokens: tokens, boundaries: boundaries, budget: 4, want: []int{100, 101}, wantDropped: 3},
+		{name: "no boundaries", tokens: tokens, budget: 4, want: tokens},
+		{name: "no system prompt", tokens: tokens[2:], boundaries: []int{0, 3, 6}, budget: 3, want: []int{9, 3, 3}, wantDropped: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := FitTokens(tt.tokens, tt.boundaries, tt.budget)
+			if !reflect.DeepEqual(got, tt.want) || dropped != tt.wantDropped {
+				t.Errorf("FitTokens = %v, %d; want %v, %d", got, dropped, tt.want, tt.wantDropped)
+			}
+		})
+	}
+}
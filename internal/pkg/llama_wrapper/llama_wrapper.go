@@ -1,7 +1,9 @@
 package llama_wrapper
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -11,22 +13,38 @@ import (
 	"time"
 )
 
+const maxStreamLineSize = 4 * 1024 * 1024
+
 // LlamaClient wraps the LLaMA.cpp HTTP server endpoints.
+// All calls honor the cancellation and deadline of their context, so an aborted request also stops the generation.
 type LlamaClient struct {
 	BaseURL string
-	APIKey  string // optional
+	APIKey  string        // optional
+	Timeout time.Duration // optional deadline per request (including a whole stream), 0 = none
 }
 type tokenizeResponse struct {
 	Tokens []int `json:"tokens"`
 }
 
+type detokenizeResponse struct {
+	Content string `json:"content"`
+}
+
 // NewLlamaClient creates a new client.
 func NewLlamaClient(baseURL string) *LlamaClient {
 	return &LlamaClient{BaseURL: strings.TrimRight(baseURL, "/")}
 }
 
+// withTimeout derives the context of a single request from ctx, applying the client's Timeout.
+func (c *LlamaClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
 // doRequest is a helper for HTTP requests.
-func (c *LlamaClient) doRequest(method, path string, body interface{}, result interface{}) error {
+func (c *LlamaClient) doRequest(ctx context.Context, method, path string, body interface{}, result interface{}) error {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.doRequest %s %s took %s", method, path, time.Since(startTime))
@@ -43,7 +61,9 @@ func (c *LlamaClient) doRequest(method, path string, body interface{}, result in
 		log.Debugf("LlamaClient.doRequest JSON marshal for %s %s took %s", method, path, time.Since(marshalStartTime))
 		buf = bytes.NewBuffer(b)
 	}
-	req, err := http.NewRequest(method, c.BaseURL+path, buf)
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, buf)
 	if err != nil {
 		log.Errorf("LlamaClient.doRequest failed to create new request for %s %s: %v", method, path, err)
 		return err
@@ -86,106 +106,220 @@ func (c *LlamaClient) doRequest(method, path string, body interface{}, result in
 	return nil
 }
 
+// doStreamRequest is a helper for HTTP requests answered with server-sent events.
+// onEvent is called with the payload of every "data:" line; returning an error from it aborts the stream.
+func (c *LlamaClient) doStreamRequest(ctx context.Context, method, path string, body interface{}, onEvent func(data []byte) error) error {
+	startTime := time.Now()
+	defer func() {
+		log.Debugf("LlamaClient.doStreamRequest %s %s took %s", method, path, time.Since(startTime))
+	}()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("LlamaClient.doStreamRequest failed to marshal body for %s %s: %v", method, path, err)
+		return err
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewBuffer(b))
+	if err != nil {
+		log.Errorf("LlamaClient.doStreamRequest failed to create new request for %s %s: %v", method, path, err)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Errorf("LlamaClient.doStreamRequest HTTP Do failed for %s %s: %v", method, path, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		errBody, _ := io.ReadAll(resp.Body)
+		log.Errorf("LlamaClient.doStreamRequest %s %s returned error status %d: %s", method, path, resp.StatusCode, string(errBody))
+		return fmt.Errorf("server error: status %d, body: %s", resp.StatusCode, string(errBody))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxStreamLineSize) // a single chunk may carry large fields (e.g. probabilities)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue // blank separators, comments and other SSE fields
+		}
+		data := bytes.TrimSpace(line[len("data:"):])
+		if len(data) == 0 {
+			continue
+		}
+		if bytes.Equal(data, []byte("[DONE]")) { // OpenAI-compatible endpoints terminate with [DONE]
+			return nil
+		}
+		if err := onEvent(data); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Errorf("LlamaClient.doStreamRequest failed to read stream for %s %s: %v", method, path, err)
+		return err
+	}
+	return nil
+}
+
 // Health checks server health.
-func (c *LlamaClient) Health() (map[string]interface{}, error) {
+func (c *LlamaClient) Health(ctx context.Context) (map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Health took %s", time.Since(startTime))
 	}()
 	var res map[string]interface{}
-	err := c.doRequest("GET", "/health", nil, &res)
+	err := c.doRequest(ctx, "GET", "/health", nil, &res)
 	return res, err
 }
 
 // Completion sends a prompt and options to /completion.
-func (c *LlamaClient) Completion(req map[string]interface{}) (map[string]interface{}, error) {
+func (c *LlamaClient) Completion(ctx context.Context, req map[string]interface{}) (map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Completion took %s", time.Since(startTime))
 	}()
 	// log.Debugf("LlamaClient.Completion prompt: %s", req["prompt"])
 	var res map[string]interface{}
-	err := c.doRequest("POST", "/completion", req, &res)
+	err := c.doRequest(ctx, "POST", "/completion", req, &res)
 	log.Debugf("Compeltion response: %v", res)
 	return res, err
 }
 
+// CompletionStream sends a prompt to /completion with streaming enabled.
+// onChunk is called for every chunk as it arrives. The last chunk (the one with "stop": true) is returned.
+func (c *LlamaClient) CompletionStream(ctx context.Context, req map[string]interface{}, onChunk func(chunk map[string]interface{}) error) (map[string]interface{}, error) {
+	startTime := time.Now()
+	chunks := 0
+	defer func() {
+		log.Debugf("LlamaClient.CompletionStream took %s (%d chunks)", time.Since(startTime), chunks)
+	}()
+	req["stream"] = true
+
+	var last map[string]interface{}
+	err := c.doStreamRequest(ctx, "POST", "/completion", req, func(data []byte) error {
+		var chunk map[string]interface{}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			log.Errorf("LlamaClient.CompletionStream failed to decode chunk: %v. Chunk: %s", err, string(data))
+			return err
+		}
+		chunks++
+		last = chunk
+		return onChunk(chunk)
+	})
+	return last, err
+}
+
 // Tokenize text to tokens.
-func (c *LlamaClient) Tokenize(content string) ([]int, error) {
+func (c *LlamaClient) Tokenize(ctx context.Context, content string) ([]int, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Tokenize for content length %d took %s", len(content), time.Since(startTime))
 	}()
 	body := map[string]interface{}{"content": content}
 	var res tokenizeResponse
-	err := c.doRequest("POST", "/tokenize", body, &res)
+	err := c.doRequest(ctx, "POST", "/tokenize", body, &res)
 	return res.Tokens, err
 }
 
 // Detokenize tokens to text.
-func (c *LlamaClient) Detokenize(tokens []int) (string, error) {
+func (c *LlamaClient) Detokenize(ctx context.Context, tokens []int) (string, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Detokenize for %d tokens took %s", len(tokens), time.Since(startTime))
 	}()
 	body := map[string]interface{}{"tokens": tokens}
-	var res string                                        // Expecting a simple string response based on typical detokenize endpoints
-	err := c.doRequest("POST", "/detokenize", body, &res) // Assuming the response is directly the string
-	return res, err
+	var res detokenizeResponse
+	err := c.doRequest(ctx, "POST", "/detokenize", body, &res)
+	return res.Content, err
 }
 
 // Embedding for text (and optional image_data).
-func (c *LlamaClient) Embedding(req map[string]interface{}) (map[string]interface{}, error) {
+func (c *LlamaClient) Embedding(ctx context.Context, req map[string]interface{}) (map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Embedding took %s", time.Since(startTime))
 	}()
 	var res map[string]interface{}
-	err := c.doRequest("POST", "/embedding", req, &res)
+	err := c.doRequest(ctx, "POST", "/embedding", req, &res)
 	return res, err
 }
 
 // Infill for code infilling.
-func (c *LlamaClient) Infill(req map[string]interface{}) (map[string]interface{}, error) {
+func (c *LlamaClient) Infill(ctx context.Context, req map[string]interface{}) (map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Infill took %s", time.Since(startTime))
 	}()
 	var res map[string]interface{}
-	err := c.doRequest("POST", "/infill", req, &res)
+	err := c.doRequest(ctx, "POST", "/infill", req, &res)
 	return res, err
 }
 
 // Props returns server properties.
-func (c *LlamaClient) Props() (map[string]interface{}, error) {
+func (c *LlamaClient) Props(ctx context.Context) (map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Props took %s", time.Since(startTime))
 	}()
 	var res map[string]interface{}
-	err := c.doRequest("GET", "/props", nil, &res)
+	err := c.doRequest(ctx, "GET", "/props", nil, &res)
 	return res, err
 }
 
+// MixedPrompt returns a prompt for Completion made of tokens followed by text, as accepted by upstream llama.cpp.
+// The leading empty string makes llama.cpp add the BOS token like for a text prompt, token IDs are taken as they are.
+func MixedPrompt(tokens []int, text string) []interface{} {
+	prompt := make([]interface{}, 0, len(tokens)+2)
+	prompt = append(prompt, "")
+	for _, token := range tokens {
+		prompt = append(prompt, token)
+	}
+	return append(prompt, text)
+}
+
+// ContextSize extracts the context size (n_ctx) from a Props response, 0 if it is missing.
+func ContextSize(props map[string]interface{}) int {
+	if settings, ok := props["default_generation_settings"].(map[string]interface{}); ok {
+		if nCtx, ok := settings["n_ctx"].(float64); ok {
+			return int(nCtx)
+		}
+	}
+	if nCtx, ok := props["n_ctx"].(float64); ok {
+		return int(nCtx)
+	}
+	return 0
+}
+
 // Slots returns current slots state.
-func (c *LlamaClient) Slots() ([]map[string]interface{}, error) {
+func (c *LlamaClient) Slots(ctx context.Context) ([]map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Slots took %s", time.Since(startTime))
 	}()
 	var res []map[string]interface{}
-	err := c.doRequest("GET", "/slots", nil, &res)
+	err := c.doRequest(ctx, "GET", "/slots", nil, &res)
 	return res, err
 }
 
 // Metrics returns Prometheus metrics as plain text.
 // This method does not use doRequest, so logging is added directly.
-func (c *LlamaClient) Metrics() (string, error) {
+func (c *LlamaClient) Metrics(ctx context.Context) (string, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.Metrics took %s", time.Since(startTime))
 	}()
-	req, err := http.NewRequest("GET", c.BaseURL+"/metrics", nil)
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/metrics", nil)
 	if err != nil {
 		log.Errorf("LlamaClient.Metrics failed to create request: %v", err)
 		return "", err
@@ -214,23 +348,47 @@ func (c *LlamaClient) Metrics() (string, error) {
 }
 
 // OpenAI-compatible chat completions.
-func (c *LlamaClient) ChatCompletions(req map[string]interface{}) (map[string]interface{}, error) {
+func (c *LlamaClient) ChatCompletions(ctx context.Context, req map[string]interface{}) (map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.ChatCompletions took %s", time.Since(startTime))
 	}()
 	var res map[string]interface{}
-	err := c.doRequest("POST", "/v1/chat/completions", req, &res)
+	err := c.doRequest(ctx, "POST", "/v1/chat/completions", req, &res)
 	return res, err
 }
 
+// ChatCompletionsStream sends an OpenAI-compatible chat completion request with streaming enabled.
+// onChunk is called for every "chat.completion.chunk" as it arrives. The last chunk is returned.
+func (c *LlamaClient) ChatCompletionsStream(ctx context.Context, req map[string]interface{}, onChunk func(chunk map[string]interface{}) error) (map[string]interface{}, error) {
+	startTime := time.Now()
+	chunks := 0
+	defer func() {
+		log.Debugf("LlamaClient.ChatCompletionsStream took %s (%d chunks)", time.Since(startTime), chunks)
+	}()
+	req["stream"] = true
+
+	var last map[string]interface{}
+	err := c.doStreamRequest(ctx, "POST", "/v1/chat/completions", req, func(data []byte) error {
+		var chunk map[string]interface{}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			log.Errorf("LlamaClient.ChatCompletionsStream failed to decode chunk: %v. Chunk: %s", err, string(data))
+			return err
+		}
+		chunks++
+		last = chunk
+		return onChunk(chunk)
+	})
+	return last, err
+}
+
 // OpenAI-compatible embeddings.
-func (c *LlamaClient) OpenAIEmbeddings(req map[string]interface{}) (map[string]interface{}, error) {
+func (c *LlamaClient) OpenAIEmbeddings(ctx context.Context, req map[string]interface{}) (map[string]interface{}, error) {
 	startTime := time.Now()
 	defer func() {
 		log.Debugf("LlamaClient.OpenAIEmbeddings took %s", time.Since(startTime))
 	}()
 	var res map[string]interface{}
-	err := c.doRequest("POST", "/v1/embeddings", req, &res)
+	err := c.doRequest(ctx, "POST", "/v1/embeddings", req, &res)
 	return res, err
 }
@@ -0,0 +1,228 @@
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const ggufMagic = 0x46554747 // "GGUF", little-endian
+
+// GGUF metadata value types.
+const (
+	ggufUint8 uint32 = iota
+	ggufInt8
+	ggufUint16
+	ggufInt16
+	ggufUint32
+	ggufInt32
+	ggufFloat32
+	ggufBool
+	ggufString
+	ggufArray
+	ggufUint64
+	ggufInt64
+	ggufFloat64
+)
+
+// llama.cpp token types, control and user-defined tokens are parsed as special tokens.
+const (
+	tokenTypeControl     = 3
+	tokenTypeUserDefined = 4
+)
+
+// preTokenizerPatterns maps the "tokenizer.ggml.pre" values of llama.cpp to their patterns.
+var preTokenizerPatterns = map[string]string{
+	"gpt-2":            GPT2Pattern,
+	"gpt2":             GPT2Pattern,
+	"llama3":           Llama3Pattern,
+	"llama-v3":         Llama3Pattern,
+	"llama-bpe":        Llama3Pattern,
+	"falcon3":          Llama3Pattern,
+	"qwen2":            Qwen2Pattern,
+	"deepseek-r1-qwen": Qwen2Pattern,
+}
+
+// ignoreMergesPre are the pre-tokenizers for which llama.cpp looks up whole words before merging.
+var ignoreMergesPre = map[string]bool{"llama3": true, "llama-v3": true, "llama-bpe": true, "falcon3": true}
+
+// LoadGGUF loads the tokenizer embedded in a GGUF model file's metadata. Only the tensor-free header is read.
+func LoadGGUF(path string) (*BPE, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+	metadata, err := readGGUFMetadata(bufio.NewReaderSize(file, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GGUF metadata from %s: %w", path, err)
+	}
+
+	if model, _ := metadata["tokenizer.ggml.model"].(string); model != "gpt2" {
+		return nil, fmt.Errorf("unsupported tokenizer model %q in %s, only byte-level BPE (\"gpt2\") is supported", model, path)
+	}
+	pre, _ := metadata["tokenizer.ggml.pre"].(string)
+	pattern, ok := preTokenizerPatterns[pre]
+	if !ok {
+		return nil, fmt.Errorf("unsupported pre-tokenizer %q in %s", pre, path)
+	}
+	tokens, err := stringArray(metadata, "tokenizer.ggml.tokens")
+	if err != nil {
+		return nil, err
+	}
+	merges, err := stringArray(metadata, "tokenizer.ggml.merges")
+	if err != nil {
+		return nil, err
+	}
+	special := make(map[int]bool)
+	if types, ok := metadata["tokenizer.ggml.token_type"].([]interface{}); ok {
+		for id, tokenType := range types {
+			if t, ok := tokenType.(int64); ok && (t == tokenTypeControl || t == tokenTypeUserDefined) && id < len(tokens) {
+				special[id] = true
+			}
+		}
+	}
+	return newBPE(tokens, merges, special, pattern, ignoreMergesPre[pre])
+}
+
+func stringArray(metadata map[string]interface{}, key string) ([]string, error) {
+	values, ok := metadata[key].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("GGUF metadata has no %s", key)
+	}
+	strs := make([]string, len(values))
+	for i, value := range values {
+		if strs[i], ok = value.(string); !ok {
+			return nil, fmt.Errorf("GGUF metadata %s is not a string array", key)
+		}
+	}
+	return strs, nil
+}
+
+// readGGUFMetadata reads the key-value metadata of a GGUF file (version 2 or 3).
+// Integers are returned as int64 or uint64, arrays as []interface{}.
+func readGGUFMetadata(r io.Reader) (map[string]interface{}, error) {
+	var header struct {
+		Magic       uint32
+		Version     uint32
+		TensorCount uint64
+		KVCount     uint64
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != ggufMagic {
+		return nil, fmt.Errorf("not a GGUF file")
+	}
+	if header.Version < 2 {
+		return nil, fmt.Errorf("unsupported GGUF version %d", header.Version)
+	}
+	metadata := make(map[string]interface{}, header.KVCount)
+	for i := uint64(0); i < header.KVCount; i++ {
+		key, err := readGGUFString(r)
+		if err != nil {
+			return nil, err
+		}
+		var valueType uint32
+		if err := binary.Read(r, binary.LittleEndian, &valueType); err != nil {
+			return nil, err
+		}
+		value, err := readGGUFValue(r, valueType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+func readGGUFString(r io.Reader) (string, error) {
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	if length > 1<<30 {
+		return "", fmt.Errorf("string of %d bytes", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func readGGUFValue(r io.Reader, valueType uint32) (interface{}, error) {
+	var err error
+	switch valueType {
+	case ggufUint8:
+		var v uint8
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return int64(v), err
+	case ggufInt8:
+		var v int8
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return int64(v), err
+	case ggufUint16:
+		var v uint16
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return int64(v), err
+	case ggufInt16:
+		var v int16
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return int64(v), err
+	case ggufUint32:
+		var v uint32
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return int64(v), err
+	case ggufInt32:
+		var v int32
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return int64(v), err
+	case ggufUint64:
+		var v uint64
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case ggufInt64:
+		var v int64
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case ggufFloat32:
+		var v uint32
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return float64(math.Float32frombits(v)), err
+	case ggufFloat64:
+		var v uint64
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return math.Float64frombits(v), err
+	case ggufBool:
+		var v uint8
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return v != 0, err
+	case ggufString:
+		return readGGUFString(r)
+	case ggufArray:
+		var elemType uint32
+		var count uint64
+		if err := binary.Read(r, binary.LittleEndian, &elemType); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+		if count > 1<<28 {
+			return nil, fmt.Errorf("array of %d elements", count)
+		}
+		values := make([]interface{}, count)
+		for i := range values {
+			if values[i], err = readGGUFValue(r, elemType); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown GGUF value type %d", valueType)
+	}
+}
@@ -0,0 +1,200 @@
+package tokenizer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pre-tokenizer patterns of the model families, as in llama.cpp and the models' tokenizer.json.
+const (
+	GPT2Pattern   = `'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+`
+	Llama3Pattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+	Qwen2Pattern  = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+)
+
+// trailingSpaceAlternative is the only lookahead the patterns use, Go's regexp has none, so it is matched by hand:
+// a run of whitespace, without its last character if a non-space follows.
+const trailingSpaceAlternative = `\s+(?!\S)`
+
+// unicodeSpace is what \s matches in the Unicode-aware regex engines the patterns are written for.
+const unicodeSpace = `\s\v\p{Z}\x{85}`
+
+// preTokenizer splits text into words like the pattern's regex would, trying the alternatives in order at each
+// position.
+type preTokenizer struct {
+	alternatives []*regexp.Regexp // nil for trailingSpaceAlternative
+}
+
+func newPreTokenizer(pattern string) (*preTokenizer, error) {
+	p := &preTokenizer{}
+	for _, alternative := range splitAlternatives(pattern) {
+		if alternative == trailingSpaceAlternative {
+			p.alternatives = append(p.alternatives, nil)
+			continue
+		}
+		if strings.Contains(alternative, "(?=") || strings.Contains(alternative, "(?!") || strings.Contains(alternative, "(?<") {
+			return nil, fmt.Errorf("unsupported lookaround in pre-tokenizer pattern %q", alternative)
+		}
+		re, err := regexp.Compile(`^(?:` + translatePattern(alternative) + `)`)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported pre-tokenizer pattern %q: %w", alternative, err)
+		}
+		p.alternatives = append(p.alternatives, re)
+	}
+	return p, nil
+}
+
+func (p *preTokenizer) split(text string) []string {
+	var words []string
+	for len(text) > 0 {
+		n := p.match(text)
+		if n == 0 { // not matched by any alternative, the character is a word of its own
+			_, n = utf8.DecodeRuneInString(text)
+		}
+		words = append(words, text[:n])
+		text = text[n:]
+	}
+	return words
+}
+
+// match returns the length of the word at the start of text.
+func (p *preTokenizer) match(text string) int {
+	for _, re := range p.alternatives {
+		if re == nil {
+			if n := matchTrailingSpace(text); n > 0 {
+				return n
+			}
+			continue
+		}
+		if loc := re.FindStringIndex(text); loc != nil && loc[1] > 0 {
+			return loc[1]
+		}
+	}
+	return 0
+}
+
+func matchTrailingSpace(text string) int {
+	end, last := 0, 0
+	for end < len(text) {
+		r, size := utf8.DecodeRuneInString(text[end:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		last = end
+		end += size
+	}
+	if end == 0 || end == len(text) {
+		return end
+	}
+	return last // backtrack one character, so the space before the non-space isn't taken
+}
+
+// splitAlternatives splits a pattern at its top-level "|".
+func splitAlternatives(pattern string) []string {
+	var alternatives []string
+	depth, inClass, start := 0, false, 0
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '|' && depth == 0:
+			alternatives = append(alternatives, pattern[start:i])
+			start = i + 1
+		}
+	}
+	return append(alternatives, pattern[start:])
+}
+
+// translatePattern rewrites an alternative for Go's regexp: \s matches Unicode whitespace and possessive
+// quantifiers become greedy ones, which gives the same words for these patterns.
+func translatePattern(pattern string) string {
+	var builder strings.Builder
+	inClass, afterQuantifier := false, false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == '\\' && i+1 < len(pattern) {
+			escape := pattern[i : i+2]
+			i++
+			if escape[1] == 'p' || escape[1] == 'P' {
+				if end := strings.IndexByte(pattern[i:], '}'); i+1 < len(pattern) && pattern[i+1] == '{' && end > 0 {
+					escape += pattern[i+1 : i+end+1]
+					i += end
+				}
+			}
+			switch {
+			case escape == `\s` && inClass:
+				builder.WriteString(unicodeSpace)
+			case escape == `\s`:
+				builder.WriteString("[" + unicodeSpace + "]")
+			default:
+				builder.WriteString(escape)
+			}
+			afterQuantifier = false
+			continue
+		}
+		if c == '+' && afterQuantifier && !inClass {
+			afterQuantifier = false
+			continue
+		}
+		builder.WriteByte(c)
+		switch {
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '?' && i > 0 && pattern[i-1] == '(':
+			afterQuantifier = false
+		default:
+			afterQuantifier = c == '?' || c == '*' || c == '+' || c == '}'
+		}
+	}
+	return builder.String()
+}
+
+// byteEncoder maps bytes to the printable characters byte-level BPE vocabularies are written in, as GPT-2 does.
+var byteEncoder, byteDecoder = func() ([256]rune, map[rune]byte) {
+	var encoder [256]rune
+	decoder := make(map[rune]byte, 256)
+	n := 0
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF) {
+			encoder[b] = rune(b)
+		} else {
+			encoder[b] = rune(256 + n)
+			n++
+		}
+		decoder[encoder[b]] = byte(b)
+	}
+	return encoder, decoder
+}()
+
+func encodeBytes(text string) string {
+	var builder strings.Builder
+	for i := 0; i < len(text); i++ {
+		builder.WriteRune(byteEncoder[text[i]])
+	}
+	return builder.String()
+}
+
+func decodeBytes(token string) []byte {
+	decoded := make([]byte, 0, len(token))
+	for _, r := range token {
+		if b, ok := byteDecoder[r]; ok {
+			decoded = append(decoded, b)
+		} else {
+			decoded = append(decoded, string(r)...)
+		}
+	}
+	return decoded
+}
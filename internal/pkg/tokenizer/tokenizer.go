@@ -0,0 +1,262 @@
+package tokenizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tokenizer turns text into token IDs. Llama.LlamaClient implements it over HTTP, BPE in process.
+type Tokenizer interface {
+	Tokenize(ctx context.Context, text string) ([]int, error)
+}
+
+// ErrMismatch is returned by Verify when the tokenizers disagree.
+var ErrMismatch = errors.New("tokenizers disagree")
+
+// maxCachedWords bounds the cache of encoded pre-tokenized words, it is cleared when full.
+const maxCachedWords = 65536
+
+// BPE is a byte-level BPE tokenizer as used by GPT-2, LLaMa 3 and Qwen models.
+// Like llama.cpp's /tokenize endpoint it parses special tokens in the text and doesn't add a BOS token.
+type BPE struct {
+	vocab        map[string]int
+	tokens       []string // by ID
+	special      map[int]bool
+	specialTexts []string // sorted by length, longest first
+	ranks        map[string]int
+	pre          *preTokenizer
+	ignoreMerges bool // words found in the vocabulary are not merged, as for LLaMa 3
+
+	cacheMu sync.Mutex
+	cache   map[string][]int
+}
+
+func newBPE(tokens []string, merges []string, special map[int]bool, pattern string, ignoreMerges bool) (*BPE, error) {
+	pre, err := newPreTokenizer(pattern)
+	if err != nil {
+		return nil, err
+	}
+	t := &BPE{
+		vocab:        make(map[string]int, len(tokens)),
+		tokens:       tokens,
+		special:      special,
+		ranks:        make(map[string]int, len(merges)),
+		pre:          pre,
+		ignoreMerges: ignoreMerges,
+		cache:        make(map[string][]int),
+	}
+	for id, token := range tokens {
+		if _, exists := t.vocab[token]; !exists {
+			t.vocab[token] = id
+		}
+	}
+	for rank, merge := range merges {
+		if _, exists := t.ranks[merge]; !exists {
+			t.ranks[merge] = rank
+		}
+	}
+	for id := range special {
+		if tokens[id] != "" {
+			t.vocab[tokens[id]] = id
+			t.specialTexts = append(t.specialTexts, tokens[id])
+		}
+	}
+	sort.Slice(t.specialTexts, func(i, j int) bool { return len(t.specialTexts[i]) > len(t.specialTexts[j]) })
+	return t, nil
+}
+
+// Load loads a tokenizer from a GGUF model file or a Hugging Face tokenizer.json, by the file extension.
+func Load(path string) (*BPE, error) {
+	if strings.EqualFold(filepath.Ext(path), ".gguf") {
+		return LoadGGUF(path)
+	}
+	return LoadTokenizerJSON(path)
+}
+
+// VocabSize returns the number of tokens.
+func (t *BPE) VocabSize() int {
+	return len(t.tokens)
+}
+
+// Tokenize implements Tokenizer.
+func (t *BPE) Tokenize(_ context.Context, text string) ([]int, error) {
+	return t.Encode(text)
+}
+
+// Encode tokenizes text. Special tokens written in the text, e.g. "<|im_start|>", are encoded as such.
+func (t *BPE) Encode(text string) ([]int, error) {
+	ids := make([]int, 0, len(text)/3+1)
+	for len(text) > 0 {
+		start, special := t.nextSpecial(text)
+		for _, word := range t.pre.split(text[:start]) {
+			wordIDs, err := t.encodeWord(word)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, wordIDs...)
+		}
+		if special == "" {
+			break
+		}
+		ids = append(ids, t.vocab[special])
+		text = text[start+len(special):]
+	}
+	return ids, nil
+}
+
+// nextSpecial finds the first special token in text, the longest one if several start at the same position.
+// It returns len(text) and "" if there is none.
+func (t *BPE) nextSpecial(text string) (int, string) {
+	for i := 0; i < len(text); i++ {
+		for _, special := range t.specialTexts {
+			if strings.HasPrefix(text[i:], special) {
+				return i, special
+			}
+		}
+	}
+	return len(text), ""
+}
+
+func (t *BPE) encodeWord(word string) ([]int, error) {
+	t.cacheMu.Lock()
+	cached, ok := t.cache[word]
+	t.cacheMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	encoded := encodeBytes(word)
+	var ids []int
+	if id, ok := t.vocab[encoded]; ok && t.ignoreMerges {
+		ids = []int{id}
+	} else {
+		for _, symbol := range t.merge(encoded) {
+			id, ok := t.vocab[symbol]
+			if !ok {
+				return nil, fmt.Errorf("token %q is not in the vocabulary", symbol)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	t.cacheMu.Lock()
+	if len(t.cache) >= maxCachedWords {
+		t.cache = make(map[string][]int)
+	}
+	t.cache[word] = ids
+	t.cacheMu.Unlock()
+	return ids, nil
+}
+
+// merge applies the merges to the characters of a byte-encoded word, the lowest ranked pair first.
+func (t *BPE) merge(word string) []string {
+	symbols := make([]string, 0, len(word))
+	for _, r := range word {
+		symbols = append(symbols, string(r))
+	}
+	for len(symbols) > 1 {
+		best, bestRank := -1, 0
+		for i := 0; i < len(symbols)-1; i++ {
+			if rank, ok := t.ranks[symbols[i]+" "+symbols[i+1]]; ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		first, second := symbols[best], symbols[best+1]
+		merged := symbols[:0]
+		for i := 0; i < len(symbols); i++ {
+			if i < len(symbols)-1 && symbols[i] == first && symbols[i+1] == second {
+				merged = append(merged, first+second)
+				i++
+			} else {
+				merged = append(merged, symbols[i])
+			}
+		}
+		symbols = merged
+	}
+	return symbols
+}
+
+// Decode turns token IDs back into text.
+func (t *BPE) Decode(ids []int) (string, error) {
+	var builder strings.Builder
+	var pending []byte
+	for _, id := range ids {
+		if id < 0 || id >= len(t.tokens) {
+			return "", fmt.Errorf("token ID %d out of range", id)
+		}
+		if t.special[id] {
+			builder.Write(pending)
+			pending = pending[:0]
+			builder.WriteString(t.tokens[id])
+			continue
+		}
+		pending = append(pending, decodeBytes(t.tokens[id])...)
+	}
+	builder.Write(pending)
+	return builder.String(), nil
+}
+
+// Samples are texts for Verify, covering contractions, numbers, whitespace runs and non-ASCII text.
+var Samples = []string{
+	"Hello world! How are you doing today?",
+	"I'm sure they'll say it's what we'd've DONE, isn't it?",
+	"The answer is 1234567 or 3.14159, not 42.",
+	"  leading spaces,\ttabs\tand   multiple   spaces  \n\nnew lines\r\n\n   indented\n",
+	"def f(x):\n    return x ** 2  # square\n",
+	"Ünïcödé: naïve café, Straße, 日本語のテキスト, Привет мир, 🙂👍",
+	"email@example.com https://example.com/path?q=1&r=2 {\"key\": [1, 2, 3]}",
+}
+
+// Verify compares the output of candidate with reference for each of samples. A difference, or candidate failing
+// on a sample, is reported as ErrMismatch; a failure of reference is returned as is.
+func Verify(ctx context.Context, candidate Tokenizer, reference Tokenizer, samples []string) error {
+	for i, sample := range samples {
+		want, err := reference.Tokenize(ctx, sample)
+		if err != nil {
+			return fmt.Errorf("reference tokenizer failed on sample %d: %w", i, err)
+		}
+		got, err := candidate.Tokenize(ctx, sample)
+		if err != nil {
+			return fmt.Errorf("%w: sample %d: %v", ErrMismatch, i, err)
+		}
+		for j := 0; j < len(got) || j < len(want); j++ {
+			if j >= len(got) || j >= len(want) || got[j] != want[j] {
+				return fmt.Errorf("%w: sample %d differs at token %d, %d tokens instead of %d", ErrMismatch, i, j, len(got), len(want))
+			}
+		}
+	}
+	return nil
+}
+
+// fingerprintProbes are the texts tokenized by Fingerprint, the Samples and the special tokens of common chat formats.
+var fingerprintProbes = slices.Concat(Samples, []string{
+	"<|im_start|>user\nHi<|im_end|>\n<|endoftext|>",
+	"<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|><|begin_of_text|>",
+	"<start_of_turn>user\nHi<end_of_turn>\n",
+	"[INST] Hi [/INST]</s><|user|>\nHi<|end|>\n",
+})
+
+// Fingerprint identifies a tokenizer by the tokens it produces for fixed probe texts. Models with the same
+// fingerprint, e.g. quantizations of one model, can use each other's token IDs.
+func Fingerprint(ctx context.Context, t Tokenizer) (string, error) {
+	hash := sha256.New()
+	for _, probe := range fingerprintProbes {
+		tokens, err := t.Tokenize(ctx, probe)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(hash, tokens)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8]), nil
+}
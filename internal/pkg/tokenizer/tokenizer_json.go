@@ -0,0 +1,124 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tokenizerJSON is the part of a Hugging Face tokenizer.json that byte-level BPE needs.
+type tokenizerJSON struct {
+	AddedTokens []struct {
+		ID      int    `json:"id"`
+		Content string `json:"content"`
+	} `json:"added_tokens"`
+	PreTokenizer *preTokenizerJSON `json:"pre_tokenizer"`
+	Model        struct {
+		Type         string            `json:"type"`
+		Vocab        map[string]int    `json:"vocab"`
+		Merges       []json.RawMessage `json:"merges"` // "a b" or, in newer files, ["a", "b"]
+		IgnoreMerges bool              `json:"ignore_merges"`
+	} `json:"model"`
+}
+
+type preTokenizerJSON struct {
+	Type          string              `json:"type"`
+	Pretokenizers []*preTokenizerJSON `json:"pretokenizers"`
+	Pattern       struct {
+		Regex string `json:"Regex"`
+	} `json:"pattern"`
+	UseRegex bool `json:"use_regex"`
+}
+
+// pattern returns the split pattern of a ByteLevel pre-tokenizer, alone or after a Split in a Sequence.
+func (p *preTokenizerJSON) pattern() (string, error) {
+	if p == nil {
+		return "", fmt.Errorf("no pre-tokenizer")
+	}
+	switch p.Type {
+	case "ByteLevel":
+		if !p.UseRegex {
+			return "", fmt.Errorf("ByteLevel pre-tokenizer without a split pattern")
+		}
+		return GPT2Pattern, nil
+	case "Sequence":
+		pattern, byteLevel := "", false
+		for _, child := range p.Pretokenizers {
+			switch child.Type {
+			case "Split":
+				if pattern != "" || child.Pattern.Regex == "" {
+					return "", fmt.Errorf("unsupported Split pre-tokenizers")
+				}
+				pattern = child.Pattern.Regex
+			case "ByteLevel":
+				byteLevel = true
+				if child.UseRegex {
+					if pattern != "" {
+						return "", fmt.Errorf("unsupported Split pre-tokenizers")
+					}
+					pattern = GPT2Pattern
+				}
+			default:
+				return "", fmt.Errorf("unsupported pre-tokenizer %q", child.Type)
+			}
+		}
+		if !byteLevel || pattern == "" {
+			return "", fmt.Errorf("not a byte-level pre-tokenizer")
+		}
+		return pattern, nil
+	default:
+		return "", fmt.Errorf("unsupported pre-tokenizer %q", p.Type)
+	}
+}
+
+// LoadTokenizerJSON loads a byte-level BPE tokenizer from a Hugging Face tokenizer.json.
+// All added tokens are parsed as special tokens, as llama.cpp does.
+func LoadTokenizerJSON(path string) (*BPE, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var config tokenizerJSON
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if config.Model.Type != "BPE" {
+		return nil, fmt.Errorf("unsupported tokenizer model %q in %s, only BPE is supported", config.Model.Type, path)
+	}
+	pattern, err := config.PreTokenizer.pattern()
+	if err != nil {
+		return nil, fmt.Errorf("unsupported tokenizer in %s: %w", path, err)
+	}
+
+	size := 0
+	for _, id := range config.Model.Vocab {
+		size = max(size, id+1)
+	}
+	for _, added := range config.AddedTokens {
+		size = max(size, added.ID+1)
+	}
+	tokens := make([]string, size)
+	for token, id := range config.Model.Vocab {
+		tokens[id] = token
+	}
+	special := make(map[int]bool, len(config.AddedTokens))
+	for _, added := range config.AddedTokens {
+		tokens[added.ID] = added.Content
+		special[added.ID] = true
+	}
+
+	merges := make([]string, len(config.Model.Merges))
+	for i, raw := range config.Model.Merges {
+		var merge string
+		if err := json.Unmarshal(raw, &merge); err != nil {
+			var pair []string
+			if err := json.Unmarshal(raw, &pair); err != nil || len(pair) != 2 {
+				return nil, fmt.Errorf("invalid merge %s in %s", raw, path)
+			}
+			merge = strings.Join(pair, " ")
+		}
+		merges[i] = merge
+	}
+	return newBPE(tokens, merges, special, pattern, config.Model.IgnoreMerges)
+}
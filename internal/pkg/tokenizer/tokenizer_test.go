@@ -0,0 +1,199 @@
+package tokenizer
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	Llama "llm-context-management/internal/pkg/llama_wrapper"
+)
+
+// Environment variables of TestVerifyAgainstLlama, which is skipped if they are not set.
+const (
+	llamaURLEnv      = "LLAMA_URL"      // Base URL of a running LLaMa.cpp server, e.g. http://localhost:8080
+	tokenizerPathEnv = "TOKENIZER_PATH" // GGUF file or tokenizer.json of the model it serves
+)
+
+func TestMatchTrailingSpace(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: "abc", want: 0},
+		{text: "   ", want: 3},           // Whitespace up to the end is taken completely
+		{text: "  x", want: 1},           // The space before the non-space is left for it
+		{text: " x", want: 0},            // A single space belongs to the next word
+		{text: "\t\n x", want: 2},        // Any whitespace counts
+		{text: "\u00a0\u00a0x", want: 2}, // Multi-byte whitespace backtracks by one character
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := matchTrailingSpace(tt.text); got != tt.want {
+				t.Errorf("matchTrailingSpace(%q) = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreTokenizerSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		text    string
+		want    []string
+	}{
+		{name: "gpt2 words", pattern: GPT2Pattern, text: "Hello world!", want: []string{"Hello", " world", "!"}},
+		{name: "gpt2 contraction", pattern: GPT2Pattern, text: "I'm here", want: []string{"I", "'m", " here"}},
+		{name: "gpt2 numbers", pattern: GPT2Pattern, text: "123 abc", want: []string{"123", " abc"}},
+		{name: "gpt2 space run", pattern: GPT2Pattern, text: "a   b", want: []string{"a", "  ", " b"}},
+		{name: "gpt2 trailing spaces", pattern: GPT2Pattern, text: "a  ", want: []string{"a", "  "}},
+		{name: "llama3 digit groups", pattern: Llama3Pattern, text: "12345", want: []string{"123", "45"}},
+		{name: "llama3 new lines", pattern: Llama3Pattern, text: "Hello\n\nworld", want: []string{"Hello", "\n\n", "world"}},
+		{name: "llama3 case-insensitive contraction", pattern: Llama3Pattern, text: "DON'T", want: []string{"DON", "'T"}},
+		{name: "qwen2 single digits", pattern: Qwen2Pattern, text: "x42", want: []string{"x", "4", "2"}},
+		{name: "non-ASCII", pattern: Qwen2Pattern, text: "naïve café", want: []string{"naïve", " café"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pre, err := newPreTokenizer(tt.pattern)
+			if err != nil {
+				t.Fatalf("newPreTokenizer: %v", err)
+			}
+			if got := pre.split(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("split(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPreTokenizerRejectsLookaround(t *testing.T) {
+	if _, err := newPreTokenizer(`\p{L}+(?=\s)|\s+`); err == nil {
+		t.Error("newPreTokenizer accepted a lookahead other than the trailing space one")
+	}
+}
+
+// IDs of the multi-character tokens of newFixtureBPE, following the 256 byte tokens.
+const (
+	idHe = 256 + iota
+	idLl
+	idHell
+	idHello
+	idSpaceW
+	idXyz
+	idImEnd
+)
+
+// newFixtureBPE returns a tokenizer with a token for every byte and a few merges, which encode "hello" as one token.
+func newFixtureBPE(t *testing.T, ignoreMerges bool) *BPE {
+	t.Helper()
+	tokens := make([]string, 0, 256+7)
+	for b := 0; b < 256; b++ {
+		tokens = append(tokens, string(byteEncoder[b]))
+	}
+	tokens = append(tokens, "he", "ll", "hell", "hello", encodeBytes(" w"), "xyz", "<|im_end|>")
+	merges := []string{"h e", "l l", "he ll", "hell o", encodeBytes(" ") + " w"}
+	bpe, err := newBPE(tokens, merges, map[int]bool{idImEnd: true}, GPT2Pattern, ignoreMerges)
+	if err != nil {
+		t.Fatalf("newBPE: %v", err)
+	}
+	return bpe
+}
+
+func TestMerge(t *testing.T) {
+	bpe := newFixtureBPE(t, false)
+	tests := []struct {
+		word string
+		want []string
+	}{
+		{word: "hello", want: []string{"hello"}},
+		{word: "hell", want: []string{"hell"}},
+		{word: "lll", want: []string{"ll", "l"}},             // Pairs are merged from the left
+		{word: "hellllo", want: []string{"hell", "ll", "o"}}, // "hell o" does not apply across "ll"
+		{word: "oh", want: []string{"o", "h"}},
+		{word: "x", want: []string{"x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			if got := bpe.merge(tt.word); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merge(%q) = %q, want %q", tt.word, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name         string
+		ignoreMerges bool
+		text         string
+		want         []int
+	}{
+		{name: "merged word", text: "hello", want: []int{idHello}},
+		{name: "two words", text: "hello world", want: []int{idHello, idSpaceW, 'o', 'r', 'l', 'd'}},
+		{name: "special token", text: "hi<|im_end|>hello", want: []int{'h', 'i', idImEnd, idHello}},
+		{name: "bytes", text: "é", want: []int{0xC3, 0xA9}},
+		{name: "word without merges", text: "xyz", want: []int{'x', 'y', 'z'}},
+		{name: "word in vocabulary", ignoreMerges: true, text: "xyz", want: []int{idXyz}},
+		{name: "empty", text: "", want: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newFixtureBPE(t, tt.ignoreMerges).Encode(tt.text)
+			if err != nil {
+				t.Fatalf("Encode(%q): %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Encode(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	bpe := newFixtureBPE(t, false)
+	texts := append([]string{"", "hello<|im_end|>\n<|im_end|>", "hellllo  world  "}, Samples...)
+	for _, text := range texts {
+		t.Run(text, func(t *testing.T) {
+			ids, err := bpe.Encode(text)
+			if err != nil {
+				t.Fatalf("Encode(%q): %v", text, err)
+			}
+			got, err := bpe.Decode(ids)
+			if err != nil {
+				t.Fatalf("Decode(%v): %v", ids, err)
+			}
+			if got != text {
+				t.Errorf("Decode(Encode(%q)) = %q", text, got)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsUnknownIDs(t *testing.T) {
+	bpe := newFixtureBPE(t, false)
+	for _, id := range []int{-1, bpe.VocabSize()} {
+		if text, err := bpe.Decode([]int{'a', id}); err == nil {
+			t.Errorf("Decode(%d) = %q, want an error", id, text)
+		}
+	}
+}
+
+// TestVerifyAgainstLlama compares the tokenizer of a model file with LLaMa.cpp's /tokenize for the model on the Samples.
+func TestVerifyAgainstLlama(t *testing.T) {
+	llamaURL, tokenizerPath := os.Getenv(llamaURLEnv), os.Getenv(tokenizerPathEnv)
+	if llamaURL == "" || tokenizerPath == "" {
+		t.Skipf("%s and %s are not set", llamaURLEnv, tokenizerPathEnv)
+	}
+	bpe, err := Load(tokenizerPath)
+	if err != nil {
+		t.Fatalf("Load(%s): %v", tokenizerPath, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := Verify(ctx, bpe, Llama.NewLlamaClient(llamaURL), Samples); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}